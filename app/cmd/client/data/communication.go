@@ -4,12 +4,48 @@ import (
 	"bytes"
 	"container/list"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"marshmello/pkg/handlers"
+	"marshmello/pkg/link"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+const (
+	// Times a request the first relay refused with RATE_LIMIT_ERROR is sent again
+	MAX_RATE_LIMIT_RETRIES = 3
+	MAX_BACKOFF            = 10 * time.Second
+
+	RELAY_DIAL_TIMEOUT     = 10 * time.Second
+	RELAY_RESPONSE_TIMEOUT = 2 * time.Minute // the first relay answers once the rest of the circuit did
+)
+
+// relayClient sends the requests to the first relay, a relay that stops answering fails them instead of holding them
+var relayClient = newRelayClient()
+
+func newRelayClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: RELAY_DIAL_TIMEOUT}).DialContext
+	transport.ResponseHeaderTimeout = RELAY_RESPONSE_TIMEOUT
+	return &http.Client{Transport: transport}
+}
+
+// RateLimitedError is a request the first relay refused with RATE_LIMIT_ERROR, it went no further
+type RateLimitedError struct {
+	RetryAfter int // seconds the relay asked to wait
+	Body       []byte
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("HTTP error: %s", e.Body)
+}
+
 // SendHttpRequest sends a POST request with JSON data to the given address and msgType path.
+// A request the relay refuses for its rate limit is sent again after backing off.
 func SendHttpRequest(addr string, data interface{}, msgType string) ([]byte, error) {
 	// Convert data to JSON
 	jsonData, err := json.Marshal(data)
@@ -20,8 +56,45 @@ func SendHttpRequest(addr string, data interface{}, msgType string) ([]byte, err
 	// Create the full URL by appending msgType to the address
 	fullURL := fmt.Sprintf("http://%s/%s", addr, msgType)
 
+	return retryRateLimited(func() ([]byte, error) {
+		return postJSON(fullURL, jsonData)
+	})
+}
+
+// OpenHttpRequest is SendHttpRequest returning the answer before its body is read, the caller closes it.
+// An answer with an error status is returned as an error holding its body, unless it's a chunked stream.
+func OpenHttpRequest(addr string, data interface{}, msgType string) (*http.Response, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding JSON: %w", err)
+	}
+
+	fullURL := fmt.Sprintf("http://%s/%s", addr, msgType)
+
+	return retryRateLimited(func() (*http.Response, error) {
+		resp, err := relayClient.Post(fullURL, "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("error sending HTTP request: %w", err)
+		}
+
+		// A chunked stream carries the errors of the nodes further in the circuit, they're read from it
+		if resp.StatusCode == http.StatusOK || resp.Header.Get("Content-Type") == handlers.CHUNKED_CONTENT_TYPE {
+			return resp, nil
+		}
+
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if err := rateLimited(resp, body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("HTTP error: %s", string(body))
+	})
+}
+
+// postJSON sends one POST request with the JSON body to url and returns the answer
+func postJSON(url string, jsonData []byte) ([]byte, error) {
 	// Send the POST request
-	resp, err := http.Post(fullURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := relayClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("error sending HTTP request: %w", err)
 	}
@@ -30,6 +103,9 @@ func SendHttpRequest(addr string, data interface{}, msgType string) ([]byte, err
 	// Check if the response status code indicates an error
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		if err := rateLimited(resp, body); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("HTTP error: %s", string(body))
 	}
 
@@ -42,6 +118,90 @@ func SendHttpRequest(addr string, data interface{}, msgType string) ([]byte, err
 	return respBody, nil
 }
 
+// SendCellRequest sends cells for the session to the node at addr and returns the cells it answered.
+// The cells go over the link to the node, or to its /cell endpoint when it can't open one.
+// Cells the node refuses for its rate limit are sent again after backing off.
+func SendCellRequest(addr string, session string, data []byte) ([]byte, error) {
+	return retryRateLimited(func() ([]byte, error) {
+		return sendCells(addr, session, data)
+	})
+}
+
+// sendCells sends the cells once, see SendCellRequest
+func sendCells(addr string, session string, data []byte) ([]byte, error) {
+	respBody, err := links.Send(addr, session, data)
+	if !errors.Is(err, link.ErrNoLink) {
+		var remote *link.RemoteError
+		if errors.As(err, &remote) {
+			var errResp handlers.ErrorResponse
+			if json.Unmarshal(remote.Payload, &errResp) == nil && errResp.Error == handlers.RATE_LIMIT_ERROR {
+				return nil, &RateLimitedError{RetryAfter: errResp.RetryAfter, Body: remote.Payload}
+			}
+		}
+		return respBody, err
+	}
+
+	fullURL := fmt.Sprintf("http://%s/cell", addr)
+
+	resp, err := relayClient.Post(fullURL, "application/octet-stream", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("error sending HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	if err := rateLimited(resp, respBody); err != nil {
+		return nil, err
+	}
+
+	// The node answers cells even for errors further in the circuit, anything else is its own error
+	if resp.Header.Get("Content-Type") != "application/octet-stream" {
+		return nil, fmt.Errorf("HTTP error: %s", string(respBody))
+	}
+
+	return respBody, nil
+}
+
+// rateLimited returns a RateLimitedError when the relay refused the request for its rate limit, nil otherwise.
+// Only the relay's own refusal has a Retry-After header, a 429 from further in the circuit is answered encrypted.
+func rateLimited(resp *http.Response, body []byte) error {
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		return nil
+	}
+
+	retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return &RateLimitedError{RetryAfter: retryAfter, Body: body}
+}
+
+// retryRateLimited calls send until the relay stops refusing it for its rate limit, or MAX_RATE_LIMIT_RETRIES
+// more times, waiting longer before every retry
+func retryRateLimited[T any](send func() (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+
+		var limited *RateLimitedError
+		if !errors.As(err, &limited) || attempt == MAX_RATE_LIMIT_RETRIES {
+			return resp, err
+		}
+
+		time.Sleep(backoff(attempt, limited.RetryAfter))
+	}
+}
+
+// backoff is how long to wait before retry number attempt (from 0): what the relay asked for,
+// or longer as the delay doubles with every attempt, at most MAX_BACKOFF
+func backoff(attempt int, retryAfter int) time.Duration {
+	delay := time.Duration(1<<attempt) * 500 * time.Millisecond
+	if asked := time.Duration(retryAfter) * time.Second; asked > delay {
+		delay = asked
+	}
+	return min(delay, MAX_BACKOFF)
+}
+
 type MessageSender struct {
 	Circuit list.List
 }
@@ -4,45 +4,199 @@ import (
 	"container/list"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"marshmello/pkg/encryption"
 	"marshmello/pkg/handlers"
+	"strconv"
+	"strings"
 )
 
-// CreateAesRequest, creates the struct
-func CreateAesRequest(encryptor *encryption.RSAEncryptor) (handlers.GetAesRequest, error) {
+// Handshake holds the client secrets of a /get-aes exchange until the relay answers
+type Handshake struct {
+	Version     int
+	Fingerprint string
+	Suites      []int // cipher suites offered
+	Suite       int   // cipher suite the relay picked, set by FinishAesHandshake
+	Transcript  []byte
+	Rsa         encryption.RSAEncryptor
+	X25519      encryption.X25519KeyPair
+}
+
+// CreateAesRequest, generates the client keys for the handshake version and creates the struct.
+// fingerprint is the identity the relay must prove, it is required by the ntor handshake.
+func CreateAesRequest(version int, fingerprint string) (*Handshake, handlers.GetAesRequest, error) {
 	var req handlers.GetAesRequest
 	var err error
 
-	// Encode the RSA public key for transmission
-	req.RsaKey, err = encryption.EncodeRSAPublicKey(encryptor.PublicKey)
+	hs := &Handshake{Version: version, Fingerprint: fingerprint, Suites: cipherSuites}
+	req.Version = version
+	req.Suites = cipherSuites
+
+	switch version {
+	case handlers.HANDSHAKE_RSA:
+		err = hs.Rsa.GenerateKey()
+		if err != nil {
+			return nil, handlers.GetAesRequest{}, err
+		}
+
+		// Encode the RSA public key for transmission
+		req.RsaKey, err = encryption.EncodeRSAPublicKey(hs.Rsa.PublicKey)
+		if err != nil {
+			return nil, handlers.GetAesRequest{}, err
+		}
+	case handlers.HANDSHAKE_X25519, handlers.HANDSHAKE_NTOR:
+		if version == handlers.HANDSHAKE_NTOR && fingerprint == "" {
+			return nil, handlers.GetAesRequest{}, errors.New("ntor handshake needs the relay fingerprint")
+		}
+
+		err = hs.X25519.GenerateKey()
+		if err != nil {
+			return nil, handlers.GetAesRequest{}, err
+		}
+
+		req.X25519Key = encryption.EncodeX25519PublicKey(hs.X25519.PublicKey)
+	default:
+		return nil, handlers.GetAesRequest{}, fmt.Errorf("unsupported handshake version %d", version)
+	}
+
+	return hs, req, nil
+}
+
+// FinishAesHandshake, recovers the key from the relay's /get-aes response, with the size of the suite the relay picked
+func (hs *Handshake) FinishAesHandshake(res handlers.GetAesResponse) ([]byte, error) {
+	// Relays that predate versioning don't echo it and always use RSA
+	if res.Version == 0 {
+		res.Version = handlers.HANDSHAKE_RSA
+	}
+
+	if res.Version != hs.Version {
+		return nil, fmt.Errorf("relay answered with handshake version %d, expected %d", res.Version, hs.Version)
+	}
+
+	if err := hs.setSuite(res.Suite); err != nil {
+		return nil, err
+	}
+	keySize, _ := encryption.SuiteKeySize(hs.Suite)
+
+	switch hs.Version {
+	case handlers.HANDSHAKE_RSA:
+		// Decode the base64-encoded AES key from the response
+		aesKey, err := base64.StdEncoding.DecodeString(res.Aes_key)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := hs.Rsa.Decrypt(aesKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != keySize {
+			return nil, errors.New("relay sent a key of the wrong size for the cipher suite")
+		}
+
+		return key, nil
+	case handlers.HANDSHAKE_X25519:
+		relayKey, err := encryption.DecodeX25519PublicKey(res.X25519Key)
+		if err != nil {
+			return nil, err
+		}
+
+		sharedSecret, err := hs.X25519.SharedSecret(relayKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return encryption.DeriveSessionKey(sharedSecret, hs.X25519.PublicKey, relayKey, keySize)
+	case handlers.HANDSHAKE_NTOR:
+		return hs.finishNtor(res, keySize)
+	}
+
+	return nil, fmt.Errorf("unsupported handshake version %d", hs.Version)
+}
+
+// setSuite, checks the suite the relay picked is one we offered. Relays that predate suites don't answer one, they use
+// AES-128-GCM and derive the direction keys without the transcript, like every relay does when nothing was offered.
+func (hs *Handshake) setSuite(suite int) error {
+	if suite == 0 || len(hs.Suites) == 0 && suite == encryption.SUITE_AES_128_GCM {
+		hs.Suite = encryption.SUITE_AES_128_GCM
+		hs.Transcript = nil
+		return nil
+	}
+
+	for _, offered := range hs.Suites {
+		if offered == suite {
+			hs.Suite = suite
+			hs.Transcript = encryption.SuiteTranscript(suite, hs.Suites)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("relay picked cipher suite %d, which wasn't offered", suite)
+}
+
+// finishNtor, checks the relay is the one we expected and that it proved possession of its ntor key
+func (hs *Handshake) finishNtor(res handlers.GetAesResponse, keySize int) ([]byte, error) {
+	identity, err := encryption.DecodeIdentityPublicKey(res.IdentityKey)
 	if err != nil {
-		return handlers.GetAesRequest{}, err
+		return nil, err
 	}
 
-	return req, nil
+	if encryption.Fingerprint(identity) != strings.ToLower(hs.Fingerprint) {
+		return nil, fmt.Errorf("relay fingerprint mismatch: expected %s, got %s", hs.Fingerprint, encryption.Fingerprint(identity))
+	}
+
+	ntorKey, err := encryption.DecodeX25519PublicKey(res.NtorKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ntorKeySig, err := base64.StdEncoding.DecodeString(res.NtorKeySig)
+	if err != nil {
+		return nil, err
+	}
+
+	if !encryption.VerifyNtorKey(identity, ntorKey, ntorKeySig) {
+		return nil, errors.New("relay ntor key is not signed by its identity")
+	}
+
+	relayKey, err := encryption.DecodeX25519PublicKey(res.X25519Key)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := base64.StdEncoding.DecodeString(res.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return hs.X25519.NtorClientHandshake(identity, ntorKey, relayKey, auth, keySize)
 }
 
 // CreateSetAddrRequest, creates the struct of CreateSetAddrRequest with the addr being encrypted
 
-func CreateSetAddrRequest(addr string, session string, encryptor encryption.AESEncryptor) (handlers.SetRedirectRequest, error) {
+func CreateSetAddrRequest(addr string, node NodeInfo) (handlers.SetRedirectRequest, error) {
 	var req handlers.SetRedirectRequest
 	var err error
 
 	b64addr := base64.StdEncoding.EncodeToString([]byte(addr))
 
-	req.Addr, err = encryptor.EncryptBase64(b64addr)
+	// The session, message type and sequence number are authenticated with the address, so the request
+	// can't be replayed or used anywhere else
+	req.Seq = node.NextSeq()
+	ad := handlers.AssociatedData(node.Session, handlers.DIRECTION_FORWARD, "set-redirect", req.Seq)
+	req.Addr, err = node.ForwardEncryptor.EncryptBase64WithAD(b64addr, ad)
 
 	if err != nil {
 		return handlers.SetRedirectRequest{}, err
 	}
 
-	req.Session = session
+	req.Session = node.Session
 
 	return req, nil
 }
 
-func CreateRedirectRequest(session string, redirectedJson handlers.RedirectRequestJson, encryptor encryption.AESEncryptor) (handlers.RedirectRequest, error) {
+func CreateRedirectRequest(node NodeInfo, redirectedJson handlers.RedirectRequestJson) (handlers.RedirectRequest, error) {
 	var finalReq handlers.RedirectRequest
 	var jsonString string
 	var err error
@@ -55,104 +209,151 @@ func CreateRedirectRequest(session string, redirectedJson handlers.RedirectReque
 
 	jsonString = base64.StdEncoding.EncodeToString(jsonBytes)
 
-	finalReq.Message, err = encryptor.EncryptBase64(jsonString)
+	finalReq.Seq = node.NextSeq()
+	ad := handlers.AssociatedData(node.Session, handlers.DIRECTION_FORWARD, "redirect", finalReq.Seq)
+	finalReq.Message, err = node.ForwardEncryptor.EncryptBase64WithAD(jsonString, ad)
 	if err != nil {
 		return handlers.RedirectRequest{}, err
 	}
 
-	finalReq.Session = session
+	finalReq.Session = node.Session
 
 	return finalReq, nil
 }
 
-func CreateRequestThroughNetwork(nodeList *list.List, message interface{}, msgType string) (handlers.RedirectRequest, error) {
-	var finalReq handlers.RedirectRequest
-	var reqJson handlers.RedirectRequestJson
-
+// NewRedirectJson wraps the JSON of the message for the last node, which sends it to msgType on the destination
+func NewRedirectJson(message interface{}, msgType string) (handlers.RedirectRequestJson, error) {
 	jsonBytes, err := json.Marshal(message)
-
 	if err != nil {
-		return handlers.RedirectRequest{}, err
+		return handlers.RedirectRequestJson{}, err
 	}
-	jsonString := base64.StdEncoding.EncodeToString(jsonBytes)
 
-	reqJson.Data = jsonString
-	reqJson.MsgType = msgType
+	return handlers.RedirectRequestJson{
+		MsgType: msgType,
+		Data:    base64.StdEncoding.EncodeToString(jsonBytes),
+	}, nil
+}
+
+// CreateRequestThroughNetwork wraps the message of the last node in a redirect request for every node, the first
+// node's is returned with the sequence number used for each node, in the circuit order, which the answer of every
+// node is bound to
+func CreateRequestThroughNetwork(nodeList *list.List, reqJson handlers.RedirectRequestJson) (handlers.RedirectRequest, []uint64, error) {
+	var finalReq handlers.RedirectRequest
+
+	seqs := make([]uint64, nodeList.Len())
+	i := nodeList.Len()
 
 	for n := nodeList.Back(); n != nil; n = n.Prev() {
-		currentLayer, err := CreateRedirectRequest(n.Value.(NodeInfo).Session, reqJson, n.Value.(NodeInfo).AesEncryptor)
+		currentLayer, err := CreateRedirectRequest(n.Value.(NodeInfo), reqJson)
 		if err != nil {
-			return handlers.RedirectRequest{}, err
+			return handlers.RedirectRequest{}, nil, err
 		}
 
+		// Every node streams its answer, a node that can't ignores it
+		currentLayer.Chunked = true
+
+		i--
+		seqs[i] = currentLayer.Seq
+
 		jsonBytes, err := json.Marshal(currentLayer)
 
 		if err != nil {
-			return handlers.RedirectRequest{}, err
+			return handlers.RedirectRequest{}, nil, err
 		}
 
 		jsonString := base64.StdEncoding.EncodeToString(jsonBytes)
 
 		reqJson.Data = jsonString
 		reqJson.MsgType = "redirect"
+		reqJson.HTTP = nil
 
 		finalReq = currentLayer
 	}
 
-	return finalReq, nil
+	return finalReq, seqs, nil
 }
 
-func CreateCircuit(node1 string, node2 string, node3 string, finalDst string) (MessageSender, error) {
-	nodeOne, err := CreateInitialConnection(node1, node2)
+// CreateRekeyRequest asks the node to ratchet its keys to the generation after its current one
+func CreateRekeyRequest(node NodeInfo) (handlers.RekeyRequest, error) {
+	var req handlers.RekeyRequest
+	var err error
+
+	b64generation := base64.StdEncoding.EncodeToString([]byte(strconv.FormatUint(node.Generation+1, 10)))
 
+	req.Seq = node.NextSeq()
+	ad := handlers.AssociatedData(node.Session, handlers.DIRECTION_FORWARD, "rekey", req.Seq)
+	req.Message, err = node.ForwardEncryptor.EncryptBase64WithAD(b64generation, ad)
 	if err != nil {
-		fmt.Printf("Error: %s", err)
-		return MessageSender{list.List{}}, err
+		return handlers.RekeyRequest{}, err
 	}
 
-	nodeList := list.List{}
-	nodeList.PushBack(nodeOne)
+	req.Session = node.Session
 
-	newNode, err := GetAesFromNetwork(&nodeList)
+	return req, nil
+}
 
-	if err != nil {
-		fmt.Printf("Error 2: %s", err)
-		return MessageSender{list.List{}}, err
-	}
+// CreateDestroyRequest builds the teardown request of the circuit, the request of each node carries the one of the next node
+func CreateDestroyRequest(nodeList *list.List) (handlers.DestroyRequest, error) {
+	var req handlers.DestroyRequest
+	next := ""
 
-	err = SetAddrFromNetwork(&nodeList, &newNode, node3)
+	for n := nodeList.Back(); n != nil; n = n.Prev() {
+		nodeInfo := n.Value.(NodeInfo)
 
-	nodeList.PushBack(newNode)
+		seq := nodeInfo.NextSeq()
+		message, err := nodeInfo.ForwardEncryptor.EncryptBase64WithAD(next, handlers.AssociatedData(nodeInfo.Session, handlers.DIRECTION_FORWARD, "destroy", seq))
+		if err != nil {
+			return handlers.DestroyRequest{}, err
+		}
 
-	if err != nil {
-		fmt.Printf("Error node 2: %s", err)
-		return MessageSender{list.List{}}, err
-	}
+		req = handlers.DestroyRequest{Session: nodeInfo.Session, Seq: seq, Message: message}
 
-	newNode2, err := GetAesFromNetwork(&nodeList)
+		jsonBytes, err := json.Marshal(req)
+		if err != nil {
+			return handlers.DestroyRequest{}, err
+		}
 
-	if err != nil {
-		fmt.Printf("Error node 3 setup: %s", err)
-		return MessageSender{list.List{}}, err
+		next = base64.StdEncoding.EncodeToString(jsonBytes)
 	}
 
-	err = SetAddrFromNetwork(&nodeList, &newNode2, finalDst)
+	return req, nil
+}
 
-	nodeList.PushBack(newNode2)
+// BuildCircuit, builds a circuit through the hops in order, the last hop redirects to dst.
+// The first hop is set up directly, every next hop is reached and set up through the circuit built so far.
+func BuildCircuit(hops []Relay, dst string) (MessageSender, error) {
+	if len(hops) == 0 {
+		return MessageSender{list.List{}}, errors.New("a circuit needs at least one hop")
+	}
 
+	// Each hop redirects to the next one, the last one to the destination
+	redirectionAddr := func(i int) string {
+		if i+1 < len(hops) {
+			return hops[i+1].Addr
+		}
+		return dst
+	}
+
+	nodeOne, err := CreateInitialConnection(hops[0], redirectionAddr(0))
 	if err != nil {
-		fmt.Printf("Error ndoe 3 setup: %s", err)
-		return MessageSender{list.List{}}, err
+		return MessageSender{list.List{}}, fmt.Errorf("error setting up hop 1: %w", err)
 	}
 
-	for n := nodeList.Front(); n != nil; n = n.Next() {
-		_, ok := n.Value.(NodeInfo)
-		if !ok {
-			fmt.Println("unexpected type in node list; expected *NodeInfo")
-			return MessageSender{list.List{}}, err
+	nodeList := list.List{}
+	nodeList.PushBack(nodeOne)
+
+	for i := 1; i < len(hops); i++ {
+		newNode, err := GetAesFromNetwork(&nodeList, hops[i].Fingerprint)
+		if err != nil {
+			return MessageSender{list.List{}}, fmt.Errorf("error setting up hop %d: %w", i+1, err)
+		}
+
+		err = SetAddrFromNetwork(&nodeList, &newNode, redirectionAddr(i))
+		if err != nil {
+			return MessageSender{list.List{}}, fmt.Errorf("error setting up hop %d: %w", i+1, err)
 		}
 
-		//fmt.Printf("Addr: %s, Key: %s, Session: %s, Redirect: %s\n", node.Addr, node.AesEncryptor.Key, node.Session, node.RedirectionAddr)
+		nodeList.PushBack(newNode)
 	}
 
 	return MessageSender{nodeList}, nil
@@ -0,0 +1,24 @@
+package main
+
+import "marshmello/pkg/directory"
+
+// GetRelaysFromDirectory fetches the consensus, checks it is signed by the expected directory and returns its relays
+func GetRelaysFromDirectory(dirAddr string, dirFingerprint string) ([]Relay, error) {
+	consensus, err := directory.FetchConsensus(dirAddr, dirFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	relays := make([]Relay, 0, len(consensus.Relays))
+	for _, entry := range consensus.Relays {
+		relays = append(relays, Relay{
+			Addr:        entry.Address,
+			Fingerprint: entry.Fingerprint,
+			Bandwidth:   entry.Bandwidth,
+			Flags:       entry.Flags,
+			Family:      entry.Family,
+		})
+	}
+
+	return relays, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"marshmello/pkg/handlers"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HttpRequest is an HTTP request the last node makes to the destination for the client, as it is described
+type HttpRequest struct {
+	Method  string
+	Path    string // on the destination, like "auth/users"
+	Query   url.Values
+	Headers http.Header
+	Body    []byte
+}
+
+// HttpResponse is the destination's answer to an HttpRequest
+type HttpResponse struct {
+	Status  int
+	Headers http.Header
+	Body    []byte
+}
+
+// SendHttpThroughNetwork sends the request to the destination of the circuit and returns its answer, whatever
+// its status. Only the errors of the nodes are returned as errors.
+func SendHttpThroughNetwork(nodeList *list.List, req HttpRequest) (HttpResponse, error) {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	reqJson := handlers.RedirectRequestJson{
+		MsgType: strings.TrimPrefix(req.Path, "/"),
+		Data:    base64.StdEncoding.EncodeToString(req.Body),
+		HTTP: &handlers.ExitRequest{
+			Method:  method,
+			Query:   req.Query.Encode(),
+			Headers: req.Headers,
+		},
+	}
+
+	respJson, err := SendJsonThroughNetwork(nodeList, reqJson)
+	if err != nil {
+		return HttpResponse{}, err
+	}
+
+	var exitResp handlers.ExitResponse
+	if err := json.Unmarshal(respJson, &exitResp); err != nil {
+		return HttpResponse{}, err
+	}
+
+	body, err := base64.StdEncoding.DecodeString(exitResp.Body)
+	if err != nil {
+		return HttpResponse{}, err
+	}
+
+	return HttpResponse{Status: exitResp.Status, Headers: exitResp.Headers, Body: body}, nil
+}
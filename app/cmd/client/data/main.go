@@ -5,16 +5,104 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/handlers"
+	"marshmello/pkg/link"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"unicode"
 )
 
+const MAX_HOPS = handlers.CELL_MAX_HOPS
+
 var (
-	circuit   *MessageSender
-	authToken string
+	circuits         = make(map[int]*MessageSender) // hop count -> circuit
+	circuitsMu       sync.Mutex
+	relayPool        []Relay
+	defaultHops      int
+	finalDst         string
+	authToken        string
+	handshakeVersion = handlers.HANDSHAKE_NTOR
+	cipherSuites     = encryption.PreferredSuites() // offered to the relays, which pick the one they run best
+	useCells         = true
+	links            = link.NewPool() // persistent links to the first relays
 )
 
+// circuitFor returns the circuit with the hop count asked in the request's "hops" query parameter
+// (the default hop count when missing), building it from the relay pool on first use
+func circuitFor(r *http.Request) (*MessageSender, error) {
+	hops := defaultHops
+
+	if r.URL.Query().Get("hops") != "" {
+		var err error
+		hops, err = strconv.Atoi(r.URL.Query().Get("hops"))
+		if err != nil || hops < 1 || hops > MAX_HOPS {
+			return nil, fmt.Errorf("hops must be between 1 and %d", MAX_HOPS)
+		}
+	}
+
+	return circuitWithHops(hops)
+}
+
+// circuitWithHops returns the circuit with the hop count, building it from the relay pool on first use.
+// The circuit is built without the lock, so building one doesn't hold the requests on the other circuits.
+func circuitWithHops(hops int) (*MessageSender, error) {
+	circuitsMu.Lock()
+	c, ok := circuits[hops]
+	circuitsMu.Unlock()
+
+	if ok {
+		return c, nil
+	}
+
+	path, err := SelectPath(relayPool, hops)
+	if err != nil {
+		return nil, err
+	}
+
+	built, err := BuildCircuit(path, finalDst)
+	if err != nil {
+		return nil, err
+	}
+
+	circuitsMu.Lock()
+	c, ok = circuits[hops]
+	if !ok {
+		c = &built
+		circuits[hops] = c
+	}
+	circuitsMu.Unlock()
+
+	// Another request built a circuit with the same hop count first, it is kept and ours torn down
+	if ok {
+		if err := CloseCircuit(&built.Circuit); err != nil {
+			log.Printf("Error closing the extra %d hop circuit: %s", hops, err)
+		}
+	}
+
+	return c, nil
+}
+
+// closeCircuits tears down every circuit, so the relays don't keep the keys once the client is gone
+func closeCircuits() {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	for hops, c := range circuits {
+		if err := CloseCircuit(&c.Circuit); err != nil {
+			log.Printf("Error closing the %d hop circuit: %s", hops, err)
+		}
+		delete(circuits, hops)
+	}
+
+	links.Close()
+}
+
 func passwordChecker(password string) string {
 	var (
 		hasUpperCase bool
@@ -74,31 +162,99 @@ func checkCredentials(req *AuthUserRequest) error {
 }
 
 func main() {
-	// Define command-line flags for IPs
-	node1 := flag.String("node1", "", "IP address of node1 (e.g., node1:8080)")
-	node2 := flag.String("node2", "", "IP address of node2 (e.g., node2:8080)")
-	node3 := flag.String("node3", "", "IP address of node3 (e.g., node3:8080)")
+	// Define command-line flags for the relay sources and the server
+	dirAddr := flag.String("directory", "", "IP address of the directory authority (e.g., 192.168.25.205:9030)")
+	dirFingerprint := flag.String("directory-fp", "", "Fingerprint of the directory authority, printed by the directory at startup")
+	relaysFile := flag.String("relays", "", "JSON file with the known relays, used instead of the directory")
 	server := flag.String("server", "", "IP address of the server (e.g., 192.168.25.205:8080)")
+	handshake := flag.String("handshake", "ntor", "Key exchange used with the relays (ntor, or x25519/rsa for older relays)")
+	flag.BoolVar(&enforceDistinctSubnets, "distinct-subnets", true, "Never put two relays of the same /16 in a circuit")
+	flag.BoolVar(&useCells, "cells", true, "Send requests in fixed-size cells, disable for relays without /cell")
+	flag.IntVar(&defaultHops, "hops", 3, "Number of relays in a circuit, requests can ask for another count with ?hops=")
+	flag.Uint64Var(&rekeyMessages, "rekey-messages", REKEY_MESSAGES, "Ratchet the keys of a relay after this many messages, 0 to never")
+	socksAddr := flag.String("socks", "127.0.0.1:1080", "Address of the SOCKS5 proxy tunneling TCP through the default circuit, empty to disable")
+	flag.DurationVar(&rekeyInterval, "rekey-interval", REKEY_INTERVAL, "Ratchet the keys of a relay after this long, 0 to never")
 	flag.Parse()
 
+	switch *handshake {
+	case "ntor":
+		handshakeVersion = handlers.HANDSHAKE_NTOR
+	case "x25519":
+		handshakeVersion = handlers.HANDSHAKE_X25519
+	case "rsa":
+		handshakeVersion = handlers.HANDSHAKE_RSA
+	default:
+		fmt.Println("Unknown handshake, use ntor, x25519 or rsa")
+		os.Exit(1)
+	}
+
 	// Ensure all required arguments are provided
-	if *node2 == "" || *node3 == "" || *server == "" || *node1 == "" {
-		fmt.Println("Usage: go run main.go -node1=<node1_ip> -node2=<node2_ip> -node3=<node3_ip> -server=<server_ip>")
+	if (*relaysFile == "" && (*dirAddr == "" || *dirFingerprint == "")) || *server == "" {
+		fmt.Println("Usage: go run main.go -directory=<directory_ip> -directory-fp=<directory_fingerprint> -server=<server_ip>")
+		fmt.Println("   or: go run main.go -relays=<relays.json> -server=<server_ip>")
 		os.Exit(1)
 	}
 
-	circuitObj, err := CreateCircuit(*node1, *node2, *node3, *server)
+	if defaultHops < 1 || defaultHops > MAX_HOPS {
+		fmt.Printf("hops must be between 1 and %d\n", MAX_HOPS)
+		os.Exit(1)
+	}
+
+	// Get the relay pool from the config file or the verified directory consensus
+	var err error
+	if *relaysFile != "" {
+		relayPool, err = LoadRelays(*relaysFile)
+	} else {
+		relayPool, err = GetRelaysFromDirectory(*dirAddr, *dirFingerprint)
+	}
+	if err != nil {
+		log.Fatal("Cant get the relay list: ", err)
+	}
+
+	finalDst = *server
+
+	// Build the default circuit up front
+	path, err := SelectPath(relayPool, defaultHops)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	circuitObj, err := BuildCircuit(path, finalDst)
 	if err != nil {
-		log.Fatal("Cant connect")
+		log.Fatal("Cant connect: ", err)
 	}
 
-	circuit = &circuitObj
+	circuits[defaultHops] = &circuitObj
 
 	// Set up routes
 	http.HandleFunc("/register", registerHandler)
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/send-message", sendMessageHandler)
 	http.HandleFunc("/receive-messages", receiveMessagesHandler)
+	http.HandleFunc("/users", usersHandler)
+
+	// Tunnel the TCP connections of other tools through the relays
+	if *socksAddr != "" {
+		socksListener, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			log.Fatal("Cant start the SOCKS proxy: ", err)
+		}
+
+		fmt.Println("SOCKS5 proxy on", *socksAddr)
+		go func() {
+			log.Println("SOCKS proxy stopped: ", ServeSocks(socksListener))
+		}()
+	}
+
+	// Tear the circuits down before exiting
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		closeCircuits()
+		os.Exit(0)
+	}()
 
 	// Start the server
 	fmt.Println("Server starting on :1234")
@@ -125,6 +281,12 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	circuit, err := circuitFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	err = SendRegister(&circuit.Circuit, req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -148,6 +310,12 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	circuit, err := circuitFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	token, err := SendLogin(&circuit.Circuit, req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -183,6 +351,12 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	// Use the stored token
 	req.Token = authToken
 
+	circuit, err := circuitFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	err = SendMessage(&circuit.Circuit, req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -205,6 +379,12 @@ func receiveMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	circuit, err := circuitFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	messages, err := ReceiveMessages(&circuit.Circuit, GetMessagees{Token: authToken})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -214,3 +394,25 @@ func receiveMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(messages)
 }
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	circuit, err := circuitFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := GetUsers(&circuit.Circuit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"marshmello/pkg/directory"
+	"math/rand"
+	"net"
+	"os"
+)
+
+// Relays in the same /16 are likely run by the same operator, can be turned off for local test networks
+var enforceDistinctSubnets = true
+
+// LoadRelays reads the pool of known relays from a JSON config file
+//
+//	[
+//	    {"Addr": "10.0.0.1:8080", "Fingerprint": "...", "Bandwidth": 1000, "Flags": ["Guard"], "Family": "alice"}
+//	]
+func LoadRelays(path string) ([]Relay, error) {
+	var relays []Relay
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &relays); err != nil {
+		return nil, fmt.Errorf("error reading relay list: %w", err)
+	}
+
+	return relays, nil
+}
+
+// SelectPath picks the relays of a circuit with the given number of hops, guard first and exit last.
+//
+// The exit is chosen first among relays with the Exit flag, then the guard among relays with the Guard flag,
+// then the middle relays; when no candidate has the flag for a position any relay may take it.
+// Each pick is weighted by bandwidth and no two relays of the path share a fingerprint, a /16 or a family.
+func SelectPath(relays []Relay, hops int) ([]Relay, error) {
+	if hops < 1 {
+		return nil, errors.New("a circuit needs at least one hop")
+	}
+
+	path := make([]Relay, hops)
+
+	exit, err := pickRelay(relays, nil, directory.FLAG_EXIT)
+	if err != nil {
+		return nil, fmt.Errorf("no usable exit relay: %w", err)
+	}
+	path[hops-1] = exit
+	chosen := []Relay{exit}
+
+	if hops == 1 {
+		return path, nil
+	}
+
+	guard, err := pickRelay(relays, chosen, directory.FLAG_GUARD)
+	if err != nil {
+		return nil, fmt.Errorf("no usable guard relay: %w", err)
+	}
+	path[0] = guard
+	chosen = append(chosen, guard)
+
+	for i := 1; i < hops-1; i++ {
+		middle, err := pickRelay(relays, chosen, "")
+		if err != nil {
+			return nil, fmt.Errorf("no usable middle relay: %w", err)
+		}
+		path[i] = middle
+		chosen = append(chosen, middle)
+	}
+
+	return path, nil
+}
+
+// pickRelay chooses a relay compatible with the chosen ones, preferring relays with the flag, weighted by bandwidth
+func pickRelay(relays []Relay, chosen []Relay, flag string) (Relay, error) {
+	var candidates, flagged []Relay
+
+	for _, relay := range relays {
+		if !compatible(relay, chosen) {
+			continue
+		}
+		candidates = append(candidates, relay)
+		if flag != "" && relay.HasFlag(flag) {
+			flagged = append(flagged, relay)
+		}
+	}
+
+	if len(flagged) > 0 {
+		candidates = flagged
+	}
+
+	if len(candidates) == 0 {
+		return Relay{}, errors.New("not enough distinct relays")
+	}
+
+	return weightedChoice(candidates), nil
+}
+
+// compatible reports whether the relay can share a circuit with the chosen relays
+func compatible(relay Relay, chosen []Relay) bool {
+	for _, other := range chosen {
+		if relay.Fingerprint == other.Fingerprint || relay.Addr == other.Addr {
+			return false
+		}
+		if relay.Family != "" && relay.Family == other.Family {
+			return false
+		}
+		if enforceDistinctSubnets && subnet(relay.Addr) == subnet(other.Addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// weightedChoice picks a relay with probability proportional to its bandwidth
+func weightedChoice(relays []Relay) Relay {
+	total := 0
+	for _, relay := range relays {
+		total += max(relay.Bandwidth, 1)
+	}
+
+	n := rand.Intn(total)
+	for _, relay := range relays {
+		n -= max(relay.Bandwidth, 1)
+		if n < 0 {
+			return relay
+		}
+	}
+
+	return relays[len(relays)-1]
+}
+
+// subnet returns the /16 of an IPv4 relay (/32 for IPv6), host names are resolved first
+func subnet(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return host
+		}
+		ip = ips[0]
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/handlers"
+	"sync/atomic"
+	"time"
+)
+
+// When the keys of a relay are ratcheted by default, whichever comes first
+const (
+	REKEY_MESSAGES = 1000
+	REKEY_INTERVAL = 10 * time.Minute
+)
+
+var (
+	rekeyMessages uint64 = REKEY_MESSAGES // 0 never rekeys on the message count
+	rekeyInterval        = REKEY_INTERVAL // 0 never rekeys on time
+)
+
+// rekeyDue reports whether the keys of the node were used for too many messages or for too long
+func rekeyDue(node NodeInfo) bool {
+	if rekeyMessages > 0 && node.Sent.Load() >= rekeyMessages {
+		return true
+	}
+	return rekeyInterval > 0 && time.Since(node.RekeyedAt) >= rekeyInterval
+}
+
+// rotateKeys ratchets the keys of every node of the circuit that is due. It holds the circuit lock for writing,
+// so no message is in flight while a relay and the client switch keys.
+func rotateKeys(nodeList *list.List) error {
+	lock := nodeList.Front().Value.(NodeInfo).Lock
+
+	lock.RLock()
+	due := false
+	for n := nodeList.Front(); n != nil; n = n.Next() {
+		due = due || rekeyDue(n.Value.(NodeInfo))
+	}
+	lock.RUnlock()
+
+	if !due {
+		return nil
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another message may have rotated them while the lock was free, so every node is checked again
+	i := 0
+	for n := nodeList.Front(); n != nil; n, i = n.Next(), i+1 {
+		if !rekeyDue(n.Value.(NodeInfo)) {
+			continue
+		}
+
+		if err := rekeyNode(nodeList, n); err != nil {
+			return fmt.Errorf("error rotating the keys of hop %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// rekeyNode asks the node to ratchet its keys, directly for the first node and through the nodes before it
+// for the others, and ratchets the client's copy once the node confirmed. The caller holds the circuit lock.
+func rekeyNode(nodeList *list.List, element *list.Element) error {
+	node := element.Value.(NodeInfo)
+
+	req, err := CreateRekeyRequest(node)
+	if err != nil {
+		return err
+	}
+
+	var respJson []byte
+	if element == nodeList.Front() {
+		respJson, err = SendHttpRequest(node.Addr, req, "rekey")
+	} else {
+		prefix := list.New()
+		for n := nodeList.Front(); n != element; n = n.Next() {
+			prefix.PushBack(n.Value)
+		}
+		respJson, err = sendThroughNetwork(prefix, req, "rekey")
+	}
+	if err != nil {
+		return decryptNodeError(node, err, rekeyAD(node, req.Seq))
+	}
+
+	// The node answers with the keys it is leaving
+	var resp handlers.EncryptedResponse
+	if err := json.Unmarshal(respJson, &resp); err != nil {
+		return err
+	}
+
+	dec, err := node.BackwardEncryptor.DecryptBase64WithAD(resp.Data, rekeyAD(node, req.Seq))
+	if err != nil {
+		return err
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(dec); err != nil {
+		return err
+	}
+
+	next, err := node.ratchet()
+	if err != nil {
+		return err
+	}
+
+	element.Value = next
+	return nil
+}
+
+// ratchet returns the node with the keys of the next generation, the current ones are dropped with the old value
+func (n NodeInfo) ratchet() (NodeInfo, error) {
+	forward, backward, err := encryption.RatchetKeys(n.ForwardEncryptor.KeyBytes(), n.BackwardEncryptor.KeyBytes())
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	n.ForwardEncryptor, err = encryption.NewSessionCipher(n.ForwardEncryptor.Suite(), forward)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	n.BackwardEncryptor, err = encryption.NewSessionCipher(n.BackwardEncryptor.Suite(), backward)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	n.Generation++
+	n.RekeyedAt = time.Now()
+	n.Sent = new(atomic.Uint64)
+	return n, nil
+}
+
+// rekeyAD is the associated data of the node's answer to the rekey request with sequence number seq
+func rekeyAD(node NodeInfo, seq uint64) []byte {
+	return handlers.AssociatedData(node.Session, handlers.DIRECTION_BACKWARD, "rekey", seq)
+}
@@ -3,23 +3,82 @@ package main
 import (
 	"container/list"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"marshmello/pkg/encryption"
 	"marshmello/pkg/handlers"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Relay is a hop the client can put in its circuit and the identity fingerprint it must prove
+type Relay struct {
+	Addr        string
+	Fingerprint string
+	Bandwidth   int
+	Flags       []string
+	Family      string
+}
+
+// HasFlag reports whether the directory gave the relay the flag
+func (r Relay) HasFlag(flag string) bool {
+	for _, f := range r.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
 type NodeInfo struct {
-	Addr            string
-	AesEncryptor    encryption.AESEncryptor
-	Session         string
-	RedirectionAddr string
+	Addr              string
+	Fingerprint       string
+	ForwardEncryptor  encryption.SessionCipher // encrypts what is sent to the node
+	BackwardEncryptor encryption.SessionCipher // opens what the node answers
+	Session           string
+	RedirectionAddr   string
+	Seq               *atomic.Uint64 // last sequence number sent on the session
+	Generation        uint64         // how many times the keys were ratcheted
+	RekeyedAt         time.Time      // when the current keys were derived
+	Sent              *atomic.Uint64 // messages sent with the current keys
+	Lock              *sync.RWMutex  // shared by the nodes of a circuit, held for writing while keys rotate
+}
+
+// setKeys derives the forward and backward keys of the node from the key agreed in the handshake, for the suite it picked
+func (n *NodeInfo) setKeys(hs *Handshake, handshakeKey []byte) error {
+	forward, backward, err := encryption.DeriveDirectionKeys(handshakeKey, hs.Transcript)
+	if err != nil {
+		return err
+	}
+
+	n.ForwardEncryptor, err = encryption.NewSessionCipher(hs.Suite, forward)
+	if err != nil {
+		return err
+	}
+
+	n.BackwardEncryptor, err = encryption.NewSessionCipher(hs.Suite, backward)
+	if err != nil {
+		return err
+	}
+
+	n.RekeyedAt = time.Now()
+	n.Sent = new(atomic.Uint64)
+	return nil
 }
 
-func CreateInitialConnection(addr string, redirectionAddr string) (NodeInfo, error) {
-	key, ses, err := GetInitAesKey(addr)
+// NextSeq returns the sequence number of the next message to the node
+func (n NodeInfo) NextSeq() uint64 {
+	return n.Seq.Add(1)
+}
+
+func CreateInitialConnection(relay Relay, redirectionAddr string) (NodeInfo, error) {
+	hs, key, ses, err := GetInitAesKey(relay.Addr, relay.Fingerprint)
 
 	if err != nil {
 		fmt.Printf("Error: %s", err)
@@ -28,12 +87,16 @@ func CreateInitialConnection(addr string, redirectionAddr string) (NodeInfo, err
 
 	//fmt.Printf("Got key: %s\n Session Token: %s\n Key Size: %d\n", key, ses, len(key))
 
-	enc := encryption.AESEncryptor{Key: key}
-
 	nodeOne := NodeInfo{
-		Addr:         addr,
-		AesEncryptor: enc,
-		Session:      ses,
+		Addr:        relay.Addr,
+		Fingerprint: relay.Fingerprint,
+		Session:     ses,
+		Seq:         new(atomic.Uint64),
+		Lock:        new(sync.RWMutex),
+	}
+
+	if err := nodeOne.setKeys(hs, key); err != nil {
+		return NodeInfo{}, err
 	}
 
 	_, err = SetInitRedirectAddr(redirectionAddr, nodeOne)
@@ -47,60 +110,46 @@ func CreateInitialConnection(addr string, redirectionAddr string) (NodeInfo, err
 	return nodeOne, nil
 }
 
-// GetAesKey requests the AES key and session token from the a node
-func GetInitAesKey(addr string) ([]byte, string, error) {
-	var req handlers.GetAesRequest
-	var rsaEnc encryption.RSAEncryptor
+// GetAesKey requests the key and session token from the a node, the handshake holds the cipher suite it picked
+func GetInitAesKey(addr string, fingerprint string) (*Handshake, []byte, string, error) {
 	var res handlers.GetAesResponse
 
-	// Generate RSA keys
-	err := rsaEnc.GenerateKey()
-	if err != nil {
-		return nil, "", err
-	}
-
-	// Encode the RSA public key for transmission
-	req.RsaKey, err = encryption.EncodeRSAPublicKey(rsaEnc.PublicKey)
+	// Generate the client keys for the handshake
+	hs, req, err := CreateAesRequest(handshakeVersion, fingerprint)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
 	}
 
 	// Send request to /get-aes
 	respData, err := SendHttpRequest(addr, req, "get-aes")
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
 	}
 
 	// Unmarshal the response
 	if err := json.Unmarshal(respData, &res); err != nil {
-		return nil, "", errors.New("error decoding AES response")
+		return nil, nil, "", errors.New("error decoding AES response")
 	}
 
-	// Decode the base64-encoded AES key from the response
-	aesKey, err := base64.StdEncoding.DecodeString(res.Aes_key)
+	aesKey, err := hs.FinishAesHandshake(res)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
 	}
 
-	decrypted, err := rsaEnc.Decrypt(aesKey)
-	if err != nil {
-		return nil, "", err
-	}
-
-	return decrypted, res.Session, nil
+	return hs, aesKey, res.Session, nil
 }
 
 func SetInitRedirectAddr(redirectionAddr string, nodeInfo NodeInfo) (string, error) {
-	req, err := CreateSetAddrRequest(redirectionAddr, nodeInfo.Session, nodeInfo.AesEncryptor)
+	req, err := CreateSetAddrRequest(redirectionAddr, nodeInfo)
 
 	if err != nil {
 		return "", err
 	}
 
-	// Send request to /get-aes
+	// Send request to /set-redirect
 	respJson, err := SendHttpRequest(nodeInfo.Addr, req, "set-redirect")
 	if err != nil {
-		return "", err
+		return "", decryptNodeError(nodeInfo, err, setRedirectAD(nodeInfo, req.Seq))
 	}
 
 	var resp handlers.EncryptedResponse
@@ -110,7 +159,7 @@ func SetInitRedirectAddr(redirectionAddr string, nodeInfo NodeInfo) (string, err
 		return "", err
 	}
 
-	dec, err := nodeInfo.AesEncryptor.DecryptBase64(resp.Data)
+	dec, err := nodeInfo.BackwardEncryptor.DecryptBase64WithAD(resp.Data, setRedirectAD(nodeInfo, req.Seq))
 
 	if err != nil {
 		return "", err
@@ -125,171 +174,485 @@ func SetInitRedirectAddr(redirectionAddr string, nodeInfo NodeInfo) (string, err
 	return string(responseString), nil
 }
 
-func GetAesFromNetwork(nodeList *list.List) (NodeInfo, error) {
+func GetAesFromNetwork(nodeList *list.List, fingerprint string) (NodeInfo, error) {
 	var res handlers.GetAesResponse
-	rsa := encryption.RSAEncryptor{}
-	err := rsa.GenerateKey()
+
+	hs, getAes, err := CreateAesRequest(handshakeVersion, fingerprint)
 	if err != nil {
 		return NodeInfo{}, err
 	}
 
-	getAes, err := CreateAesRequest(&rsa)
+	decodedResp, err := SendThroughNetwork(nodeList, getAes, "get-aes")
 	if err != nil {
-		return NodeInfo{}, err
+		return NodeInfo{}, fmt.Errorf("error: %w", err)
+	}
+
+	// Unmarshal the response
+	if err := json.Unmarshal(decodedResp, &res); err != nil {
+		return NodeInfo{}, errors.New("error decoding AES response")
 	}
 
-	req, err := CreateRequestThroughNetwork(nodeList, getAes, "get-aes")
+	decrypted, err := hs.FinishAesHandshake(res)
 	if err != nil {
 		return NodeInfo{}, err
 	}
 
-	respJson, err := SendHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
+	back, ok := nodeList.Back().Value.(NodeInfo)
+	if !ok {
+		return NodeInfo{}, errors.New("unexpected type in node list; expected *NodeInfo")
+	}
+
+	// Create a new NodeInfo entity with the keys derived from the handshake and the session
+	newNode := NodeInfo{
+		Session:     res.Session,
+		Addr:        back.RedirectionAddr,
+		Fingerprint: fingerprint,
+		Seq:         new(atomic.Uint64),
+		Lock:        back.Lock,
+	}
+
+	if err := newNode.setKeys(hs, decrypted); err != nil {
+		return NodeInfo{}, err
+	}
+
+	return newNode, nil
+}
+
+func SetAddrFromNetwork(nodeList *list.List, newNode *NodeInfo, redirectionAddr string) error {
+	setAddrReq, err := CreateSetAddrRequest(redirectionAddr, *newNode)
+
+	if err != nil {
+		return err
+	}
+
+	respJson, err := SendThroughNetwork(nodeList, setAddrReq, "set-redirect")
 	if err != nil {
-		resp, err := DecodeErrorFromNetwork(err.Error(), nodeList)
-		if err != nil {
-			return NodeInfo{}, err
-		}
-		return NodeInfo{}, fmt.Errorf("error: %s", resp)
+		return fmt.Errorf("error: %w", decryptNodeError(*newNode, err, setRedirectAD(*newNode, setAddrReq.Seq)))
 	}
 
+	// The new node encrypts its answer with its own key
 	var resp handlers.EncryptedResponse
 	err = json.Unmarshal(respJson, &resp)
 	if err != nil {
-		return NodeInfo{}, err
+		return err
 	}
 
-	responseString, err := DecodeRequestThroughNetwork(nodeList, resp.Data)
+	dec, err := newNode.BackwardEncryptor.DecryptBase64WithAD(resp.Data, setRedirectAD(*newNode, setAddrReq.Seq))
+
 	if err != nil {
-		return NodeInfo{}, err
+		return err
 	}
 
-	decodedResp, err := base64.StdEncoding.DecodeString(responseString)
+	_, err = base64.StdEncoding.DecodeString(dec)
+
 	if err != nil {
-		return NodeInfo{}, err
+		return err
 	}
 
-	// Unmarshal the response
-	if err := json.Unmarshal(decodedResp, &res); err != nil {
-		return NodeInfo{}, errors.New("error decoding AES response")
+	newNode.RedirectionAddr = redirectionAddr
+
+	return nil
+}
+
+// setRedirectAD is the associated data of the node's answer to the set-redirect request with sequence number seq
+func setRedirectAD(node NodeInfo, seq uint64) []byte {
+	return handlers.AssociatedData(node.Session, handlers.DIRECTION_BACKWARD, "set-redirect", seq)
+}
+
+// decryptNodeError opens an error the node encrypted with its own key and ad, like an address refused by its exit policy.
+// Any other error is returned as it is.
+func decryptNodeError(node NodeInfo, err error, ad []byte) error {
+	var resp handlers.EncryptedResponse
+	if json.Unmarshal([]byte(strings.TrimPrefix(err.Error(), "HTTP error: ")), &resp) != nil || resp.Data == "" {
+		return err
+	}
+
+	dec, decErr := node.BackwardEncryptor.DecryptBase64WithAD(resp.Data, ad)
+	if decErr != nil {
+		return err
+	}
+
+	text, decErr := base64.StdEncoding.DecodeString(dec)
+	if decErr != nil {
+		return err
 	}
 
-	// Decode the base64-encoded AES key from the response
-	aesKey, err := base64.StdEncoding.DecodeString(res.Aes_key)
+	return errors.New(string(text))
+}
+
+// SendThroughNetwork sends the message to the destination of the circuit and returns the body it answered.
+// An answer with an error status is returned as an error holding the body.
+// The keys of the nodes that are due are rotated first.
+func SendThroughNetwork(nodeList *list.List, message interface{}, msgType string) ([]byte, error) {
+	reqJson, err := NewRedirectJson(message, msgType)
 	if err != nil {
-		return NodeInfo{}, err
+		return nil, err
+	}
+
+	return SendJsonThroughNetwork(nodeList, reqJson)
+}
+
+// SendJsonThroughNetwork is SendThroughNetwork for a message already wrapped for the last node
+func SendJsonThroughNetwork(nodeList *list.List, reqJson handlers.RedirectRequestJson) ([]byte, error) {
+	if err := rotateKeys(nodeList); err != nil {
+		return nil, err
 	}
 
-	decrypted, err := rsa.Decrypt(aesKey)
+	lock := nodeList.Front().Value.(NodeInfo).Lock
+	lock.RLock()
+	defer lock.RUnlock()
+
+	for n := nodeList.Front(); n != nil; n = n.Next() {
+		n.Value.(NodeInfo).Sent.Add(1)
+	}
+
+	return sendJsonThroughNetwork(nodeList, reqJson)
+}
+
+// sendThroughNetwork is SendThroughNetwork for a caller holding the circuit lock
+func sendThroughNetwork(nodeList *list.List, message interface{}, msgType string) ([]byte, error) {
+	reqJson, err := NewRedirectJson(message, msgType)
 	if err != nil {
-		return NodeInfo{}, err
+		return nil, err
 	}
 
-	back, ok := nodeList.Back().Value.(NodeInfo)
-	if !ok {
-		return NodeInfo{}, errors.New("unexpected type in node list; expected *NodeInfo")
+	return sendJsonThroughNetwork(nodeList, reqJson)
+}
+
+// sendJsonThroughNetwork is SendJsonThroughNetwork for a caller holding the circuit lock
+func sendJsonThroughNetwork(nodeList *list.List, reqJson handlers.RedirectRequestJson) ([]byte, error) {
+	if useCells {
+		return SendCellsThroughNetwork(nodeList, reqJson)
 	}
 
-	// Create a new NodeInfo entity with the decrypted AES key and session
-	newNode := NodeInfo{
-		AesEncryptor: encryption.AESEncryptor{Key: decrypted},
-		Session:      res.Session,
-		Addr:         back.RedirectionAddr,
+	req, seqs, err := CreateRequestThroughNetwork(nodeList, reqJson)
+	if err != nil {
+		return nil, err
 	}
 
-	return newNode, nil
+	httpResp, err := OpenHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
+	if err != nil {
+		resp, decodeErr := DecodeErrorFromNetwork(err.Error(), nodeList, seqs)
+		if decodeErr != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s", resp)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.Header.Get("Content-Type") == handlers.CHUNKED_CONTENT_TYPE {
+		return ReadChunkedThroughNetwork(nodeList, httpResp, seqs)
+	}
+
+	// The first node doesn't stream its answers
+	respJson, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var resp handlers.EncryptedResponse
+	err = json.Unmarshal(respJson, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeRequestThroughNetwork(nodeList, resp.Data, seqs)
 }
 
-func SetAddrFromNetwork(nodeList *list.List, newNode *NodeInfo, redirectionAddr string) error {
-	setAddrReq, err := CreateSetAddrRequest(redirectionAddr, newNode.Session, newNode.AesEncryptor)
+// ReadChunkedThroughNetwork opens the chunked stream of every node in turn and returns the body the destination
+// answered, see handlers.CHUNKED_CONTENT_TYPE. A node whose next one doesn't stream holds its answer, which is
+// opened like DecodeRequestThroughNetwork does. An answer with an error status is returned as an error holding the body.
+func ReadChunkedThroughNetwork(nodeList *list.List, resp *http.Response, seqs []uint64) ([]byte, error) {
+	var streams []io.Reader
+	r := io.Reader(resp.Body)
+
+	i := 0
+	for n := nodeList.Front(); n != nil; n, i = n.Next(), i+1 {
+		nodeInfo := n.Value.(NodeInfo)
+
+		ad := handlers.AssociatedData(nodeInfo.Session, handlers.DIRECTION_BACKWARD, "redirect", seqs[i])
+		cr, err := encryption.NewChunkReader(nodeInfo.BackwardEncryptor, r, ad)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, cr)
+
+		kind := make([]byte, 1)
+		if _, err := io.ReadFull(cr, kind); err != nil {
+			return nil, err
+		}
+
+		var body []byte
+		switch kind[0] {
+		case handlers.CHUNK_KIND_NESTED:
+			if n.Next() == nil {
+				return nil, errors.New("chunked stream nested past the last node")
+			}
+			r = cr
+			continue
+		case handlers.CHUNK_KIND_EXIT:
+			body, err = readExitStream(cr)
+		case handlers.CHUNK_KIND_BODY:
+			body, err = io.ReadAll(cr)
+			if err == nil && n.Next() != nil {
+				body, err = decodeAnswerFrom(n.Next(), body, seqs[i+1:])
+			}
+		default:
+			return nil, fmt.Errorf("unknown chunked stream kind %d", kind[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Every stream around the answer must end with its last chunk, or the answer may have been cut
+		for j := len(streams) - 2; j >= 0; j-- {
+			if _, err := io.Copy(io.Discard, streams[j]); err != nil {
+				return nil, err
+			}
+		}
 
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s", body)
+		}
+		return body, nil
+	}
+
+	return nil, errors.New("empty circuit")
+}
+
+// readExitStream reads the ExitResponse of a CHUNK_KIND_EXIT stream and returns it whole, with its body
+func readExitStream(r io.Reader) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length)
+	if size > handlers.MAX_EXIT_HEAD_SIZE {
+		return nil, errors.New("exit response head too large")
+	}
+
+	head := make([]byte, size)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	var exitResp handlers.ExitResponse
+	if err := json.Unmarshal(head, &exitResp); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	exitResp.Body = base64.StdEncoding.EncodeToString(body)
 
-	req, err := CreateRequestThroughNetwork(nodeList, setAddrReq, "set-redirect")
+	return json.Marshal(exitResp)
+}
+
+// decodeAnswerFrom opens the answer a node got from the node n when n doesn't stream: its layers from n on, or the
+// error of the node that got it when it isn't one
+func decodeAnswerFrom(n *list.Element, answer []byte, seqs []uint64) ([]byte, error) {
+	var encryptedResponse handlers.EncryptedResponse
+	if err := json.Unmarshal(answer, &encryptedResponse); err != nil || encryptedResponse.Data == "" {
+		return answer, nil
+	}
+
+	return decodeLayersFrom(n, encryptedResponse.Data, seqs)
+}
+
+// SendCellsThroughNetwork sends the message in fixed-size cells to the first node and opens the cells it answers
+func SendCellsThroughNetwork(nodeList *list.List, reqJson handlers.RedirectRequestJson) ([]byte, error) {
+	forward, backward, sessions, err := circuitKeys(nodeList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	respJson, err := SendHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
+	payload, err := json.Marshal(reqJson)
 	if err != nil {
-		resp, err := DecodeErrorFromNetwork(err.Error(), nodeList)
+		return nil, err
+	}
+
+	seqs := nextSeqs(nodeList)
+	cells, err := handlers.CreateForwardCells(forward, sessions, seqs, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := handlers.MarshalCells(cells)
+	if err != nil {
+		return nil, err
+	}
+
+	guard := nodeList.Front().Value.(NodeInfo)
+	respData, err := SendCellRequest(guard.Addr, guard.Session, data)
+	if err != nil {
+		return nil, err
+	}
+
+	respCells, err := handlers.ParseCells(respData)
+	if err != nil {
+		return nil, err
+	}
+
+	status, body, err := handlers.OpenBackwardCells(backward, sessions, seqs, respCells)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	return body, nil
+}
+
+// CloseCircuit tears the circuit down, every node deletes its session and tells the next one
+func CloseCircuit(nodeList *list.List) error {
+	guard := nodeList.Front().Value.(NodeInfo)
+	guard.Lock.Lock()
+	defer guard.Lock.Unlock()
+
+	if !useCells {
+		req, err := CreateDestroyRequest(nodeList)
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf("error: %s", resp)
+
+		// Only the first node answers, the ones after it just tell it whether they deleted their session
+		ad := handlers.AssociatedData(guard.Session, handlers.DIRECTION_BACKWARD, "destroy", req.Seq)
+		respJson, err := SendHttpRequest(guard.Addr, req, "destroy")
+		if err != nil {
+			return decryptNodeError(guard, err, ad)
+		}
+
+		var resp handlers.EncryptedResponse
+		if err := json.Unmarshal(respJson, &resp); err != nil {
+			return err
+		}
+
+		_, err = guard.BackwardEncryptor.DecryptBase64WithAD(resp.Data, ad)
+		return err
 	}
 
-	var resp handlers.EncryptedResponse
-	err = json.Unmarshal(respJson, &resp)
+	forward, backward, sessions, err := circuitKeys(nodeList)
 	if err != nil {
 		return err
 	}
 
-	responseStringEnc, err := DecodeRequestThroughNetwork(nodeList, resp.Data)
+	seqs := nextSeqs(nodeList)
+	cell, err := handlers.CreateDestroyCell(forward, sessions, seqs)
 	if err != nil {
 		return err
 	}
 
-	dec, err := newNode.AesEncryptor.DecryptBase64(responseStringEnc)
-
+	data, err := handlers.MarshalCells([]handlers.Cell{cell})
 	if err != nil {
 		return err
 	}
 
-	_, err = base64.StdEncoding.DecodeString(dec)
+	respData, err := SendCellRequest(guard.Addr, guard.Session, data)
+	links.Forget(guard.Addr, guard.Session)
+	if err != nil {
+		return err
+	}
 
+	respCells, err := handlers.ParseCells(respData)
 	if err != nil {
 		return err
 	}
 
-	//log.Println(string(responseString))
+	status, body, err := handlers.OpenBackwardCells(backward, sessions, seqs, respCells)
+	if err != nil {
+		return err
+	}
 
-	newNode.RedirectionAddr = redirectionAddr
+	if status != http.StatusOK {
+		return fmt.Errorf("%s", body)
+	}
 
 	return nil
 }
 
-func DecodeRequestThroughNetwork(nodeList *list.List, response string) (string, error) {
-	var err error
-	data := response
+// circuitKeys returns the forward key, backward key and session of every node of the circuit, in order
+func circuitKeys(nodeList *list.List) ([]encryption.SessionCipher, []encryption.SessionCipher, []string, error) {
+	var forward []encryption.SessionCipher
+	var backward []encryption.SessionCipher
+	var sessions []string
 
 	for n := nodeList.Front(); n != nil; n = n.Next() {
 		nodeInfo, ok := n.Value.(NodeInfo)
 		if !ok {
-			return "", fmt.Errorf("error: nodeList.Front().Value is not of type NodeInfo")
+			return nil, nil, nil, errors.New("unexpected type in node list; expected NodeInfo")
 		}
+		forward = append(forward, nodeInfo.ForwardEncryptor)
+		backward = append(backward, nodeInfo.BackwardEncryptor)
+		sessions = append(sessions, nodeInfo.Session)
+	}
+
+	return forward, backward, sessions, nil
+}
 
-		// Decrypt the data using AesEncryptor
-		data, err = nodeInfo.AesEncryptor.DecryptBase64(data)
+// nextSeqs takes the sequence number of the next message to every node of the circuit, in order
+func nextSeqs(nodeList *list.List) []uint64 {
+	var seqs []uint64
+	for n := nodeList.Front(); n != nil; n = n.Next() {
+		seqs = append(seqs, n.Value.(NodeInfo).NextSeq())
+	}
+	return seqs
+}
+
+// DecodeRequestThroughNetwork removes the layer of every node from the response and returns the body the destination answered.
+// A node that failed answers its own error, which is returned as soon as it's reached.
+// seqs are the sequence numbers the request was sent with to every node, each layer is bound to its own.
+func DecodeRequestThroughNetwork(nodeList *list.List, response string, seqs []uint64) ([]byte, error) {
+	return decodeLayersFrom(nodeList.Front(), response, seqs)
+}
+
+// decodeLayersFrom is DecodeRequestThroughNetwork from the node n on, seqs start with n's
+func decodeLayersFrom(n *list.Element, response string, seqs []uint64) ([]byte, error) {
+	data := response
+
+	i := 0
+	for ; n != nil; n, i = n.Next(), i+1 {
+		nodeInfo, ok := n.Value.(NodeInfo)
+		if !ok {
+			return nil, fmt.Errorf("error: nodeList.Front().Value is not of type NodeInfo")
+		}
+
+		// Decrypt the data with the node's backward key, it only opens as the node's answer to this request
+		ad := handlers.AssociatedData(nodeInfo.Session, handlers.DIRECTION_BACKWARD, "redirect", seqs[i])
+		decrypted, err := nodeInfo.BackwardEncryptor.DecryptBase64WithAD(data, ad)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		// Decode the decrypted data from Base64
-		decodedData, err := base64.StdEncoding.DecodeString(data)
+		decodedData, err := base64.StdEncoding.DecodeString(decrypted)
 		if err != nil {
-			return "", fmt.Errorf("error decoding Base64: %v", err)
+			return nil, fmt.Errorf("error decoding Base64: %v", err)
 		}
 
-		// Unmarshal the decoded JSON data into EncryptedResponse struct
-		var encryptedResponse handlers.EncryptedResponse
-		if err := json.Unmarshal(decodedData, &encryptedResponse); err != nil {
-			return data, nil
+		// The last node got the destination's answer as is
+		if n.Next() == nil {
+			return decodedData, nil
 		}
 
-		if encryptedResponse.Data == "" {
-			return data, nil
+		// Unmarshal the decoded JSON data into EncryptedResponse struct
+		var encryptedResponse handlers.EncryptedResponse
+		if err := json.Unmarshal(decodedData, &encryptedResponse); err != nil || encryptedResponse.Data == "" {
+			return decodedData, nil
 		}
 
 		// Use the Data field for the next iteration
 		data = encryptedResponse.Data
 	}
 
-	return data, nil
+	return nil, errors.New("empty circuit")
 }
 
-func DecodeErrorFromNetwork(errorStr string, nodeList *list.List) (string, error) {
+func DecodeErrorFromNetwork(errorStr string, nodeList *list.List, seqs []uint64) (string, error) {
 	// Split the string to extract the JSON part
 	jsonPart := strings.TrimPrefix(errorStr, "HTTP error: ")
 
@@ -305,9 +668,9 @@ func DecodeErrorFromNetwork(errorStr string, nodeList *list.List) (string, error
 		return "", err
 	}
 
-	resp, err := DecodeRequestThroughNetwork(nodeList, result.Data)
+	resp, err := DecodeRequestThroughNetwork(nodeList, result.Data, seqs)
 	if err != nil {
 		return "", err
 	}
-	return resp, nil
+	return string(resp), nil
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"marshmello/pkg/handlers"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS5 (RFC 1928), only CONNECT without authentication: the proxy listens on the loopback for the local tools
+const (
+	SOCKS_VERSION = 5
+
+	SOCKS_NO_AUTH       = 0x00
+	SOCKS_NO_ACCEPTABLE = 0xff
+
+	SOCKS_CONNECT = 0x01
+
+	SOCKS_ATYP_IPV4   = 0x01
+	SOCKS_ATYP_DOMAIN = 0x03
+	SOCKS_ATYP_IPV6   = 0x04
+
+	SOCKS_SUCCEEDED          = 0x00
+	SOCKS_FAILURE            = 0x01
+	SOCKS_NOT_ALLOWED        = 0x02
+	SOCKS_HOST_UNREACHABLE   = 0x04
+	SOCKS_CMD_NOT_SUPPORTED  = 0x07
+	SOCKS_ATYP_NOT_SUPPORTED = 0x08
+)
+
+const (
+	SOCKS_HANDSHAKE_TIMEOUT    = 10 * time.Second
+	STREAM_POLL_INTERVAL_FIRST = 50 * time.Millisecond // wait before asking again once the stream is idle
+	STREAM_POLL_INTERVAL_MAX   = time.Second
+)
+
+var streamIDs atomic.Uint32 // ids of the streams, unique for the client
+
+// ServeSocks accepts SOCKS5 connections and tunnels each one in a stream of the default circuit
+func ServeSocks(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go serveSocksConn(conn)
+	}
+}
+
+// serveSocksConn connects the SOCKS client to its target through the circuit and moves the bytes until either side closes
+func serveSocksConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(SOCKS_HANDSHAKE_TIMEOUT))
+	addr, err := socksHandshake(conn)
+	if err != nil {
+		return
+	}
+
+	circuit, err := circuitWithHops(defaultHops)
+	if err != nil {
+		log.Printf("SOCKS: no circuit: %s", err)
+		socksReply(conn, SOCKS_FAILURE)
+		return
+	}
+
+	id := streamIDs.Add(1)
+	_, err = SendThroughNetwork(&circuit.Circuit, handlers.StreamRequest{Stream: id, Addr: addr}, handlers.STREAM_BEGIN)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), handlers.EXIT_POLICY_ERROR), strings.Contains(err.Error(), handlers.STREAMS_DISABLED_ERROR):
+			socksReply(conn, SOCKS_NOT_ALLOWED)
+		default:
+			socksReply(conn, SOCKS_HOST_UNREACHABLE)
+		}
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	if err := socksReply(conn, SOCKS_SUCCEEDED); err != nil {
+		endStream(&circuit.Circuit, id)
+		return
+	}
+
+	pipeStream(conn, &circuit.Circuit, id)
+}
+
+// socksHandshake reads the method selection and the CONNECT request, and returns the address asked for.
+// Requests the proxy can't serve are answered with their error before it returns.
+func socksHandshake(conn net.Conn) (string, error) {
+	// VER | NMETHODS | METHODS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != SOCKS_VERSION {
+		return "", errors.New("not a SOCKS5 client")
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	if bytes.IndexByte(methods, SOCKS_NO_AUTH) == -1 {
+		conn.Write([]byte{SOCKS_VERSION, SOCKS_NO_ACCEPTABLE})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{SOCKS_VERSION, SOCKS_NO_AUTH}); err != nil {
+		return "", err
+	}
+
+	// VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != SOCKS_VERSION {
+		return "", errors.New("not a SOCKS5 request")
+	}
+	if request[1] != SOCKS_CONNECT {
+		socksReply(conn, SOCKS_CMD_NOT_SUPPORTED)
+		return "", fmt.Errorf("command %d not supported", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case SOCKS_ATYP_IPV4, SOCKS_ATYP_IPV6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == SOCKS_ATYP_IPV6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case SOCKS_ATYP_DOMAIN:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		// The exit relay resolves the name, so the client's resolver never learns it
+		host = string(domain)
+	default:
+		socksReply(conn, SOCKS_ATYP_NOT_SUPPORTED)
+		return "", fmt.Errorf("address type %d not supported", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply answers the CONNECT request, the bound address is never told
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{SOCKS_VERSION, code, 0, SOCKS_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// pipeStream moves the bytes between the local connection and the stream. The relays only answer requests, so when
+// neither side has anything to send the stream is asked for the target's bytes less and less often.
+func pipeStream(conn net.Conn, nodeList *list.List, id uint32) {
+	local := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(local)
+		for {
+			buf := make([]byte, handlers.STREAM_DATA_SIZE)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				select {
+				case local <- buf[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	wait := time.Duration(0)
+	for {
+		var out []byte
+		select {
+		case chunk, ok := <-local:
+			if !ok {
+				endStream(nodeList, id)
+				return
+			}
+			out = chunk
+		case <-time.After(wait):
+		}
+
+		resp, err := sendStreamData(nodeList, id, out)
+		if err != nil {
+			endStream(nodeList, id)
+			return
+		}
+
+		data, err := base64.StdEncoding.DecodeString(resp.Data)
+		if err != nil {
+			endStream(nodeList, id)
+			return
+		}
+
+		if _, err := conn.Write(data); err != nil {
+			endStream(nodeList, id)
+			return
+		}
+
+		if resp.Closed {
+			return
+		}
+
+		if len(out) == 0 && len(data) == 0 {
+			wait = min(max(2*wait, STREAM_POLL_INTERVAL_FIRST), STREAM_POLL_INTERVAL_MAX)
+		} else {
+			wait = 0
+		}
+	}
+}
+
+// sendStreamData sends the bytes of the local side and returns the answer of the exit relay
+func sendStreamData(nodeList *list.List, id uint32, data []byte) (handlers.StreamResponse, error) {
+	req := handlers.StreamRequest{Stream: id, Data: base64.StdEncoding.EncodeToString(data)}
+
+	respJson, err := SendThroughNetwork(nodeList, req, handlers.STREAM_DATA)
+	if err != nil {
+		return handlers.StreamResponse{}, err
+	}
+
+	var resp handlers.StreamResponse
+	if err := json.Unmarshal(respJson, &resp); err != nil {
+		return handlers.StreamResponse{}, err
+	}
+
+	return resp, nil
+}
+
+// endStream closes the stream on the exit relay, which also closes it when the circuit goes
+func endStream(nodeList *list.List, id uint32) {
+	SendThroughNetwork(nodeList, handlers.StreamRequest{Stream: id}, handlers.STREAM_END)
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"container/list"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"marshmello/pkg/handlers"
+	"net/http"
 	"time"
 )
 
@@ -34,6 +33,12 @@ type MessageResponse struct {
 	CreateTime *CustomTime `json:"createdAt"`
 }
 
+type UsersContainer struct {
+	Users []struct {
+		Name string `json:"name"`
+	} `json:"users"`
+}
+
 type MessagesContainer struct {
 	Messages []MessageResponse `json:"messages"`
 }
@@ -71,45 +76,8 @@ func parseMessages(jsonData string) ([]MessageResponse, error) {
 }
 
 func SendRegister(nodeList *list.List, data AuthUserRequest) error {
-	req, err := CreateRequestThroughNetwork(nodeList, data, "auth/register")
-
-	if err != nil {
-		//fmt.Println("Cant create request")
-		return err
-	}
-
-	respJson, err := SendHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
-	if err != nil {
-		resp, err := DecodeErrorFromNetwork(err.Error(), nodeList)
-		if err != nil {
-			//fmt.Println("error decoding 1")
-			return err
-		}
-		decodedResp, err := base64.StdEncoding.DecodeString(resp)
-
-		if err != nil {
-			return err
-		}
-
-		return fmt.Errorf(string(decodedResp))
-	}
-
-	var resp handlers.EncryptedResponse
-	err = json.Unmarshal(respJson, &resp)
-	if err != nil {
-		//fmt.Println("error unmarshaloing")
-		return err
-	}
-
-	responseString, err := DecodeRequestThroughNetwork(nodeList, resp.Data)
-	if err != nil {
-		//fmt.Println("error decoding 2")
-		return err
-	}
-
-	_, err = base64.StdEncoding.DecodeString(responseString)
+	_, err := SendThroughNetwork(nodeList, data, "auth/register")
 	if err != nil {
-		//fmt.Println("error decoding b64")
 		return err
 	}
 
@@ -117,46 +85,9 @@ func SendRegister(nodeList *list.List, data AuthUserRequest) error {
 }
 
 func SendLogin(nodeList *list.List, data AuthUserRequest) (string, error) {
-	req, err := CreateRequestThroughNetwork(nodeList, data, "auth/login")
-
-	if err != nil {
-		fmt.Println("Cant create request")
-		return "", nil
-	}
-
-	respJson, err := SendHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
-	if err != nil {
-		resp, err := DecodeErrorFromNetwork(err.Error(), nodeList)
-		if err != nil {
-			fmt.Println("error decoding 1")
-			return "", nil
-		}
-		decodedResp, err := base64.StdEncoding.DecodeString(resp)
-
-		if err != nil {
-			return "", err
-		}
-
-		return "", fmt.Errorf(string(decodedResp))
-	}
-
-	var resp handlers.EncryptedResponse
-	err = json.Unmarshal(respJson, &resp)
-	if err != nil {
-		//fmt.Println("error unmarshaloing")
-		return "", nil
-	}
-
-	responseString, err := DecodeRequestThroughNetwork(nodeList, resp.Data)
-	if err != nil {
-		//fmt.Println("error decoding 2")
-		return "", nil
-	}
-
-	decodedResp, err := base64.StdEncoding.DecodeString(responseString)
+	decodedResp, err := SendThroughNetwork(nodeList, data, "auth/login")
 	if err != nil {
-		//fmt.Println("error decoding b64")
-		return "", nil
+		return "", err
 	}
 
 	var key AuthResponse
@@ -170,45 +101,8 @@ func SendLogin(nodeList *list.List, data AuthUserRequest) (string, error) {
 }
 
 func SendMessage(nodeList *list.List, data SendMessageStruct) error {
-	req, err := CreateRequestThroughNetwork(nodeList, data, "messages/send")
-
-	if err != nil {
-		//fmt.Println("Cant create request")
-		return err
-	}
-
-	respJson, err := SendHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
-	if err != nil {
-		resp, err := DecodeErrorFromNetwork(err.Error(), nodeList)
-		if err != nil {
-			fmt.Println("error decoding 1")
-			return err
-		}
-		decodedResp, err := base64.StdEncoding.DecodeString(resp)
-
-		if err != nil {
-			return err
-		}
-
-		return fmt.Errorf(string(decodedResp))
-	}
-
-	var resp handlers.EncryptedResponse
-	err = json.Unmarshal(respJson, &resp)
-	if err != nil {
-		//fmt.Println("error unmarshaloing")
-		return err
-	}
-
-	responseString, err := DecodeRequestThroughNetwork(nodeList, resp.Data)
-	if err != nil {
-		//fmt.Println("error decoding 2")
-		return err
-	}
-
-	_, err = base64.StdEncoding.DecodeString(responseString)
+	_, err := SendThroughNetwork(nodeList, data, "messages/send")
 	if err != nil {
-		//fmt.Println("error decoding b64")
 		return err
 	}
 
@@ -216,53 +110,40 @@ func SendMessage(nodeList *list.List, data SendMessageStruct) error {
 }
 
 func ReceiveMessages(nodeList *list.List, data GetMessagees) ([]MessageResponse, error) {
-	req, err := CreateRequestThroughNetwork(nodeList, data, "messages/fetch")
-
+	decodedResp, err := SendThroughNetwork(nodeList, data, "messages/fetch")
 	if err != nil {
-		//fmt.Println("Cant create request")
 		return nil, err
 	}
 
-	respJson, err := SendHttpRequest(nodeList.Front().Value.(NodeInfo).Addr, req, "redirect")
+	messages, err := parseMessages(string(decodedResp))
 	if err != nil {
-		resp, err := DecodeErrorFromNetwork(err.Error(), nodeList)
-		if err != nil {
-			//fmt.Println("error decoding 1")
-			return nil, err
-		}
-		decodedResp, err := base64.StdEncoding.DecodeString(resp)
-
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, fmt.Errorf(string(decodedResp))
+		//fmt.Println("Error:", err)
+		return nil, err
 	}
 
-	var resp handlers.EncryptedResponse
-	err = json.Unmarshal(respJson, &resp)
+	return messages, nil
+}
+
+// GetUsers asks the auth service for the names of the registered users, in a GET through the circuit
+func GetUsers(nodeList *list.List) ([]string, error) {
+	resp, err := SendHttpThroughNetwork(nodeList, HttpRequest{Method: http.MethodGet, Path: "auth/users"})
 	if err != nil {
-		//fmt.Println("error unmarshaloing")
 		return nil, err
 	}
 
-	responseString, err := DecodeRequestThroughNetwork(nodeList, resp.Data)
-	if err != nil {
-		//fmt.Println("error decoding 2")
-		return nil, err
+	if resp.Status != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Body)
 	}
 
-	decodedResp, err := base64.StdEncoding.DecodeString(responseString)
-	if err != nil {
-		//fmt.Println("error decoding b64")
-		return nil, err
+	var container UsersContainer
+	if err := json.Unmarshal(resp.Body, &container); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON: %v", err)
 	}
 
-	messages, err := parseMessages(string(decodedResp))
-	if err != nil {
-		//fmt.Println("Error:", err)
-		return nil, err
+	names := make([]string, 0, len(container.Users))
+	for _, user := range container.Users {
+		names = append(names, user.Name)
 	}
 
-	return messages, nil
+	return names, nil
 }
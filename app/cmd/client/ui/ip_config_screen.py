@@ -31,18 +31,18 @@ def show_ip_config_screen(app, cute_photo):
     # Create entry fields for IPs
     ip_entries = {}
     
-    # Node IP entries
-    for i in range(1, 4):
-        node_frame = ctk.CTkFrame(frame)
-        node_frame.pack(pady=10, padx=20, fill="x")
-        
-        label = ctk.CTkLabel(node_frame, text=f"Node {i} IP:")
+    # Directory authority entries
+    for key, text in (("directory", "Directory IP"), ("directory_fp", "Directory Fingerprint")):
+        dir_frame = ctk.CTkFrame(frame)
+        dir_frame.pack(pady=10, padx=20, fill="x")
+
+        label = ctk.CTkLabel(dir_frame, text=f"{text}:")
         label.pack(side="left", padx=10)
-        
-        entry = ctk.CTkEntry(node_frame, placeholder_text=f"Enter Node {i} IP")
+
+        entry = ctk.CTkEntry(dir_frame, placeholder_text=f"Enter {text}")
         entry.pack(side="left", expand=True, padx=10)
-        
-        ip_entries[f"node{i}"] = entry
+
+        ip_entries[key] = entry
 
     # Server IP entry
     server_frame = ctk.CTkFrame(frame)
@@ -74,7 +74,7 @@ def show_ip_config_screen(app, cute_photo):
             return
 
         # Validate IP format
-        invalid_ips = [key for key, ip in ips.items() if not validate_ip(ip)]
+        invalid_ips = [key for key, ip in ips.items() if key != "directory_fp" and not validate_ip(ip)]
         if invalid_ips:
             status_label.configure(
                 text=f"Invalid IP format for: {', '.join(invalid_ips)}"
@@ -84,9 +84,8 @@ def show_ip_config_screen(app, cute_photo):
         # Construct command arguments
         args = [
             "sender.exe",
-            f"-node1={ips['node1']}",
-            f"-node2={ips['node2']}",
-            f"-node3={ips['node3']}",
+            f"-directory={ips['directory']}",
+            f"-directory-fp={ips['directory_fp']}",
             f"-server={ips['server']}"
         ]
 
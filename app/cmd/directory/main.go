@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"marshmello/pkg/directory"
+	"marshmello/pkg/encryption"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// A client that is slow to send its request, or keeps an idle connection, can't hold the directory's
+	// connections. Writing an answer to /register includes the handshake with the relay, see checkReachable.
+	READ_HEADER_TIMEOUT = 10 * time.Second
+	READ_TIMEOUT        = time.Minute
+	WRITE_TIMEOUT       = REACHABILITY_TIMEOUT + 20*time.Second
+	IDLE_TIMEOUT        = 2 * time.Minute
+
+	// Largest signed descriptor read by /register
+	MAX_DESCRIPTOR_SIZE = 8 * 1024
+)
+
+var (
+	authority     *encryption.IdentityKey
+	mu            sync.Mutex
+	registrations = make(map[string]registration) // fingerprint -> latest descriptor
+)
+
+// registration is the latest descriptor of a relay and since when the directory lists it
+type registration struct {
+	Descriptor directory.Descriptor
+	Since      time.Time // reset when the relay lapses or moves to another address
+}
+
+// WriteErrorResponse writes a standard JSON error response to the http.ResponseWriter.
+func WriteErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// registerHandler stores the signed descriptor of a relay
+//
+// Request Type: "POST /register"
+// Request Payload: directory.SignedDescriptor
+//
+// Error Responses:
+// - 400 Bad Request: the payload can't be read, the signatures don't verify, the publication time is off or the relay
+// doesn't answer a handshake with the keys of the descriptor at its address (see checkReachable)
+// - 413 Request Entity Too Large: the payload is over MAX_DESCRIPTOR_SIZE
+// - 503 Service Unavailable: the directory already lists MAX_RELAYS relays
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	var sd directory.SignedDescriptor
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_DESCRIPTOR_SIZE)).Decode(&sd)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		WriteErrorResponse(w, "Descriptor too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		WriteErrorResponse(w, "Error reading JSON data.", http.StatusBadRequest)
+		return
+	}
+
+	d, err := directory.VerifyDescriptor(sd)
+	if err != nil {
+		WriteErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if d.Published.After(now.Add(directory.MAX_CLOCK_SKEW)) || d.Published.Before(now.Add(-directory.DESCRIPTOR_LIFETIME)) {
+		WriteErrorResponse(w, "Descriptor publication time out of range.", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := d.Entry()
+	if err != nil {
+		WriteErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mu.Lock()
+	pruneRegistrations(now)
+	old, ok := registrations[entry.Fingerprint]
+	full := !ok && len(registrations) >= directory.MAX_RELAYS
+	mu.Unlock()
+
+	if full {
+		WriteErrorResponse(w, "Directory is full.", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Relays trust the addresses of the consensus, so a new address or new keys are only listed once the relay
+	// proved it holds the keys there
+	if !ok || old.Descriptor.Address != d.Address || old.Descriptor.IdentityKey != d.IdentityKey || old.Descriptor.NtorKey != d.NtorKey {
+		if err := checkReachable(d); err != nil {
+			log.Printf("Relay %s not reachable at %s: %v", entry.Fingerprint, d.Address, err)
+			WriteErrorResponse(w, "Relay not reachable at its address.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mu.Lock()
+	old, ok = registrations[entry.Fingerprint]
+	if !ok && len(registrations) >= directory.MAX_RELAYS {
+		mu.Unlock()
+		WriteErrorResponse(w, "Directory is full.", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Keep the newest descriptor, an old one could be a replay
+	if !ok || d.Published.After(old.Descriptor.Published) {
+		since := old.Since
+		if !ok || old.Descriptor.Address != d.Address {
+			since = now
+		}
+		registrations[entry.Fingerprint] = registration{Descriptor: d, Since: since}
+	}
+	mu.Unlock()
+
+	log.Printf("Registered relay %s at %s", entry.Fingerprint, d.Address)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"Message": "OK"})
+}
+
+// consensusHandler serves the signed list of relays with a fresh descriptor
+//
+// Request Type: "GET /consensus"
+// Response: directory.SignedConsensus
+func consensusHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	consensus := directory.Consensus{
+		ValidAfter: now,
+		ValidUntil: now.Add(directory.CONSENSUS_LIFETIME),
+	}
+
+	var listed []registration
+
+	mu.Lock()
+	pruneRegistrations(now)
+	for _, reg := range registrations {
+		entry, err := reg.Descriptor.Entry()
+		if err != nil {
+			continue
+		}
+		consensus.Relays = append(consensus.Relays, entry)
+		listed = append(listed, reg)
+	}
+	mu.Unlock()
+
+	// The flags come from what the directory saw of the relays, not from what they claim
+	median := medianBandwidth(consensus.Relays)
+	for i, reg := range listed {
+		consensus.Relays[i].Flags = directory.AssignFlags(reg.Descriptor, now.Sub(reg.Since), consensus.Relays[i].Bandwidth, median)
+	}
+
+	sort.Slice(consensus.Relays, func(i, j int) bool {
+		return consensus.Relays[i].Fingerprint < consensus.Relays[j].Fingerprint
+	})
+
+	sc, err := directory.SignConsensus(authority, consensus)
+	if err != nil {
+		WriteErrorResponse(w, "Error signing consensus.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sc)
+}
+
+// pruneRegistrations drops the relays whose descriptor is too old, mu must be held
+func pruneRegistrations(now time.Time) {
+	for fingerprint, reg := range registrations {
+		if reg.Descriptor.Published.Before(now.Add(-directory.DESCRIPTOR_LIFETIME)) {
+			delete(registrations, fingerprint)
+		}
+	}
+}
+
+// medianBandwidth returns the median of the bandwidth of the relays, 0 without relays
+func medianBandwidth(relays []directory.ConsensusEntry) int {
+	if len(relays) == 0 {
+		return 0
+	}
+
+	bandwidths := make([]int, 0, len(relays))
+	for _, relay := range relays {
+		bandwidths = append(bandwidths, relay.Bandwidth)
+	}
+	sort.Ints(bandwidths)
+
+	return bandwidths[len(bandwidths)/2]
+}
+
+// Router function to redirect paths to their corresponding handlers
+func router() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/register", registerHandler).Methods("POST")
+	r.HandleFunc("/consensus", consensusHandler).Methods("GET")
+
+	return r
+}
+
+func main() {
+	var err error
+
+	listen := flag.String("listen", ":9030", "Address the directory listens on")
+	keyPath := flag.String("key", "directory.key", "Path of the directory signing key, created on first start")
+	flag.Parse()
+
+	authority, err = encryption.LoadOrCreateIdentityKey(*keyPath)
+	if err != nil {
+		log.Fatal("Error loading directory key: ", err)
+		return
+	}
+
+	log.Printf("Directory authority fingerprint: %s", authority.Fingerprint())
+
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           router(),
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+		ReadTimeout:       READ_TIMEOUT,
+		WriteTimeout:      WRITE_TIMEOUT,
+		IdleTimeout:       IDLE_TIMEOUT,
+	}
+
+	log.Printf("Starting directory on %s", *listen)
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterHandlerBodyTooLarge(t *testing.T) {
+	body := append([]byte(`{"Descriptor": "`), bytes.Repeat([]byte("A"), MAX_DESCRIPTOR_SIZE)...)
+	body = append(body, `", "Signature": ""}`...)
+
+	w := httptest.NewRecorder()
+	registerHandler(w, httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body)))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized descriptor answered %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"marshmello/pkg/directory"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/handlers"
+	"net/http"
+	"time"
+)
+
+const (
+	// How long the directory waits for a relay to answer its handshake
+	REACHABILITY_TIMEOUT = 10 * time.Second
+
+	// Largest /get-aes answer read from a relay
+	MAX_HANDSHAKE_ANSWER = 16 * 1024
+)
+
+var reachabilityClient = &http.Client{Timeout: REACHABILITY_TIMEOUT}
+
+// checkReachable runs an ntor handshake with the relay at the address of its descriptor, so the directory only
+// lists an address where the holder of the descriptor's keys answers. Relays trust the addresses of the consensus
+// with the handshakes of the clients behind them, a descriptor alone could name any address.
+// The session the handshake leaves on the relay is never used and expires with the others.
+func checkReachable(d directory.Descriptor) error {
+	identity, err := encryption.DecodeIdentityPublicKey(d.IdentityKey)
+	if err != nil {
+		return err
+	}
+
+	ntorKey, err := encryption.DecodeX25519PublicKey(d.NtorKey)
+	if err != nil {
+		return err
+	}
+
+	var kp encryption.X25519KeyPair
+	if err := kp.GenerateKey(); err != nil {
+		return err
+	}
+
+	// No suites offered, the relay answers with AES-128-GCM
+	body, err := json.Marshal(handlers.GetAesRequest{
+		Version:   handlers.HANDSHAKE_NTOR,
+		X25519Key: encryption.EncodeX25519PublicKey(kp.PublicKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := reachabilityClient.Post(fmt.Sprintf("http://%s/get-aes", d.Address), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay answered %s", resp.Status)
+	}
+
+	var res handlers.GetAesResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MAX_HANDSHAKE_ANSWER)).Decode(&res); err != nil {
+		return fmt.Errorf("error reading handshake answer: %w", err)
+	}
+
+	if res.Version != handlers.HANDSHAKE_NTOR || res.Suite != encryption.SUITE_AES_128_GCM {
+		return errors.New("relay answered another handshake")
+	}
+	if res.IdentityKey != d.IdentityKey || res.NtorKey != d.NtorKey {
+		return errors.New("relay at the address doesn't hold the keys of the descriptor")
+	}
+
+	relayKey, err := encryption.DecodeX25519PublicKey(res.X25519Key)
+	if err != nil {
+		return err
+	}
+
+	auth, err := base64.StdEncoding.DecodeString(res.Auth)
+	if err != nil {
+		return err
+	}
+
+	keySize, _ := encryption.SuiteKeySize(encryption.SUITE_AES_128_GCM)
+	if _, err := kp.NtorClientHandshake(identity, ntorKey, relayKey, auth, keySize); err != nil {
+		return fmt.Errorf("relay didn't prove its ntor key: %w", err)
+	}
+
+	return nil
+}
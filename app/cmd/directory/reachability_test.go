@@ -0,0 +1,67 @@
+package main
+
+import (
+	"marshmello/pkg/directory"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/handlers"
+	"marshmello/pkg/session"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRelay serves /get-aes with the identity and returns the address it listens on
+func newTestRelay(t *testing.T, identity *encryption.IdentityKey) string {
+	t.Helper()
+
+	ms := session.NewMemoryStore(time.Hour, time.Hour)
+	t.Cleanup(ms.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetAesHandler(w, r, ms, identity)
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func newTestIdentity(t *testing.T) *encryption.IdentityKey {
+	t.Helper()
+
+	identity, err := encryption.GenerateIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestCheckReachable(t *testing.T) {
+	identity := newTestIdentity(t)
+	addr := newTestRelay(t, identity)
+
+	if err := checkReachable(directory.NewDescriptor(identity, addr, 1000, nil, "")); err != nil {
+		t.Fatalf("relay holding the keys of its descriptor: %v", err)
+	}
+}
+
+func TestCheckReachableRefused(t *testing.T) {
+	identity := newTestIdentity(t)
+	other := newTestIdentity(t)
+	addr := newTestRelay(t, other)
+
+	// A descriptor naming the address of another relay
+	if err := checkReachable(directory.NewDescriptor(identity, addr, 1000, nil, "")); err == nil {
+		t.Fatal("descriptor naming the address of another relay was accepted")
+	}
+
+	// Nothing listening at the address
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedAddr := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+
+	if err := checkReachable(directory.NewDescriptor(identity, closedAddr, 1000, nil, "")); err == nil {
+		t.Fatal("descriptor naming an address nobody answers at was accepted")
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"marshmello/pkg/directory"
+	"marshmello/pkg/exitpolicy"
+	"marshmello/pkg/handlers"
+	"marshmello/pkg/logging"
+	"marshmello/pkg/session"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the relay configuration. It is read from the YAML config file, then the environment, then the
+// command line flags, each one overriding the previous.
+type Config struct {
+	Listen          string          `yaml:"listen"`
+	AdminListen     string          `yaml:"admin_listen"` // serves /metrics, empty to disable
+	AdvertisedAddr  string          `yaml:"advertised_addr"`
+	IdentityKeyPath string          `yaml:"identity_key_path"`
+	SessionTTL      time.Duration   `yaml:"session_ttl"`
+	Store           string          `yaml:"store"`
+	RedisAddr       string          `yaml:"redis_addr"`
+	LogLevel        string          `yaml:"log_level"`
+	LogMode         string          `yaml:"log_mode"`
+	ExitPolicy      []string        `yaml:"exit_policy"`
+	ExitPaths       []string        `yaml:"exit_paths"` // paths of the destination the relay forwards to, see handlers.Registry
+	Streams         bool            `yaml:"streams"`    // connect client streams to the targets the exit policy accepts
+	Bandwidth       BandwidthConfig `yaml:"bandwidth"`
+	RateLimit       RateLimitConfig `yaml:"rate_limit"`
+	Directory       DirectoryConfig `yaml:"directory"`
+	Timeouts        TimeoutConfig   `yaml:"timeouts"`
+	BodyLimits      BodyLimitConfig `yaml:"body_limits"`
+	DrainTimeout    time.Duration   `yaml:"drain_timeout"`
+	Console         bool            `yaml:"console"`
+}
+
+// TimeoutConfig bounds how long a peer can hold the relay, on its listener and towards the next hop
+type TimeoutConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"` // to read the headers of a request
+	Read       time.Duration `yaml:"read"`        // to read a whole request, body included, 0 for no limit
+	Write      time.Duration `yaml:"write"`       // to write an answer, 0 for no limit so streamed answers can take their time
+	Idle       time.Duration `yaml:"idle"`        // a kept-alive connection waits for its next request, 0 for no limit
+	Dial       time.Duration `yaml:"dial"`        // to connect to the next hop or open a link to it
+	Response   time.Duration `yaml:"response"`    // for the next hop to start answering, or to answer on a link
+}
+
+// BodyLimitConfig caps the bodies the relay holds in memory, in KB
+type BodyLimitConfig struct {
+	MaxRequest int `yaml:"max_request"` // body of a request to the relay, answered with 413 above it, and request on a link
+	MaxAnswer  int `yaml:"max_answer"`  // answer the relay encrypts whole, chunked answers are streamed instead
+}
+
+type BandwidthConfig struct {
+	Advertised int `yaml:"advertised"` // KB/s published in the descriptor
+	Rate       int `yaml:"rate"`       // KB/s the relay reads and writes at most, 0 for no limit
+	Burst      int `yaml:"burst"`      // KB that can go above the rate at once, defaults to one second of rate
+}
+
+// RateLimitConfig limits what a single source can ask of the relay, a rate of 0 means no limit
+type RateLimitConfig struct {
+	HandshakeRate           float64 `yaml:"handshake_rate"`            // handshakes per second from one remote IP
+	HandshakeBurst          int     `yaml:"handshake_burst"`           // handshakes above the rate at once, defaults to one second of rate
+	RedirectRate            float64 `yaml:"redirect_rate"`             // messages per second on one session
+	RedirectBurst           int     `yaml:"redirect_burst"`            // messages above the rate at once, defaults to one second of rate
+	MaxConcurrentHandshakes int     `yaml:"max_concurrent_handshakes"` // handshakes running at once over every source, 0 for no cap
+}
+
+type DirectoryConfig struct {
+	Addr        string   `yaml:"addr"`        // empty to run without registering
+	Fingerprint string   `yaml:"fingerprint"` // of the directory authority, to trust its consensus, empty to hold every relay to the handshake rate
+	Flags       []string `yaml:"flags"`
+	Family      string   `yaml:"family"`
+}
+
+// DefaultConfig returns the configuration used when nothing overrides it
+func DefaultConfig() Config {
+	return Config{
+		Listen:          ":8080",
+		AdminListen:     "127.0.0.1:9090",
+		IdentityKeyPath: "identity.key",
+		SessionTTL:      session.SESSION_TTL,
+		Store:           session.STORE_REDIS,
+		RedisAddr:       "localhost:6379",
+		LogLevel:        "info",
+		LogMode:         logging.MODE_SAFE,
+		Bandwidth:       BandwidthConfig{Advertised: 1000},
+		DrainTimeout:    25 * time.Second,
+		Timeouts: TimeoutConfig{
+			ReadHeader: 10 * time.Second,
+			Read:       time.Minute,
+			Idle:       2 * time.Minute,
+			Dial:       exitpolicy.DIAL_TIMEOUT,
+			Response:   exitpolicy.RESPONSE_TIMEOUT,
+		},
+		BodyLimits: BodyLimitConfig{
+			MaxRequest: 8 * 1024,
+			MaxAnswer:  handlers.DEFAULT_MAX_ANSWER_SIZE / 1024,
+		},
+		RateLimit: RateLimitConfig{
+			HandshakeRate:           2,
+			HandshakeBurst:          10,
+			RedirectRate:            20,
+			RedirectBurst:           50,
+			MaxConcurrentHandshakes: 64,
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the config file (-config or NODE_CONFIG),
+// the environment and the command line args, and validates it.
+// Every problem found is reported in the returned error, one per line.
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	// A first pass only to find the config file, the flags are parsed again once the file and env are read
+	scratch := DefaultConfig()
+	firstPass := flag.NewFlagSet("node", flag.ExitOnError)
+	path := defineFlags(firstPass, &scratch)
+	firstPass.Parse(args)
+
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return cfg, err
+		}
+	}
+
+	envErrs := cfg.applyEnv()
+
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	defineFlags(fs, &cfg)
+	fs.Parse(args)
+
+	return cfg, errors.Join(append(envErrs, cfg.Validate())...)
+}
+
+// readFile reads the YAML config file at path over the current values, unknown keys are an error
+func (cfg *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides the values set in the environment, it returns an error per variable that can't be parsed
+func (cfg *Config) applyEnv() []error {
+	var errs []error
+
+	envString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	envInt := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	envFloat := func(name string, dst *float64) {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+				return
+			}
+			*dst = f
+		}
+	}
+	envDuration := func(name string, dst *time.Duration) {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration (e.g. 30s, 24h)", name, v))
+				return
+			}
+			*dst = d
+		}
+	}
+	envList := func(name string, sep string, dst *[]string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = splitList(v, sep)
+		}
+	}
+
+	envString("LISTEN_ADDR", &cfg.Listen)
+	envString("ADMIN_LISTEN", &cfg.AdminListen)
+	envString("ADVERTISED_ADDR", &cfg.AdvertisedAddr)
+	envString("IDENTITY_KEY_PATH", &cfg.IdentityKeyPath)
+	envDuration("SESSION_TTL", &cfg.SessionTTL)
+	envString("SESSION_STORE", &cfg.Store)
+	envString("LOG_LEVEL", &cfg.LogLevel)
+	envString("LOG_MODE", &cfg.LogMode)
+	envList("EXIT_POLICY", ";", &cfg.ExitPolicy)
+	envList("EXIT_PATHS", ",", &cfg.ExitPaths)
+	envInt("RELAY_BANDWIDTH", &cfg.Bandwidth.Advertised)
+	envInt("BANDWIDTH_RATE", &cfg.Bandwidth.Rate)
+	envInt("BANDWIDTH_BURST", &cfg.Bandwidth.Burst)
+	envFloat("HANDSHAKE_RATE", &cfg.RateLimit.HandshakeRate)
+	envInt("HANDSHAKE_BURST", &cfg.RateLimit.HandshakeBurst)
+	envFloat("REDIRECT_RATE", &cfg.RateLimit.RedirectRate)
+	envInt("REDIRECT_BURST", &cfg.RateLimit.RedirectBurst)
+	envInt("MAX_CONCURRENT_HANDSHAKES", &cfg.RateLimit.MaxConcurrentHandshakes)
+	envString("DIRECTORY_ADDR", &cfg.Directory.Addr)
+	envString("DIRECTORY_FINGERPRINT", &cfg.Directory.Fingerprint)
+	envList("RELAY_FLAGS", ",", &cfg.Directory.Flags)
+	envString("RELAY_FAMILY", &cfg.Directory.Family)
+	envDuration("READ_HEADER_TIMEOUT", &cfg.Timeouts.ReadHeader)
+	envDuration("READ_TIMEOUT", &cfg.Timeouts.Read)
+	envDuration("WRITE_TIMEOUT", &cfg.Timeouts.Write)
+	envDuration("IDLE_TIMEOUT", &cfg.Timeouts.Idle)
+	envDuration("DIAL_TIMEOUT", &cfg.Timeouts.Dial)
+	envDuration("RESPONSE_TIMEOUT", &cfg.Timeouts.Response)
+	envInt("MAX_REQUEST_SIZE", &cfg.BodyLimits.MaxRequest)
+	envInt("MAX_ANSWER_SIZE", &cfg.BodyLimits.MaxAnswer)
+	envDuration("DRAIN_TIMEOUT", &cfg.DrainTimeout)
+
+	// The Redis address is given as a host and a port, either one falls back to the current address
+	redisHost, redisPort, err := net.SplitHostPort(cfg.RedisAddr)
+	if err != nil {
+		redisHost, redisPort = "localhost", "6379"
+	}
+	envString("REDIS_HOST", &redisHost)
+	envString("REDIS_PORT", &redisPort)
+	cfg.RedisAddr = net.JoinHostPort(redisHost, redisPort)
+
+	if v := os.Getenv("CONSOLE_ENABLED"); v != "" {
+		cfg.Console = v == "true"
+	}
+	if v := os.Getenv("STREAMS_ENABLED"); v != "" {
+		cfg.Streams = v == "true"
+	}
+
+	return errs
+}
+
+// defineFlags binds the command line flags to cfg, with its current values as defaults.
+// It returns the config file path flag.
+func defineFlags(fs *flag.FlagSet, cfg *Config) *string {
+	path := fs.String("config", os.Getenv("NODE_CONFIG"), "Path of the YAML config file")
+
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "Address the relay listens on")
+	fs.StringVar(&cfg.AdminListen, "admin-listen", cfg.AdminListen, "Address the admin endpoints (/metrics) listen on, empty to disable")
+	fs.StringVar(&cfg.AdvertisedAddr, "advertised-addr", cfg.AdvertisedAddr, "Address published in the directory, required with -directory")
+	fs.StringVar(&cfg.IdentityKeyPath, "identity-key", cfg.IdentityKeyPath, "Path of the relay identity key, created on first start")
+	fs.DurationVar(&cfg.SessionTTL, "session-ttl", cfg.SessionTTL, "How long a circuit session lives")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "Session store backend (redis or memory)")
+	fs.StringVar(&cfg.RedisAddr, "redis-addr", cfg.RedisAddr, "Address of the Redis service")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level (debug, info, warn or error)")
+	fs.StringVar(&cfg.LogMode, "log-mode", cfg.LogMode, "Log mode, safe never logs addresses, session tokens or payloads, debug logs everything")
+	fs.Var(&listValue{list: &cfg.ExitPolicy}, "exit-policy", "Exit policy rule (e.g. \"accept *:8000\"), repeat the flag for every rule")
+	fs.Var(&listValue{list: &cfg.ExitPaths, sep: ","}, "exit-paths", "Comma separated paths the relay forwards exit traffic to (e.g. \"auth/*,messages/send\")")
+	fs.BoolVar(&cfg.Streams, "streams", cfg.Streams, "Connect the TCP streams of clients (SOCKS) to the targets the exit policy accepts")
+	fs.IntVar(&cfg.Bandwidth.Advertised, "bandwidth", cfg.Bandwidth.Advertised, "Bandwidth published in the directory, in KB/s")
+	fs.IntVar(&cfg.Bandwidth.Rate, "bandwidth-rate", cfg.Bandwidth.Rate, "Most KB/s the relay reads and writes, 0 for no limit")
+	fs.IntVar(&cfg.Bandwidth.Burst, "bandwidth-burst", cfg.Bandwidth.Burst, "KB that can go above the rate at once")
+	fs.Float64Var(&cfg.RateLimit.HandshakeRate, "handshake-rate", cfg.RateLimit.HandshakeRate, "Handshakes per second from one remote IP, 0 for no limit")
+	fs.IntVar(&cfg.RateLimit.HandshakeBurst, "handshake-burst", cfg.RateLimit.HandshakeBurst, "Handshakes from one remote IP above the rate at once")
+	fs.Float64Var(&cfg.RateLimit.RedirectRate, "redirect-rate", cfg.RateLimit.RedirectRate, "Messages per second on one session, 0 for no limit")
+	fs.IntVar(&cfg.RateLimit.RedirectBurst, "redirect-burst", cfg.RateLimit.RedirectBurst, "Messages on one session above the rate at once")
+	fs.IntVar(&cfg.RateLimit.MaxConcurrentHandshakes, "max-handshakes", cfg.RateLimit.MaxConcurrentHandshakes, "Handshakes running at once, 0 for no cap")
+	fs.StringVar(&cfg.Directory.Addr, "directory", cfg.Directory.Addr, "Address of the directory authority to register in")
+	fs.StringVar(&cfg.Directory.Fingerprint, "directory-fp", cfg.Directory.Fingerprint, "Fingerprint of the directory authority, its relays aren't held to the handshake rate")
+	fs.Var(&listValue{list: &cfg.Directory.Flags, sep: ","}, "relay-flags", "Comma separated flags asked of the directory (Guard, Exit), it grants them from what it observes")
+	fs.StringVar(&cfg.Directory.Family, "family", cfg.Directory.Family, "Family published in the directory")
+	fs.DurationVar(&cfg.Timeouts.ReadHeader, "read-header-timeout", cfg.Timeouts.ReadHeader, "How long a client gets to send the headers of a request")
+	fs.DurationVar(&cfg.Timeouts.Read, "read-timeout", cfg.Timeouts.Read, "How long a client gets to send a whole request, 0 for no limit")
+	fs.DurationVar(&cfg.Timeouts.Write, "write-timeout", cfg.Timeouts.Write, "How long the relay gets to write an answer, 0 for no limit")
+	fs.DurationVar(&cfg.Timeouts.Idle, "idle-timeout", cfg.Timeouts.Idle, "How long a kept-alive connection waits for its next request, 0 for no limit")
+	fs.DurationVar(&cfg.Timeouts.Dial, "dial-timeout", cfg.Timeouts.Dial, "How long the relay waits to connect to the next hop")
+	fs.DurationVar(&cfg.Timeouts.Response, "response-timeout", cfg.Timeouts.Response, "How long the next hop gets to start answering")
+	fs.IntVar(&cfg.BodyLimits.MaxRequest, "max-request-size", cfg.BodyLimits.MaxRequest, "Largest request body the relay reads, in KB")
+	fs.IntVar(&cfg.BodyLimits.MaxAnswer, "max-answer-size", cfg.BodyLimits.MaxAnswer, "Largest answer the relay encrypts whole, in KB")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "How long requests in flight get to finish on shutdown")
+	fs.BoolVar(&cfg.Console, "console", cfg.Console, "Read the EXIT command from stdin")
+
+	return path
+}
+
+// listValue is a list flag, the first use replaces the configured list and the next ones add to it
+type listValue struct {
+	list *[]string
+	sep  string // split every value on sep, when set
+	set  bool
+}
+
+func (v *listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, "; ")
+}
+
+func (v *listValue) Set(s string) error {
+	if !v.set {
+		*v.list = nil
+		v.set = true
+	}
+
+	if v.sep == "" {
+		*v.list = append(*v.list, s)
+	} else {
+		*v.list = append(*v.list, splitList(s, v.sep)...)
+	}
+	return nil
+}
+
+// splitList splits s on sep, dropping the empty items
+func splitList(s string, sep string) []string {
+	var list []string
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Validate checks every value of the configuration, all the problems are reported together
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if err := checkAddress(cfg.Listen, true); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+
+	if cfg.AdminListen != "" {
+		if err := checkAddress(cfg.AdminListen, true); err != nil {
+			errs = append(errs, fmt.Errorf("admin_listen: %w", err))
+		} else if cfg.AdminListen == cfg.Listen {
+			errs = append(errs, errors.New("admin_listen: must not be the relay's listen address"))
+		}
+	}
+
+	if cfg.AdvertisedAddr != "" {
+		if err := checkAddress(cfg.AdvertisedAddr, false); err != nil {
+			errs = append(errs, fmt.Errorf("advertised_addr: %w", err))
+		}
+	}
+
+	if cfg.IdentityKeyPath == "" {
+		errs = append(errs, errors.New("identity_key_path: required"))
+	}
+
+	if cfg.SessionTTL <= 0 {
+		errs = append(errs, errors.New("session_ttl: must be positive"))
+	}
+
+	switch cfg.Store {
+	case session.STORE_REDIS:
+		if err := checkAddress(cfg.RedisAddr, false); err != nil {
+			errs = append(errs, fmt.Errorf("redis_addr: %w", err))
+		}
+	case session.STORE_MEMORY:
+	default:
+		errs = append(errs, fmt.Errorf("store: %q must be %s or %s", cfg.Store, session.STORE_REDIS, session.STORE_MEMORY))
+	}
+
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+
+	if _, err := logging.ParseMode(cfg.LogMode); err != nil {
+		errs = append(errs, fmt.Errorf("log_mode: %w", err))
+	}
+
+	if _, err := exitpolicy.Parse(cfg.ExitPolicy); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := handlers.CheckExitPaths(cfg.ExitPaths); err != nil {
+		errs = append(errs, fmt.Errorf("exit_paths: %w", err))
+	}
+
+	if cfg.Bandwidth.Advertised <= 0 {
+		errs = append(errs, errors.New("bandwidth.advertised: must be positive"))
+	}
+	if cfg.Bandwidth.Rate < 0 {
+		errs = append(errs, errors.New("bandwidth.rate: can't be negative"))
+	}
+	if cfg.Bandwidth.Burst < 0 {
+		errs = append(errs, errors.New("bandwidth.burst: can't be negative"))
+	}
+
+	if cfg.RateLimit.HandshakeRate < 0 {
+		errs = append(errs, errors.New("rate_limit.handshake_rate: can't be negative"))
+	}
+	if cfg.RateLimit.HandshakeBurst < 0 {
+		errs = append(errs, errors.New("rate_limit.handshake_burst: can't be negative"))
+	}
+	if cfg.RateLimit.RedirectRate < 0 {
+		errs = append(errs, errors.New("rate_limit.redirect_rate: can't be negative"))
+	}
+	if cfg.RateLimit.RedirectBurst < 0 {
+		errs = append(errs, errors.New("rate_limit.redirect_burst: can't be negative"))
+	}
+	if cfg.RateLimit.MaxConcurrentHandshakes < 0 {
+		errs = append(errs, errors.New("rate_limit.max_concurrent_handshakes: can't be negative"))
+	}
+
+	if cfg.Directory.Addr != "" {
+		if err := checkAddress(cfg.Directory.Addr, false); err != nil {
+			errs = append(errs, fmt.Errorf("directory.addr: %w", err))
+		}
+		if cfg.AdvertisedAddr == "" {
+			errs = append(errs, errors.New("advertised_addr: required to register in the directory"))
+		}
+	} else if cfg.Directory.Fingerprint != "" {
+		errs = append(errs, errors.New("directory.fingerprint: needs directory.addr"))
+	}
+
+	for _, f := range cfg.Directory.Flags {
+		if f != directory.FLAG_GUARD && f != directory.FLAG_EXIT && f != directory.FLAG_STABLE {
+			errs = append(errs, fmt.Errorf("directory.flags: unknown flag %q", f))
+		}
+	}
+
+	if cfg.Timeouts.ReadHeader <= 0 {
+		errs = append(errs, errors.New("timeouts.read_header: must be positive"))
+	}
+	if cfg.Timeouts.Read < 0 {
+		errs = append(errs, errors.New("timeouts.read: can't be negative"))
+	}
+	if cfg.Timeouts.Write < 0 {
+		errs = append(errs, errors.New("timeouts.write: can't be negative"))
+	}
+	if cfg.Timeouts.Idle < 0 {
+		errs = append(errs, errors.New("timeouts.idle: can't be negative"))
+	}
+	if cfg.Timeouts.Dial <= 0 {
+		errs = append(errs, errors.New("timeouts.dial: must be positive"))
+	}
+	if cfg.Timeouts.Response <= 0 {
+		errs = append(errs, errors.New("timeouts.response: must be positive"))
+	}
+
+	if cfg.BodyLimits.MaxRequest <= 0 {
+		errs = append(errs, errors.New("body_limits.max_request: must be positive"))
+	}
+	if cfg.BodyLimits.MaxAnswer <= 0 {
+		errs = append(errs, errors.New("body_limits.max_answer: must be positive"))
+	}
+
+	if cfg.DrainTimeout <= 0 {
+		errs = append(errs, errors.New("drain_timeout: must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkAddress checks a host:port address, listen addresses may leave the host empty
+func checkAddress(addr string, listen bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%q is not a host:port address", addr)
+	}
+
+	if host == "" && !listen {
+		return fmt.Errorf("%q has no host", addr)
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("%q has an invalid port", addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"marshmello/pkg/directory"
+	"marshmello/pkg/handlers"
+	"marshmello/pkg/logging"
+	"marshmello/pkg/ratelimit"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How long a handshake refused by the concurrent handshakes cap is told to wait
+	HANDSHAKE_RETRY_AFTER = time.Second
+
+	// How often the relays of the consensus are fetched again, and how long resolving their addresses may take
+	CONSENSUS_REFRESH = 10 * time.Minute
+	RESOLVE_TIMEOUT   = 10 * time.Second
+)
+
+// limits are the rate limits of the router, a nil limit lets everything through
+type limits struct {
+	handshakes     *ratelimit.KeyedLimiter     // handshakes by remote IP
+	sessions       *ratelimit.KeyedLimiter     // messages by session
+	handshakeSlots *ratelimit.ConcurrencyLimit // handshakes running at once
+	relays         relayIPs                    // relays of the consensus, not held to the handshake rate
+}
+
+// relayIPs is the set of IPs the relays of the consensus are reached at. A relay sends the handshakes of all
+// the clients behind it, so only the first relay of a circuit limits the handshakes of a client by its IP.
+// The directory only lists an address once the relay answered its handshake there, so an address can't be claimed
+// by a descriptor alone.
+type relayIPs struct {
+	ips atomic.Pointer[map[string]bool]
+}
+
+// set replaces the set with the IPs of the relays of the consensus, resolving the addresses that are names
+func (r *relayIPs) set(consensus directory.Consensus) {
+	ctx, cancel := context.WithTimeout(context.Background(), RESOLVE_TIMEOUT)
+	defer cancel()
+
+	ips := make(map[string]bool)
+	for _, relay := range consensus.Relays {
+		host, _, err := net.SplitHostPort(relay.Address)
+		if err != nil {
+			continue
+		}
+
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			slog.Debug("Can't resolve relay of the consensus", logging.Addr("addr", relay.Address), "error", err)
+			continue
+		}
+		for _, addr := range addrs {
+			ips[addr] = true
+		}
+	}
+
+	r.ips.Store(&ips)
+}
+
+// contains reports whether ip is the IP of a relay of the consensus
+func (r *relayIPs) contains(ip string) bool {
+	ips := r.ips.Load()
+	return ips != nil && (*ips)[ip]
+}
+
+// watchConsensus keeps the relays of the consensus of the directory at dirAddr up to date in the limits
+func (l *limits) watchConsensus(dirAddr string, fingerprint string) {
+	for {
+		consensus, err := directory.FetchConsensus(dirAddr, fingerprint)
+		if err != nil {
+			slog.Warn("Error fetching the consensus", "error", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		l.relays.set(consensus)
+		slog.Debug("Relays of the consensus updated", "relays", len(consensus.Relays))
+		time.Sleep(CONSENSUS_REFRESH)
+	}
+}
+
+func newLimits(cfg RateLimitConfig) *limits {
+	l := &limits{
+		handshakes: keyedLimiter(cfg.HandshakeRate, cfg.HandshakeBurst),
+		sessions:   keyedLimiter(cfg.RedirectRate, cfg.RedirectBurst),
+	}
+	if cfg.MaxConcurrentHandshakes > 0 {
+		l.handshakeSlots = ratelimit.NewConcurrencyLimit(cfg.MaxConcurrentHandshakes)
+	}
+	return l
+}
+
+// limitBody reads the body of every request up to max bytes before anything else does, so neither the logs nor
+// the handlers hold more. A larger body is answered with 413 and BODY_TOO_LARGE_ERROR.
+func limitBody(max int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max))
+
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				slog.Debug("Request body too large", "path", r.URL.Path, "max_bytes", max)
+				handlers.SendResponse(w, handlers.ErrorResponse{Error: handlers.BODY_TOO_LARGE_ERROR}, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				handlers.SendResponse(w, map[string]string{"error": "Error reading request body."}, http.StatusBadRequest)
+				return
+			}
+
+			// Restore the body for the actual handler
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// keyedLimiter returns nil when rate is 0, a burst of 0 is one second of rate
+func keyedLimiter(rate float64, burst int) *ratelimit.KeyedLimiter {
+	if rate == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return ratelimit.NewKeyedLimiter(rate, float64(burst))
+}
+
+// handshake limits the handshakes of every remote IP, and how many run at once. The previous relay of a circuit
+// sends the handshakes of all its clients, so the relays of the consensus are only held to the concurrent cap.
+func (l *limits) handshake(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if l.handshakes != nil && !l.relays.contains(ip) && !l.handshakes.Allow(ip) {
+			slog.Debug("Handshake rate limited", logging.Addr("remote", r.RemoteAddr))
+			handlers.SendRateLimited(w, l.handshakes.RetryAfter())
+			return
+		}
+
+		if l.handshakeSlots != nil {
+			if !l.handshakeSlots.TryAcquire() {
+				slog.Debug("Too many handshakes at once", logging.Addr("remote", r.RemoteAddr))
+				handlers.SendRateLimited(w, HANDSHAKE_RETRY_AFTER)
+				return
+			}
+			defer l.handshakeSlots.Release()
+		}
+
+		next(w, r)
+	}
+}
+
+// session limits the messages of every session, the session is read from the JSON body,
+// or from the cells when cells is set. Requests without a session are left to the handler to refuse.
+func (l *limits) session(cells bool, next http.HandlerFunc) http.HandlerFunc {
+	if l.sessions == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			handlers.SendResponse(w, map[string]string{"error": "Error reading request body."}, http.StatusBadRequest)
+			return
+		}
+		// Restore the body for the actual handler
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		token := requestSession(body, cells)
+		if token != "" && !l.sessions.Allow(token) {
+			slog.Debug("Session rate limited", logging.Session(token))
+			handlers.SendRateLimited(w, l.sessions.RetryAfter())
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requestSession returns the session of a request body, or "" when it has none
+func requestSession(body []byte, cells bool) string {
+	if cells {
+		parsed, err := handlers.ParseCells(body)
+		if err != nil {
+			return ""
+		}
+		return parsed[0].Session
+	}
+
+	var req struct {
+		Session string
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+	return req.Session
+}
+
+// remoteIP is the IP the request came from, without its port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
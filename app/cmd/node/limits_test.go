@@ -0,0 +1,96 @@
+package main
+
+import (
+	"marshmello/pkg/directory"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// relayAddr is the remote address httptest gives its requests
+const relayAddr = "192.0.2.1:1234"
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// send runs one request from remote through handler and returns the status it answered
+func send(handler http.HandlerFunc, remote string, body string) int {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.RemoteAddr = remote
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	l := newLimits(RateLimitConfig{HandshakeRate: 0.001, HandshakeBurst: 2})
+	handler := l.handshake(okHandler)
+
+	for i := 0; i < 2; i++ {
+		if code := send(handler, relayAddr, ""); code != http.StatusOK {
+			t.Fatalf("handshake %d within the burst answered %d", i, code)
+		}
+	}
+	if code := send(handler, relayAddr, ""); code != http.StatusTooManyRequests {
+		t.Fatalf("handshake over the burst answered %d", code)
+	}
+
+	// Other IPs have their own budget
+	if code := send(handler, "198.51.100.7:1234", ""); code != http.StatusOK {
+		t.Fatalf("handshake from another IP answered %d", code)
+	}
+}
+
+func TestHandshakeRateExemptsConsensusRelays(t *testing.T) {
+	l := newLimits(RateLimitConfig{HandshakeRate: 0.001, HandshakeBurst: 1, MaxConcurrentHandshakes: 1})
+	l.relays.set(directory.Consensus{Relays: []directory.ConsensusEntry{{Address: "192.0.2.1:8080"}}})
+	handler := l.handshake(okHandler)
+
+	for i := 0; i < 5; i++ {
+		if code := send(handler, relayAddr, ""); code != http.StatusOK {
+			t.Fatalf("handshake %d from a relay of the consensus answered %d", i, code)
+		}
+	}
+
+	if code := send(handler, "198.51.100.7:1234", ""); code != http.StatusOK {
+		t.Fatalf("first handshake from a client answered %d", code)
+	}
+	if code := send(handler, "198.51.100.7:1234", ""); code != http.StatusTooManyRequests {
+		t.Fatalf("client over the burst answered %d", code)
+	}
+
+	// The relays are still held to the concurrent cap
+	if !l.handshakeSlots.TryAcquire() {
+		t.Fatal("no handshake slot free")
+	}
+	defer l.handshakeSlots.Release()
+
+	if code := send(handler, relayAddr, ""); code != http.StatusTooManyRequests {
+		t.Fatalf("handshake from a relay over the concurrent cap answered %d", code)
+	}
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	l := newLimits(RateLimitConfig{RedirectRate: 0.001, RedirectBurst: 2})
+	handler := l.session(false, okHandler)
+
+	for i := 0; i < 2; i++ {
+		if code := send(handler, relayAddr, `{"Session": "a"}`); code != http.StatusOK {
+			t.Fatalf("message %d within the burst answered %d", i, code)
+		}
+	}
+	if code := send(handler, relayAddr, `{"Session": "a"}`); code != http.StatusTooManyRequests {
+		t.Fatalf("message over the burst answered %d", code)
+	}
+
+	// The limit is by session, not by IP, and requests without one are left to the handler
+	if code := send(handler, relayAddr, `{"Session": "b"}`); code != http.StatusOK {
+		t.Fatalf("message of another session answered %d", code)
+	}
+	if code := send(handler, relayAddr, `{}`); code != http.StatusOK {
+		t.Fatalf("message without a session answered %d", code)
+	}
+}
@@ -3,22 +3,38 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"marshmello/pkg/directory"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/exitpolicy"
 	"marshmello/pkg/handlers"
+	"marshmello/pkg/link"
+	"marshmello/pkg/logging"
+	"marshmello/pkg/metrics"
+	"marshmello/pkg/ratelimit"
 	"marshmello/pkg/session"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var sm *session.SessionManager = nil
+var sm session.SessionStore = nil
+var identity *encryption.IdentityKey = nil
+var links *link.Pool = nil
+var policy *exitpolicy.Policy = nil
+var cfg Config
+var limiter *limits = nil
 
 // WriteErrorResponse writes a standard JSON error response to the http.ResponseWriter.
 func WriteErrorResponse(w http.ResponseWriter, message string, statusCode int) {
@@ -27,81 +43,115 @@ func WriteErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
-// Router function to redirect paths to their corresponding handlers
-func router() *mux.Router {
-	r := mux.NewRouter()
+// Middleware to log all requests at debug level, the remote address, headers and body only in debug mode
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attrs := []any{"method", r.Method, "path", r.URL.Path, logging.Addr("remote", r.RemoteAddr)}
 
-	// Middleware to log all requests
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Parse the form data and query parameters
-			r.ParseForm()
-
-			// Create the log message
-			logMsg := fmt.Sprintf("\n\033[32m=== Request Details ===\n")
-			logMsg += fmt.Sprintf("Method: %s\n", r.Method)
-			logMsg += fmt.Sprintf("Path: %s\n", r.URL.Path)
-			logMsg += fmt.Sprintf("Remote Address: %s\n", r.RemoteAddr)
-
-			// Log headers
-			logMsg += fmt.Sprintf("\nHeaders:\n")
-			for key, values := range r.Header {
-				logMsg += fmt.Sprintf("  %s: %s\n", key, strings.Join(values, ", "))
-			}
-
-			// Log query parameters
-			if len(r.URL.Query()) > 0 {
-				logMsg += fmt.Sprintf("\nQuery Parameters:\n")
-				for key, values := range r.URL.Query() {
-					logMsg += fmt.Sprintf("  %s: %s\n", key, strings.Join(values, ", "))
-				}
-			}
+		if logging.DebugMode() {
+			attrs = append(attrs, logging.Sensitive("headers", r.Header))
 
 			// Log body if it exists
 			if r.Body != nil && r.Header.Get("Content-Type") != "" {
-				var bodyBytes []byte
-				bodyBytes, _ = io.ReadAll(r.Body)
+				bodyBytes, _ := io.ReadAll(r.Body)
 				// Restore the body for the actual handler
 				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-				if len(bodyBytes) > 0 {
-					logMsg += fmt.Sprintf("\nBody:\n  %s\n", string(bodyBytes))
-				}
+				attrs = append(attrs, logging.Payload("body", bodyBytes))
 			}
+		}
 
-			logMsg += "==================\033[0m\n"
-
-			fmt.Print(logMsg)
-			next.ServeHTTP(w, r)
-		})
+		slog.Debug("Request", attrs...)
+		next.ServeHTTP(w, r)
 	})
+}
 
-	r.HandleFunc("/get-aes", func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetAesHandler(w, r, *sm)
-	}).Methods("POST")
+// Router function to redirect paths to their corresponding handlers
+func router() *mux.Router {
+	r := mux.NewRouter()
+
+	// Bodies are capped before the logs read them
+	r.Use(limitBody(int64(cfg.BodyLimits.MaxRequest) * 1024))
+	r.Use(logRequests)
+
+	r.HandleFunc("/get-aes", metrics.Instrument("get-aes", limiter.handshake(func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetAesHandler(w, r, sm, identity)
+	}))).Methods("POST")
+
+	r.HandleFunc("/set-redirect", metrics.Instrument("set-redirect", limiter.session(false, func(w http.ResponseWriter, r *http.Request) {
+		handlers.SetRedirectHandler(w, r, sm, policy)
+	}))).Methods("POST")
+
+	r.HandleFunc("/redirect", metrics.Instrument("redirect", limiter.session(false, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RedirectHandler(w, r, sm, policy)
+	}))).Methods("POST")
 
-	r.HandleFunc("/set-redirect", func(w http.ResponseWriter, r *http.Request) {
-		handlers.SetRedirectHandler(w, r, *sm)
-	}).Methods("POST")
+	r.HandleFunc("/rekey", metrics.Instrument("rekey", limiter.session(false, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RekeyHandler(w, r, sm)
+	}))).Methods("POST")
 
-	r.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
-		handlers.RedirectHandler(w, r, *sm)
-	}).Methods("POST")
+	r.HandleFunc("/destroy", metrics.Instrument("destroy", limiter.session(false, func(w http.ResponseWriter, r *http.Request) {
+		handlers.DestroyHandler(w, r, sm, policy)
+	}))).Methods("POST")
+
+	r.HandleFunc("/cell", metrics.Instrument("cell", limiter.session(true, func(w http.ResponseWriter, r *http.Request) {
+		handlers.CellHandler(w, r, sm, links, policy)
+	}))).Methods("POST")
+
+	r.HandleFunc(link.LINK_PATH, func(w http.ResponseWriter, r *http.Request) {
+		handlers.LinkHandler(w, r, sm, links, policy, limiter.sessions)
+	}).Methods("GET")
 
 	return r
 }
 
-// Function to listen for "EXIT" command and close the server
-func consoleInput(listener *net.Listener, shutdown chan bool) {
+// Router of the admin listener, kept apart from the relay's public port
+func adminRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	return r
+}
+
+// Function to publish the relay descriptor to the directory, and republish it before it goes stale
+func publishDescriptor(dirAddr string, advertisedAddr string, bandwidth int, flags []string, family string) {
+	for {
+		sd, err := directory.SignDescriptor(identity, directory.NewDescriptor(identity, advertisedAddr, bandwidth, flags, family))
+		if err == nil {
+			err = directory.Publish(dirAddr, sd)
+		}
+
+		if err != nil {
+			slog.Warn("Error publishing descriptor", "error", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		slog.Info("Published descriptor", "directory", dirAddr)
+		time.Sleep(directory.PUBLISH_INTERVAL)
+	}
+}
+
+// fatal logs the error that keeps the relay from running and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// Function to listen for "EXIT" command and ask for a shutdown
+func consoleInput(shutdown chan<- os.Signal) {
 	// Wait for EXIT command
 	fmt.Println("Type 'EXIT' to close: ")
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		text, _ := reader.ReadString('\n')
+		text, err := reader.ReadString('\n')
 		if strings.TrimSpace(strings.ToUpper(text)) == "EXIT" {
-			fmt.Println("Shutting down server...")
-			close(shutdown)
-			(*listener).Close() // Close the server listener
+			shutdown <- os.Interrupt
+			return
+		}
+		if err != nil {
+			slog.Info("Console closed, use SIGINT or SIGTERM to stop the relay")
 			return
 		}
 	}
@@ -112,62 +162,170 @@ func main() {
 	var wg sync.WaitGroup
 	var err error
 
-	// Connecting to Redis service
-	redisHost := os.Getenv("REDIS_HOST")
-	redisPort := os.Getenv("REDIS_PORT")
+	// Read the config file, environment and flags, and refuse to start on any invalid value
+	cfg, err = LoadConfig(os.Args[1:])
+	if err != nil {
+		// One line per problem found
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			slog.Error("Invalid configuration", "error", problem)
+		}
+		os.Exit(1)
+	}
 
-	if redisHost == "" {
-		redisHost = "localhost" // default fallback
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.Setup(os.Stderr, level, cfg.LogMode)
+	if logging.DebugMode() {
+		slog.Warn("Debug log mode, addresses, session tokens and payloads are logged. Never use it on a public relay")
 	}
-	if redisPort == "" {
-		redisPort = "6379" // default fallback
+
+	sm, err = session.NewSessionStore(cfg.Store, cfg.RedisAddr, cfg.SessionTTL)
+	if err != nil {
+		fatal("Error creating session store", err)
+		return
 	}
 
-	// Uncomment the following lines to initialize the session manager
+	metrics.RegisterActiveSessions(sm.Count)
+
+	if cfg.Store == session.STORE_REDIS {
+		slog.Info("Connected to Redis service", "addr", cfg.RedisAddr)
+	} else {
+		slog.Info("Using session store", "store", cfg.Store)
+	}
 
-	sm, err = session.NewSessionManager(fmt.Sprintf("%s:%s", redisHost, redisPort))
+	// Every address the relay forwards to, and every link it opens, goes through the exit policy
+	policy, err = exitpolicy.Parse(cfg.ExitPolicy)
 	if err != nil {
-		log.Fatal("Error connecting to Redis service: ", err)
+		fatal("Error parsing exit policy", err)
 		return
 	}
+	policy.SetTimeouts(cfg.Timeouts.Dial, cfg.Timeouts.Response)
+	links = link.NewPoolWithDialer(policy.DialContext)
+	links.SetLimits(link.Limits{
+		Dial:       cfg.Timeouts.Dial,
+		Request:    cfg.Timeouts.Response,
+		MaxRequest: cfg.BodyLimits.MaxRequest * 1024,
+	})
 
-	log.Printf("Connected to Redis service on %s:%s", redisHost, redisPort)
+	// Answers the relay encrypts whole are capped, chunked ones are streamed
+	handlers.MaxAnswerSize = int64(cfg.BodyLimits.MaxAnswer) * 1024
 
-	// Create a channel to signal server shutdown
-	shutdown := make(chan bool)
+	// Exit traffic is only forwarded to the paths the operator allows
+	if err := handlers.Messages.SetExitPaths(cfg.ExitPaths); err != nil {
+		fatal("Error parsing exit paths", err)
+		return
+	}
+	handlers.Streams.SetEnabled(cfg.Streams)
+
+	// Handshakes are limited by remote IP, the other requests and link messages by session
+	limiter = newLimits(cfg.RateLimit)
 
-	// Create a new Gorilla Mux router
-	r := router()
+	// Load the relay identity, creating it on first start
+	identity, err = encryption.LoadOrCreateIdentityKey(cfg.IdentityKeyPath)
+	if err != nil {
+		fatal("Error loading identity key", err)
+		return
+	}
 
-	// Start listening for requests
-	http.Handle("/", r)
+	slog.Info("Relay identity loaded", "fingerprint", identity.Fingerprint())
 
-	// Listen on port 8080
-	listener, err := net.Listen("tcp", ":8080")
+	// The relays of its consensus send the handshakes of their clients, they aren't held to the handshake rate
+	if cfg.Directory.Fingerprint != "" {
+		go limiter.watchConsensus(cfg.Directory.Addr, cfg.Directory.Fingerprint)
+	}
+
+	// Create a channel to signal server shutdown
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	listener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
-		log.Fatal("Error starting the server: ", err)
+		fatal("Error starting the server", err)
 		return
 	}
 
+	// Every connection shares the relay's bandwidth limit
+	if cfg.Bandwidth.Rate > 0 {
+		burst := cfg.Bandwidth.Burst
+		if burst == 0 {
+			burst = cfg.Bandwidth.Rate
+		}
+		listener = ratelimit.Listener(listener, ratelimit.NewTokenBucket(float64(cfg.Bandwidth.Rate*1024), float64(burst*1024)))
+		slog.Info("Bandwidth limited", "kb_per_second", cfg.Bandwidth.Rate)
+	}
+
+	// A client that is slow to send its request, or keeps an idle connection, can't hold the relay's connections
+	srv := &http.Server{
+		Handler:           router(),
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		ReadTimeout:       cfg.Timeouts.Read,
+		WriteTimeout:      cfg.Timeouts.Write,
+		IdleTimeout:       cfg.Timeouts.Idle,
+	}
+
 	// Start the HTTP server
 	go func() {
-		log.Println("Starting server on :8080")
-		if err := http.Serve(listener, nil); err != nil {
-			if err.Error() == "use of closed network connection" {
-				log.Println("Server closed.")
-			} else {
-				log.Fatal("Server error: ", err)
-			}
+		slog.Info("Starting server", "listen", cfg.Listen)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fatal("Server error", err)
 		}
 	}()
 
-	// Start listening for console input to shut down the server
-	go consoleInput(&listener, shutdown)
+	// Register in the directory when one is configured, once the relay answers the handshake the directory runs
+	if cfg.Directory.Addr != "" {
+		go publishDescriptor(cfg.Directory.Addr, cfg.AdvertisedAddr, cfg.Bandwidth.Advertised, cfg.Directory.Flags, cfg.Directory.Family)
+	}
+
+	// Serve the metrics on the admin listener
+	var admin *http.Server
+	if cfg.AdminListen != "" {
+		adminListener, err := net.Listen("tcp", cfg.AdminListen)
+		if err != nil {
+			fatal("Error starting the admin server", err)
+			return
+		}
+
+		admin = &http.Server{Handler: adminRouter(), ReadHeaderTimeout: cfg.Timeouts.ReadHeader}
+		go func() {
+			slog.Info("Starting admin server", "listen", cfg.AdminListen)
+			if err := admin.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				fatal("Admin server error", err)
+			}
+		}()
+	}
+
+	// The stdin console is an admin mode, containers usually have no stdin
+	if cfg.Console {
+		go consoleInput(shutdown)
+	}
 
 	// Wait for the shutdown signal
-	<-shutdown
+	sig := <-shutdown
+	slog.Info("Shutting down, waiting for requests in flight", "signal", sig.String(), "drain_timeout", cfg.DrainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+
+	// Stop accepting requests and let the ones in flight finish, on plain HTTP and on links
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("Requests still in flight were dropped", "error", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := links.Shutdown(ctx); err != nil {
+			slog.Warn("Link requests still in flight were dropped", "error", err)
+		}
+	}()
 
 	// Wait for all goroutines to finish before shutting down
 	wg.Wait()
-	log.Println("All requests have been processed. Server is now shut down.")
+
+	if admin != nil {
+		admin.Close()
+	}
+
+	slog.Info("All requests have been processed. Server is now shut down.")
 }
@@ -0,0 +1,307 @@
+package directory
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"marshmello/pkg/encryption"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DESCRIPTOR_SIG_PREFIX = "marshmello relay descriptor v1"
+	CONSENSUS_SIG_PREFIX  = "marshmello consensus v1"
+
+	// Relays republish before this runs out, stale descriptors are left out of the consensus
+	DESCRIPTOR_LIFETIME = 3 * time.Hour
+	PUBLISH_INTERVAL    = 1 * time.Hour
+	CONSENSUS_LIFETIME  = 1 * time.Hour
+
+	// Clock skew tolerated between relays, clients and the directory
+	MAX_CLOCK_SKEW = 10 * time.Minute
+
+	// How long the directory gets to answer a request, body included
+	REQUEST_TIMEOUT = 30 * time.Second
+
+	// Most relays the directory lists, a new relay is refused once it holds that many
+	MAX_RELAYS = 1000
+
+	// Bandwidth is advertised by the relay itself, the consensus caps it so one relay can't draw most of the paths
+	MAX_BANDWIDTH = 10000
+
+	// How long the directory must have listed a relay, without a gap and at the same address, before giving it
+	// the Stable flag, and the Guard flag
+	STABLE_UPTIME = 24 * time.Hour
+	GUARD_UPTIME  = 3 * 24 * time.Hour
+
+	FLAG_GUARD  = "Guard"
+	FLAG_EXIT   = "Exit"
+	FLAG_STABLE = "Stable"
+)
+
+// client reaches the directory, a directory that stops answering doesn't hold its relays and clients
+var client = &http.Client{Timeout: REQUEST_TIMEOUT}
+
+// Descriptor is what a relay says about itself when registering, its flags are requests, see AssignFlags
+type Descriptor struct {
+	Address     string
+	IdentityKey string // Ed25519 public key, base64 encoded
+	NtorKey     string // X25519 public key, base64 encoded
+	NtorKeySig  string // Signature of the ntor key by the identity key, base64 encoded
+	Bandwidth   int    // Advertised bandwidth in KB/s
+	Flags       []string
+	Family      string // Operator family, clients never put two relays of a family in one circuit
+	Published   time.Time
+}
+
+// SignedDescriptor carries the descriptor JSON exactly as it was signed
+type SignedDescriptor struct {
+	Descriptor string // base64 of the descriptor JSON
+	Signature  string // base64
+}
+
+// ConsensusEntry is one relay in the consensus
+type ConsensusEntry struct {
+	Fingerprint string
+	Address     string
+	IdentityKey string
+	NtorKey     string
+	Bandwidth   int
+	Flags       []string
+	Family      string
+}
+
+// Consensus is the list of usable relays published by the directory
+type Consensus struct {
+	ValidAfter time.Time
+	ValidUntil time.Time
+	Relays     []ConsensusEntry
+}
+
+// SignedConsensus carries the consensus JSON exactly as it was signed by the authority
+type SignedConsensus struct {
+	Consensus    string // base64 of the consensus JSON
+	AuthorityKey string // Ed25519 public key of the directory, base64 encoded
+	Signature    string // base64
+}
+
+// HasFlag reports whether the relay was given the flag
+func (e ConsensusEntry) HasFlag(flag string) bool {
+	for _, f := range e.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDescriptor describes the relay owning the identity key
+func NewDescriptor(id *encryption.IdentityKey, address string, bandwidth int, flags []string, family string) Descriptor {
+	return Descriptor{
+		Address:     address,
+		IdentityKey: encryption.EncodeIdentityPublicKey(id.PublicKey()),
+		NtorKey:     encryption.EncodeX25519PublicKey(id.NtorKey.PublicKey()),
+		NtorKeySig:  base64.StdEncoding.EncodeToString(id.NtorKeySignature()),
+		Bandwidth:   bandwidth,
+		Flags:       flags,
+		Family:      family,
+		Published:   time.Now().UTC(),
+	}
+}
+
+// SignDescriptor signs the descriptor with the relay identity key
+func SignDescriptor(id *encryption.IdentityKey, d Descriptor) (SignedDescriptor, error) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return SignedDescriptor{}, err
+	}
+
+	return SignedDescriptor{
+		Descriptor: base64.StdEncoding.EncodeToString(body),
+		Signature:  base64.StdEncoding.EncodeToString(id.Sign(append([]byte(DESCRIPTOR_SIG_PREFIX), body...))),
+	}, nil
+}
+
+// VerifyDescriptor checks the descriptor is signed by the identity it names and that its ntor key is certified
+func VerifyDescriptor(sd SignedDescriptor) (Descriptor, error) {
+	var d Descriptor
+
+	body, err := base64.StdEncoding.DecodeString(sd.Descriptor)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to decode descriptor: %v", err)
+	}
+
+	if err := json.Unmarshal(body, &d); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to parse descriptor: %v", err)
+	}
+
+	identity, err := encryption.DecodeIdentityPublicKey(d.IdentityKey)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(sd.Signature)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to decode signature: %v", err)
+	}
+
+	if !ed25519.Verify(identity, append([]byte(DESCRIPTOR_SIG_PREFIX), body...), signature) {
+		return Descriptor{}, errors.New("bad descriptor signature")
+	}
+
+	ntorKey, err := encryption.DecodeX25519PublicKey(d.NtorKey)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	ntorKeySig, err := base64.StdEncoding.DecodeString(d.NtorKeySig)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to decode ntor key signature: %v", err)
+	}
+
+	if !encryption.VerifyNtorKey(identity, ntorKey, ntorKeySig) {
+		return Descriptor{}, errors.New("ntor key is not signed by the identity key")
+	}
+
+	return d, nil
+}
+
+// Entry converts a verified descriptor to its consensus entry, with its bandwidth capped to MAX_BANDWIDTH.
+// The entry has no flags, the directory assigns them, see AssignFlags.
+func (d Descriptor) Entry() (ConsensusEntry, error) {
+	identity, err := encryption.DecodeIdentityPublicKey(d.IdentityKey)
+	if err != nil {
+		return ConsensusEntry{}, err
+	}
+
+	return ConsensusEntry{
+		Fingerprint: encryption.Fingerprint(identity),
+		Address:     d.Address,
+		IdentityKey: d.IdentityKey,
+		NtorKey:     d.NtorKey,
+		Bandwidth:   min(max(d.Bandwidth, 0), MAX_BANDWIDTH),
+		Family:      d.Family,
+	}, nil
+}
+
+// AssignFlags returns the flags of a relay in the consensus from what the directory observed of it. The flags of the
+// descriptor are only requests: Exit is given to a relay asking for it, Stable to a relay listed for STABLE_UPTIME,
+// and Guard to a relay asking for it that was listed for GUARD_UPTIME with at least the median bandwidth.
+func AssignFlags(d Descriptor, uptime time.Duration, bandwidth int, medianBandwidth int) []string {
+	var flags []string
+
+	requested := ConsensusEntry{Flags: d.Flags}
+	if requested.HasFlag(FLAG_EXIT) {
+		flags = append(flags, FLAG_EXIT)
+	}
+	if requested.HasFlag(FLAG_GUARD) && uptime >= GUARD_UPTIME && bandwidth >= medianBandwidth {
+		flags = append(flags, FLAG_GUARD)
+	}
+	if uptime >= STABLE_UPTIME {
+		flags = append(flags, FLAG_STABLE)
+	}
+
+	return flags
+}
+
+// SignConsensus signs the consensus with the directory authority key
+func SignConsensus(authority *encryption.IdentityKey, c Consensus) (SignedConsensus, error) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return SignedConsensus{}, err
+	}
+
+	return SignedConsensus{
+		Consensus:    base64.StdEncoding.EncodeToString(body),
+		AuthorityKey: encryption.EncodeIdentityPublicKey(authority.PublicKey()),
+		Signature:    base64.StdEncoding.EncodeToString(authority.Sign(append([]byte(CONSENSUS_SIG_PREFIX), body...))),
+	}, nil
+}
+
+// VerifyConsensus checks the consensus was signed by the authority with the given fingerprint and is currently valid
+func VerifyConsensus(sc SignedConsensus, authorityFingerprint string) (Consensus, error) {
+	var c Consensus
+
+	authority, err := encryption.DecodeIdentityPublicKey(sc.AuthorityKey)
+	if err != nil {
+		return Consensus{}, err
+	}
+
+	if encryption.Fingerprint(authority) != strings.ToLower(authorityFingerprint) {
+		return Consensus{}, fmt.Errorf("directory fingerprint mismatch: expected %s, got %s", authorityFingerprint, encryption.Fingerprint(authority))
+	}
+
+	body, err := base64.StdEncoding.DecodeString(sc.Consensus)
+	if err != nil {
+		return Consensus{}, fmt.Errorf("failed to decode consensus: %v", err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(sc.Signature)
+	if err != nil {
+		return Consensus{}, fmt.Errorf("failed to decode signature: %v", err)
+	}
+
+	if !ed25519.Verify(authority, append([]byte(CONSENSUS_SIG_PREFIX), body...), signature) {
+		return Consensus{}, errors.New("bad consensus signature")
+	}
+
+	if err := json.Unmarshal(body, &c); err != nil {
+		return Consensus{}, fmt.Errorf("failed to parse consensus: %v", err)
+	}
+
+	now := time.Now()
+	if now.Before(c.ValidAfter.Add(-MAX_CLOCK_SKEW)) || now.After(c.ValidUntil.Add(MAX_CLOCK_SKEW)) {
+		return Consensus{}, errors.New("consensus is not currently valid")
+	}
+
+	return c, nil
+}
+
+// Publish uploads the signed descriptor to the directory at dirAddr
+func Publish(dirAddr string, sd SignedDescriptor) error {
+	body, err := json.Marshal(sd)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(fmt.Sprintf("http://%s/register", dirAddr), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("directory refused descriptor: %s", msg)
+	}
+
+	return nil
+}
+
+// FetchConsensus downloads the consensus from the directory at dirAddr and verifies it
+func FetchConsensus(dirAddr string, authorityFingerprint string) (Consensus, error) {
+	var sc SignedConsensus
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/consensus", dirAddr))
+	if err != nil {
+		return Consensus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return Consensus{}, fmt.Errorf("directory error: %s", msg)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&sc); err != nil {
+		return Consensus{}, fmt.Errorf("failed to decode consensus: %v", err)
+	}
+
+	return VerifyConsensus(sc, authorityFingerprint)
+}
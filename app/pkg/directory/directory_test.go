@@ -0,0 +1,50 @@
+package directory
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAssignFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		uptime    time.Duration
+		bandwidth int
+		want      []string
+	}{
+		{"new relay", []string{FLAG_GUARD, FLAG_EXIT, FLAG_STABLE}, time.Minute, 5000, []string{FLAG_EXIT}},
+		{"stable without asking", nil, STABLE_UPTIME, 5000, []string{FLAG_STABLE}},
+		{"guard", []string{FLAG_GUARD}, GUARD_UPTIME, 1000, []string{FLAG_GUARD, FLAG_STABLE}},
+		{"guard not asked", nil, GUARD_UPTIME, 5000, []string{FLAG_STABLE}},
+		{"guard under the median", []string{FLAG_GUARD}, GUARD_UPTIME, 999, []string{FLAG_STABLE}},
+		{"guard too recent", []string{FLAG_GUARD}, GUARD_UPTIME - time.Minute, 5000, []string{FLAG_STABLE}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AssignFlags(Descriptor{Flags: tt.requested}, tt.uptime, tt.bandwidth, 1000)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryCapsBandwidth(t *testing.T) {
+	identity := "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+
+	for bandwidth, want := range map[int]int{-5: 0, 500: 500, MAX_BANDWIDTH * 10: MAX_BANDWIDTH} {
+		entry, err := Descriptor{IdentityKey: identity, Bandwidth: bandwidth, Flags: []string{FLAG_GUARD}}.Entry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Bandwidth != want {
+			t.Fatalf("bandwidth %d: got %d, want %d", bandwidth, entry.Bandwidth, want)
+		}
+		if len(entry.Flags) != 0 {
+			t.Fatalf("entry kept the requested flags %v", entry.Flags)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	CHACHA_KEY_SIZE   = chacha20poly1305.KeySize
+	CHACHA_BLOCK_SIZE = 64
+)
+
+// ChaChaEncryptor is the SUITE_CHACHA20_POLY1305 cipher, for relays without AES instructions
+type ChaChaEncryptor struct {
+	Key []byte
+}
+
+func (c *ChaChaEncryptor) GenerateKey() error {
+	c.Key = make([]byte, CHACHA_KEY_SIZE)
+	_, err := rand.Read(c.Key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ChaChaEncryptor) Encrypt(text []byte) ([]byte, error) {
+	return c.EncryptWithAD(text, nil)
+}
+
+func (c *ChaChaEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	return c.DecryptWithAD(ciphertext, nil)
+}
+
+// EncryptWithAD encrypts text and authenticates ad along with it, the same ad must be given to decrypt it
+func (c *ChaChaEncryptor) EncryptWithAD(text []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealWithNonce(aead, text, ad)
+}
+
+// DecryptWithAD decrypts ciphertext, it fails unless ad is the one it was encrypted with
+func (c *ChaChaEncryptor) DecryptWithAD(ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openWithNonce(aead, ciphertext, ad)
+}
+
+func (c *ChaChaEncryptor) EncryptBase64(textBase64 string) (string, error) {
+	return encryptBase64(c, textBase64, nil)
+}
+
+func (c *ChaChaEncryptor) DecryptBase64(ciphertextBase64 string) (string, error) {
+	return decryptBase64(c, ciphertextBase64, nil)
+}
+
+func (c *ChaChaEncryptor) EncryptBase64WithAD(textBase64 string, ad []byte) (string, error) {
+	return encryptBase64(c, textBase64, ad)
+}
+
+func (c *ChaChaEncryptor) DecryptBase64WithAD(ciphertextBase64 string, ad []byte) (string, error) {
+	return decryptBase64(c, ciphertextBase64, ad)
+}
+
+// SealLayer encrypts text under the nonce, authenticating ad with it, and returns nonce | tag | ciphertext
+func (c *ChaChaEncryptor) SealLayer(nonce []byte, text []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealLayer(aead, nonce, text, ad)
+}
+
+// OpenLayer checks and decrypts a layer made by SealLayer with the same additional data
+func (c *ChaChaEncryptor) OpenLayer(layer []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openLayer(aead, layer, ad)
+}
+
+// KeyStream returns the ChaCha20-Poly1305 keystream that encrypts the plaintext bytes [offset, offset+length) under the nonce
+func (c *ChaChaEncryptor) KeyStream(nonce []byte, offset int, length int) ([]byte, error) {
+	stream, err := chacha20.NewUnauthenticatedCipher(c.Key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// Block 0 makes the Poly1305 key, the plaintext is encrypted from block 1
+	stream.SetCounter(uint32(1 + offset/CHACHA_BLOCK_SIZE))
+
+	keyStream := make([]byte, offset%CHACHA_BLOCK_SIZE+length)
+	stream.XORKeyStream(keyStream, keyStream)
+
+	return keyStream[offset%CHACHA_BLOCK_SIZE:], nil
+}
+
+// Filler returns length pseudo-random bytes bound to the key and the nonce, from a key derived only for this
+func (c *ChaChaEncryptor) Filler(nonce []byte, length int) ([]byte, error) {
+	fillerKey, err := hkdfKey(c.Key, nil, FILLER_KEY_INFO, CHACHA_KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := chacha20.NewUnauthenticatedCipher(fillerKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	filler := make([]byte, length)
+	stream.XORKeyStream(filler, filler)
+
+	return filler, nil
+}
+
+func (c *ChaChaEncryptor) AEAD() (cipher.AEAD, error) {
+	return chacha20poly1305.New(c.Key)
+}
+
+func (c *ChaChaEncryptor) Suite() int {
+	return SUITE_CHACHA20_POLY1305
+}
+
+func (c *ChaChaEncryptor) KeyBytes() []byte {
+	return c.Key
+}
@@ -0,0 +1,203 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+A chunked stream seals a body of any length in chunks, so it can be sent as it's read instead of once it's all
+in memory. It starts with a random nonce base, then every chunk is
+
+	length (4 bytes, big endian, the top bit set on the last chunk) | sealed chunk (ciphertext | tag)
+
+The chunk number is XORed into the end of the nonce base, and the chunk number and the last flag are authenticated
+after the stream's additional data, so chunks can't be reordered, dropped or moved to another stream, and a stream
+cut before its last chunk fails to read instead of passing for a shorter body.
+*/
+
+const (
+	CHUNK_SIZE        = 16 * 1024 // most plaintext bytes in a chunk
+	CHUNK_HEADER_SIZE = 4
+
+	chunkLast = 1 << 31
+)
+
+var ErrChunkTruncated = errors.New("chunked stream cut before its last chunk")
+
+// ChunkWriter seals what is written to it in chunks and writes them to the underlying writer as they are sealed
+type ChunkWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	ad      []byte
+	base    []byte
+	counter uint64
+	closed  bool
+}
+
+// NewChunkWriter starts a chunked stream sealed with the cipher, every chunk authenticates ad
+func NewChunkWriter(c SessionCipher, w io.Writer, ad []byte) (*ChunkWriter, error) {
+	aead, err := c.AEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := NewNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(base); err != nil {
+		return nil, err
+	}
+
+	return &ChunkWriter{aead: aead, w: w, ad: ad, base: base}, nil
+}
+
+// Write seals p in as many chunks as it takes, each one is flushed when the underlying writer can flush
+func (cw *ChunkWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.New("write to a closed chunked stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), CHUNK_SIZE)
+		if err := cw.writeChunk(p[:n], false); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close writes the last chunk, without it the reader takes the stream as cut
+func (cw *ChunkWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+
+	return cw.writeChunk(nil, true)
+}
+
+func (cw *ChunkWriter) writeChunk(text []byte, last bool) error {
+	sealed := cw.aead.Seal(nil, chunkNonce(cw.base, cw.counter), text, chunkAD(cw.ad, cw.counter, last))
+	cw.counter++
+
+	header := uint32(len(sealed))
+	if last {
+		header |= chunkLast
+	}
+
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, CHUNK_HEADER_SIZE+len(sealed)), header)
+	frame = append(frame, sealed...)
+
+	if _, err := cw.w.Write(frame); err != nil {
+		return err
+	}
+
+	// The previous hop gets every chunk as soon as it's sealed
+	if flusher, ok := cw.w.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// ChunkReader opens a chunked stream, it holds a single chunk at a time
+type ChunkReader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	ad      []byte
+	base    []byte
+	counter uint64
+	text    []byte // opened and not read yet
+	done    bool
+	err     error // the stream can't be read any further
+}
+
+// NewChunkReader reads the start of a chunked stream sealed with the cipher, every chunk must authenticate ad
+func NewChunkReader(c SessionCipher, r io.Reader, ad []byte) (*ChunkReader, error) {
+	aead, err := c.AEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	base := make([]byte, GCM_NONCE_SIZE)
+	if _, err := io.ReadFull(r, base); err != nil {
+		return nil, ErrChunkTruncated
+	}
+
+	return &ChunkReader{aead: aead, r: r, ad: ad, base: base}, nil
+}
+
+// Read returns the opened bytes of the stream, and io.EOF after its last chunk
+func (cr *ChunkReader) Read(p []byte) (int, error) {
+	for len(cr.text) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.readChunk()
+	}
+
+	n := copy(p, cr.text)
+	cr.text = cr.text[n:]
+	return n, nil
+}
+
+func (cr *ChunkReader) readChunk() error {
+	header := make([]byte, CHUNK_HEADER_SIZE)
+	if _, err := io.ReadFull(cr.r, header); err != nil {
+		return ErrChunkTruncated
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	last := length&chunkLast != 0
+	length &^= chunkLast
+
+	if length < uint32(cr.aead.Overhead()) || length > uint32(CHUNK_SIZE+cr.aead.Overhead()) {
+		return errors.New("invalid chunk length")
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, sealed); err != nil {
+		return ErrChunkTruncated
+	}
+
+	text, err := cr.aead.Open(sealed[:0], chunkNonce(cr.base, cr.counter), sealed, chunkAD(cr.ad, cr.counter, last))
+	if err != nil {
+		return err
+	}
+
+	cr.counter++
+	cr.text = text
+	cr.done = last
+	return nil
+}
+
+// chunkNonce is the nonce base with the chunk number XORed into its last 8 bytes
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^counter)
+	return nonce
+}
+
+// chunkAD is the stream's additional data followed by the chunk number and whether it's the last chunk
+func chunkAD(ad []byte, counter uint64, last bool) []byte {
+	out := binary.BigEndian.AppendUint64(append([]byte{}, ad...), counter)
+	if last {
+		return append(out, 1)
+	}
+	return append(out, 0)
+}
@@ -0,0 +1,145 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealChunked seals text in a chunked stream, written in pieces of the given size
+func sealChunked(t *testing.T, c SessionCipher, text []byte, piece int, ad []byte) []byte {
+	t.Helper()
+
+	var stream bytes.Buffer
+	cw, err := NewChunkWriter(c, &stream, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(text) > 0 {
+		n := min(len(text), piece)
+		if _, err := cw.Write(text[:n]); err != nil {
+			t.Fatal(err)
+		}
+		text = text[n:]
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return stream.Bytes()
+}
+
+func openChunked(c SessionCipher, stream []byte, ad []byte) ([]byte, error) {
+	cr, err := NewChunkReader(c, bytes.NewReader(stream), ad)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(cr)
+}
+
+// splitChunks splits a chunked stream into its nonce base and its frames
+func splitChunks(t *testing.T, stream []byte) ([]byte, [][]byte) {
+	t.Helper()
+
+	base, rest := stream[:GCM_NONCE_SIZE], stream[GCM_NONCE_SIZE:]
+	var frames [][]byte
+	for len(rest) > 0 {
+		length := int(binary.BigEndian.Uint32(rest) &^ chunkLast)
+		frames = append(frames, rest[:CHUNK_HEADER_SIZE+length])
+		rest = rest[CHUNK_HEADER_SIZE+length:]
+	}
+	return base, frames
+}
+
+func joinChunks(base []byte, frames ...[]byte) []byte {
+	return bytes.Join(append([][]byte{base}, frames...), nil)
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	ad := []byte("stream")
+	for _, suite := range testSuites {
+		t.Run(SuiteName(suite), func(t *testing.T) {
+			c := newTestCipher(t, suite)
+
+			for _, size := range []int{0, 1, CHUNK_SIZE - 1, CHUNK_SIZE, CHUNK_SIZE + 1, 3*CHUNK_SIZE + 17} {
+				text := bytes.Repeat([]byte{byte(size)}, size)
+				for _, piece := range []int{1000, CHUNK_SIZE, 4 * CHUNK_SIZE} {
+					opened, err := openChunked(c, sealChunked(t, c, text, piece, ad), ad)
+					if err != nil {
+						t.Fatalf("%d bytes written %d at a time: %v", size, piece, err)
+					}
+					if !bytes.Equal(opened, text) {
+						t.Fatalf("%d bytes written %d at a time: opened %d different bytes", size, piece, len(opened))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChunkedTruncated(t *testing.T) {
+	ad := []byte("stream")
+	for _, suite := range testSuites {
+		t.Run(SuiteName(suite), func(t *testing.T) {
+			c := newTestCipher(t, suite)
+			stream := sealChunked(t, c, bytes.Repeat([]byte{'a'}, 2*CHUNK_SIZE+1), CHUNK_SIZE, ad)
+			base, frames := splitChunks(t, stream)
+			if len(frames) != 4 {
+				t.Fatalf("got %d chunks, want 3 and the last one", len(frames))
+			}
+
+			// Cut on a chunk boundary, the chunks read are authentic but the last one never comes
+			for n := range frames {
+				_, err := openChunked(c, joinChunks(base, frames[:n]...), ad)
+				if !errors.Is(err, ErrChunkTruncated) {
+					t.Errorf("cut after %d chunks: got %v, want ErrChunkTruncated", n, err)
+				}
+			}
+
+			// Cut inside a chunk
+			for _, cut := range []int{GCM_NONCE_SIZE - 1, GCM_NONCE_SIZE + 2, len(stream) - 1} {
+				if _, err := openChunked(c, stream[:cut], ad); !errors.Is(err, ErrChunkTruncated) {
+					t.Errorf("cut at byte %d: got %v, want ErrChunkTruncated", cut, err)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkedTampered(t *testing.T) {
+	ad := []byte("stream")
+	for _, suite := range testSuites {
+		t.Run(SuiteName(suite), func(t *testing.T) {
+			c := newTestCipher(t, suite)
+			stream := sealChunked(t, c, bytes.Repeat([]byte{'a'}, 2*CHUNK_SIZE+1), CHUNK_SIZE, ad)
+			base, frames := splitChunks(t, stream)
+
+			// The last chunk flag is part of the header, not of the sealed chunk
+			early := append([]byte{}, frames[1]...)
+			early[0] |= chunkLast >> 24
+
+			other := sealChunked(t, c, bytes.Repeat([]byte{'a'}, 2*CHUNK_SIZE+1), CHUNK_SIZE, ad)
+			_, otherFrames := splitChunks(t, other)
+
+			tests := []struct {
+				name   string
+				stream []byte
+				ad     []byte
+			}{
+				{"reordered", joinChunks(base, frames[1], frames[0], frames[2], frames[3]), ad},
+				{"dropped", joinChunks(base, frames[0], frames[2], frames[3]), ad},
+				{"duplicated", joinChunks(base, frames[0], frames[0], frames[1], frames[2], frames[3]), ad},
+				{"marked last early", joinChunks(base, frames[0], early), ad},
+				{"from another stream", joinChunks(base, frames[0], otherFrames[1], frames[2], frames[3]), ad},
+				{"other additional data", stream, []byte("other stream")},
+			}
+
+			for _, tt := range tests {
+				if _, err := openChunked(c, tt.stream, tt.ad); err == nil {
+					t.Errorf("%s: stream opened", tt.name)
+				}
+			}
+		})
+	}
+}
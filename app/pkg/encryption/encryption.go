@@ -1,18 +1,19 @@
 package encryption
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"io"
 )
 
 const (
-	AES_KEY_SIZE = 16
-	RSA_KEY_SIZE = 2048
+	AES_KEY_SIZE     = 16 // key of the default suite, SUITE_AES_128_GCM
+	AES_256_KEY_SIZE = 32
+	RSA_KEY_SIZE     = 2048
 )
 
 type Encrypor interface {
@@ -64,25 +65,17 @@ func (r *RSAEncryptor) Encrypt(text []byte) ([]byte, error) {
 }
 
 func (a *AESEncryptor) Encrypt(text []byte) ([]byte, error) {
-	block, err := aes.NewCipher(a.Key)
-	if err != nil {
-		return nil, err
-	}
+	return a.EncryptWithAD(text, nil)
+}
 
-	gcm, err := cipher.NewGCM(block)
+// EncryptWithAD encrypts text and authenticates ad along with it, the same ad must be given to decrypt it
+func (a *AESEncryptor) EncryptWithAD(text []byte, ad []byte) ([]byte, error) {
+	gcm, err := a.gcm()
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
-
-	ciphertext := gcm.Seal(nonce, nonce, text, nil)
-
-	return ciphertext, nil
+	return sealWithNonce(gcm, text, ad)
 }
 
 func (r *RSAEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
@@ -97,17 +90,39 @@ func (r *RSAEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
 }
 
 func (a *AESEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(a.Key)
+	return a.DecryptWithAD(ciphertext, nil)
+}
+
+// DecryptWithAD decrypts ciphertext, it fails unless ad is the one it was encrypted with
+func (a *AESEncryptor) DecryptWithAD(ciphertext []byte, ad []byte) ([]byte, error) {
+	gcm, err := a.gcm()
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+	return openWithNonce(gcm, ciphertext, ad)
+}
+
+// sealWithNonce encrypts text under a random nonce and returns nonce | ciphertext
+func sealWithNonce(aead cipher.AEAD, text []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
-	decryptedData, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+	ciphertext := aead.Seal(nonce, nonce, text, ad)
+
+	return ciphertext, nil
+}
+
+// openWithNonce decrypts what sealWithNonce returned
+func openWithNonce(aead cipher.AEAD, ciphertext []byte, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	decryptedData, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], ad)
 	if err != nil {
 		return nil, err
 	}
@@ -147,12 +162,48 @@ func (r *RSAEncryptor) DecryptBase64(ciphertextBase64 string) (string, error) {
 
 // Exposed function: Encrypts using AES and returns base64-encoded ciphertext
 func (a *AESEncryptor) EncryptBase64(textBase64 string) (string, error) {
+	return a.EncryptBase64WithAD(textBase64, nil)
+}
+
+// EncryptBase64WithAD is EncryptBase64 authenticating ad, see EncryptWithAD
+func (a *AESEncryptor) EncryptBase64WithAD(textBase64 string, ad []byte) (string, error) {
+	return encryptBase64(a, textBase64, ad)
+}
+
+// Exposed function: Decrypts base64-encoded ciphertext using AES and returns base64-encoded plaintext
+func (a *AESEncryptor) DecryptBase64(ciphertextBase64 string) (string, error) {
+	return a.DecryptBase64WithAD(ciphertextBase64, nil)
+}
+
+// DecryptBase64WithAD is DecryptBase64 checking ad, see DecryptWithAD
+func (a *AESEncryptor) DecryptBase64WithAD(ciphertextBase64 string, ad []byte) (string, error) {
+	return decryptBase64(a, ciphertextBase64, ad)
+}
+
+// Suite is SUITE_AES_128_GCM or SUITE_AES_256_GCM, after the size of the key
+func (a *AESEncryptor) Suite() int {
+	if len(a.Key) == AES_256_KEY_SIZE {
+		return SUITE_AES_256_GCM
+	}
+	return SUITE_AES_128_GCM
+}
+
+func (a *AESEncryptor) AEAD() (cipher.AEAD, error) {
+	return a.gcm()
+}
+
+func (a *AESEncryptor) KeyBytes() []byte {
+	return a.Key
+}
+
+// encryptBase64 encrypts base64-encoded text with the cipher and returns base64-encoded ciphertext
+func encryptBase64(c SessionCipher, textBase64 string, ad []byte) (string, error) {
 	text, err := base64.StdEncoding.DecodeString(textBase64)
 	if err != nil {
 		return "", err
 	}
 
-	ciphertext, err := a.Encrypt(text)
+	ciphertext, err := c.EncryptWithAD(text, ad)
 	if err != nil {
 		return "", err
 	}
@@ -160,14 +211,14 @@ func (a *AESEncryptor) EncryptBase64(textBase64 string) (string, error) {
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-// Exposed function: Decrypts base64-encoded ciphertext using AES and returns base64-encoded plaintext
-func (a *AESEncryptor) DecryptBase64(ciphertextBase64 string) (string, error) {
+// decryptBase64 decrypts base64-encoded ciphertext with the cipher and returns base64-encoded plaintext
+func decryptBase64(c SessionCipher, ciphertextBase64 string, ad []byte) (string, error) {
 	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextBase64)
 	if err != nil {
 		return "", err
 	}
 
-	plaintext, err := a.Decrypt(ciphertext)
+	plaintext, err := c.DecryptWithAD(ciphertext, ad)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,151 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	NTOR_KEY_CERT_PREFIX = "marshmello ntor key v1"
+)
+
+// IdentityKey is the long-term key pair of a relay.
+// The Ed25519 key is the relay's identity (its fingerprint), the X25519 key is the ntor key it proves possession of.
+type IdentityKey struct {
+	SigningKey ed25519.PrivateKey
+	NtorKey    *ecdh.PrivateKey
+}
+
+// GenerateIdentityKey creates a new relay identity
+func GenerateIdentityKey() (*IdentityKey, error) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ntorKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IdentityKey{
+		SigningKey: signingKey,
+		NtorKey:    ntorKey,
+	}, nil
+}
+
+// LoadOrCreateIdentityKey reads the identity from path, generating and saving a new one if the file doesn't exist
+func LoadOrCreateIdentityKey(path string) (*IdentityKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := GenerateIdentityKey()
+		if err != nil {
+			return nil, err
+		}
+		return id, id.Save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeIdentityKey(data)
+}
+
+// Save writes the identity as two PKCS#8 PEM blocks readable only by the owner
+func (id *IdentityKey) Save(path string) error {
+	data, err := id.Encode()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// Encode serializes the identity as two PKCS#8 PEM blocks, signing key first
+func (id *IdentityKey) Encode() ([]byte, error) {
+	var out []byte
+
+	for _, key := range []any{id.SigningKey, id.NtorKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal private key: %v", err)
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+
+	return out, nil
+}
+
+// DecodeIdentityKey parses an identity written by Encode
+func DecodeIdentityKey(data []byte) (*IdentityKey, error) {
+	var id IdentityKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+
+		switch k := key.(type) {
+		case ed25519.PrivateKey:
+			id.SigningKey = k
+		case *ecdh.PrivateKey:
+			id.NtorKey = k
+		}
+	}
+
+	if id.SigningKey == nil || id.NtorKey == nil || id.NtorKey.Curve() != ecdh.X25519() {
+		return nil, errors.New("identity key file must hold an Ed25519 and an X25519 private key")
+	}
+
+	return &id, nil
+}
+
+// PublicKey returns the public identity key
+func (id *IdentityKey) PublicKey() ed25519.PublicKey {
+	return id.SigningKey.Public().(ed25519.PublicKey)
+}
+
+// Fingerprint returns the hex fingerprint of the relay identity
+func (id *IdentityKey) Fingerprint() string {
+	return Fingerprint(id.PublicKey())
+}
+
+// Sign signs msg with the identity key
+func (id *IdentityKey) Sign(msg []byte) []byte {
+	return ed25519.Sign(id.SigningKey, msg)
+}
+
+// NtorKeySignature certifies the ntor key with the identity key
+func (id *IdentityKey) NtorKeySignature() []byte {
+	return id.Sign(ntorKeyCert(id.NtorKey.PublicKey()))
+}
+
+// Fingerprint returns the hex encoded SHA-256 of an identity public key
+func Fingerprint(identity ed25519.PublicKey) string {
+	sum := sha256.Sum256(identity)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyNtorKey checks that the ntor key was certified by the identity key
+func VerifyNtorKey(identity ed25519.PublicKey, ntorKey *ecdh.PublicKey, signature []byte) bool {
+	return ed25519.Verify(identity, ntorKeyCert(ntorKey), signature)
+}
+
+func ntorKeyCert(ntorKey *ecdh.PublicKey) []byte {
+	return append([]byte(NTOR_KEY_CERT_PREFIX), ntorKey.Bytes()...)
+}
@@ -1,6 +1,8 @@
 package encryption
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
@@ -42,3 +44,38 @@ func EncodeAESKey(aesKey []byte) string {
 func DecodeAESKey(encodedKey string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(encodedKey)
 }
+
+// Encode X25519 public key to base64
+func EncodeX25519PublicKey(publicKey *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey.Bytes())
+}
+
+// Decode X25519 public key from base64
+func DecodeX25519PublicKey(encodedKey string) (*ecdh.PublicKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 string: %v", err)
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	return publicKey, nil
+}
+
+// Encode Ed25519 identity public key to base64
+func EncodeIdentityPublicKey(publicKey ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
+
+// Decode Ed25519 identity public key from base64
+func DecodeIdentityPublicKey(encodedKey string) (ed25519.PublicKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 string: %v", err)
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("not an Ed25519 public key")
+	}
+	return ed25519.PublicKey(keyBytes), nil
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	X25519_KEY_INFO = "marshmello x25519 session key v1"
+
+	FORWARD_KEY_INFO  = "marshmello forward key v1"
+	BACKWARD_KEY_INFO = "marshmello backward key v1"
+
+	REKEY_FORWARD_INFO  = "marshmello rekey forward v1"
+	REKEY_BACKWARD_INFO = "marshmello rekey backward v1"
+)
+
+type X25519KeyPair struct {
+	PrivateKey *ecdh.PrivateKey
+	PublicKey  *ecdh.PublicKey
+}
+
+// GenerateKey creates a fresh ephemeral X25519 key pair
+func (x *X25519KeyPair) GenerateKey() error {
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	x.PrivateKey = privKey
+	x.PublicKey = privKey.PublicKey()
+
+	return nil
+}
+
+// SharedSecret performs the Diffie-Hellman exchange with the peer public key
+func (x *X25519KeyPair) SharedSecret(peerKey *ecdh.PublicKey) ([]byte, error) {
+	return x.PrivateKey.ECDH(peerKey)
+}
+
+// DeriveSessionKey runs the shared secret through HKDF, bound to both public keys, to get a key of size bytes
+func DeriveSessionKey(sharedSecret []byte, clientKey *ecdh.PublicKey, relayKey *ecdh.PublicKey, size int) ([]byte, error) {
+	salt := append(clientKey.Bytes(), relayKey.Bytes()...)
+
+	return hkdfKey(sharedSecret, salt, X25519_KEY_INFO, size)
+}
+
+// DeriveDirectionKeys runs the key agreed in the handshake through HKDF into the forward key, which encrypts what the
+// client sends, and the backward key, which encrypts the answers, so the two directions share no key or nonce space.
+// The keys have the size of the handshake key and are bound to the suite transcript, see SuiteTranscript.
+func DeriveDirectionKeys(handshakeKey []byte, transcript []byte) ([]byte, []byte, error) {
+	forward, err := hkdfKey(handshakeKey, transcript, FORWARD_KEY_INFO, len(handshakeKey))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backward, err := hkdfKey(handshakeKey, transcript, BACKWARD_KEY_INFO, len(handshakeKey))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return forward, backward, nil
+}
+
+// RatchetKeys derives the next forward and backward keys of a session from the current ones. HKDF can't be run
+// backwards, so once the current keys are deleted a later compromise of the session doesn't open what they encrypted.
+func RatchetKeys(forward []byte, backward []byte) ([]byte, []byte, error) {
+	nextForward, err := hkdfKey(forward, nil, REKEY_FORWARD_INFO, len(forward))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nextBackward, err := hkdfKey(backward, nil, REKEY_BACKWARD_INFO, len(backward))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nextForward, nextBackward, nil
+}
+
+// hkdfKey runs secret through HKDF-SHA256 with the salt and info into a key of size bytes
+func hkdfKey(secret []byte, salt []byte, info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// hkdfExpand is the expand step of HKDF-SHA256 alone, for a secret that is already a pseudorandom key
+func hkdfExpand(prk []byte, info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,130 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Layer helpers used by the fixed-size cells, where every hop must keep the cell length unchanged.
+// A layer is nonce | tag | ciphertext so the ciphertext stays aligned with the plaintext it encrypts.
+// Every cipher suite has the nonce and tag sizes of AES-GCM, so hops with different suites make layers of the same size.
+
+const (
+	GCM_NONCE_SIZE = 12
+	GCM_TAG_SIZE   = 16
+	LAYER_OVERHEAD = GCM_NONCE_SIZE + GCM_TAG_SIZE
+
+	FILLER_KEY_INFO = "marshmello cell filler v1"
+)
+
+// NewNonce returns a random AES-GCM nonce
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, GCM_NONCE_SIZE)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// SealLayer encrypts text under the nonce, authenticating ad with it, and returns nonce | tag | ciphertext.
+// The additional data only changes the tag, so the keystream of the layer stays the same.
+func (a *AESEncryptor) SealLayer(nonce []byte, text []byte, ad []byte) ([]byte, error) {
+	gcm, err := a.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	return sealLayer(gcm, nonce, text, ad)
+}
+
+// OpenLayer checks and decrypts a layer made by SealLayer with the same additional data
+func (a *AESEncryptor) OpenLayer(layer []byte, ad []byte) ([]byte, error) {
+	gcm, err := a.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	return openLayer(gcm, layer, ad)
+}
+
+// sealLayer is SealLayer for any AEAD with the nonce and tag sizes of a layer
+func sealLayer(aead cipher.AEAD, nonce []byte, text []byte, ad []byte) ([]byte, error) {
+	sealed := aead.Seal(nil, nonce, text, ad)
+	ciphertext, tag := sealed[:len(text)], sealed[len(text):]
+
+	layer := make([]byte, 0, LAYER_OVERHEAD+len(text))
+	layer = append(layer, nonce...)
+	layer = append(layer, tag...)
+	layer = append(layer, ciphertext...)
+
+	return layer, nil
+}
+
+// openLayer is OpenLayer for any AEAD with the nonce and tag sizes of a layer
+func openLayer(aead cipher.AEAD, layer []byte, ad []byte) ([]byte, error) {
+	if len(layer) < LAYER_OVERHEAD {
+		return nil, errors.New("layer too short")
+	}
+
+	nonce := layer[:GCM_NONCE_SIZE]
+	tag := layer[GCM_NONCE_SIZE:LAYER_OVERHEAD]
+	ciphertext := layer[LAYER_OVERHEAD:]
+
+	sealed := make([]byte, 0, len(ciphertext)+GCM_TAG_SIZE)
+	sealed = append(sealed, ciphertext...)
+	sealed = append(sealed, tag...)
+
+	return aead.Open(nil, nonce, sealed, ad)
+}
+
+// KeyStream returns the AES-GCM keystream that encrypts the plaintext bytes [offset, offset+length) under the nonce
+func (a *AESEncryptor) KeyStream(nonce []byte, offset int, length int) ([]byte, error) {
+	block, err := aes.NewCipher(a.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// GCM encrypts the plaintext in counter mode starting from nonce | 2
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	binary.BigEndian.PutUint32(iv[GCM_NONCE_SIZE:], uint32(2+offset/aes.BlockSize))
+
+	stream := make([]byte, offset%aes.BlockSize+length)
+	cipher.NewCTR(block, iv).XORKeyStream(stream, stream)
+
+	return stream[offset%aes.BlockSize:], nil
+}
+
+// Filler returns length pseudo-random bytes bound to the key and the nonce, from a key derived only for this
+func (a *AESEncryptor) Filler(nonce []byte, length int) ([]byte, error) {
+	fillerKey, err := hkdfKey(a.Key, nil, FILLER_KEY_INFO, len(a.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fillerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+
+	filler := make([]byte, length)
+	cipher.NewCTR(block, iv).XORKeyStream(filler, filler)
+
+	return filler, nil
+}
+
+func (a *AESEncryptor) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(a.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
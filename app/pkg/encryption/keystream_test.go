@@ -0,0 +1,99 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testSuites = []int{SUITE_AES_128_GCM, SUITE_AES_256_GCM, SUITE_CHACHA20_POLY1305}
+
+func newTestCipher(t *testing.T, suite int) SessionCipher {
+	t.Helper()
+
+	size, err := SuiteKeySize(suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewSessionCipher(suite, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestKeyStreamMatchesLayer(t *testing.T) {
+	text := make([]byte, 1000)
+	for i := range text {
+		text[i] = byte(i * 7)
+	}
+
+	for _, suite := range testSuites {
+		t.Run(SuiteName(suite), func(t *testing.T) {
+			c := newTestCipher(t, suite)
+			nonce, err := NewNonce()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			layer, err := c.SealLayer(nonce, text, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext := layer[LAYER_OVERHEAD:]
+
+			// Offsets on and around the AES (16) and ChaCha20 (64) block boundaries
+			for _, offset := range []int{0, 1, 15, 16, 17, 63, 64, 65, 127, 128, 500, 999} {
+				for _, length := range []int{0, 1, 16, 64, 100} {
+					length = min(length, len(text)-offset)
+
+					stream, err := c.KeyStream(nonce, offset, length)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(stream) != length {
+						t.Fatalf("offset %d: got %d bytes of keystream, want %d", offset, len(stream), length)
+					}
+
+					for i := range stream {
+						if text[offset+i]^stream[i] != ciphertext[offset+i] {
+							t.Fatalf("offset %d length %d: keystream doesn't match the layer at byte %d", offset, length, offset+i)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLayerAdditionalData(t *testing.T) {
+	for _, suite := range testSuites {
+		t.Run(SuiteName(suite), func(t *testing.T) {
+			c := newTestCipher(t, suite)
+			nonce, err := NewNonce()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			layer, err := c.SealLayer(nonce, []byte("layer"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layer) != LAYER_OVERHEAD+len("layer") {
+				t.Fatalf("layer of %d bytes, want %d", len(layer), LAYER_OVERHEAD+len("layer"))
+			}
+
+			text, err := c.OpenLayer(layer, []byte("ad"))
+			if err != nil || !bytes.Equal(text, []byte("layer")) {
+				t.Fatalf("OpenLayer = %q, %v", text, err)
+			}
+
+			if _, err := c.OpenLayer(layer, []byte("other ad")); err == nil {
+				t.Fatal("layer opened with other additional data")
+			}
+		})
+	}
+}
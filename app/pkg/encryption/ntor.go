@@ -0,0 +1,122 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// ntor handshake, following Tor's ntor-curve25519-sha256 design:
+//
+//	secret_input = EXP(X,y) | EXP(X,b) | ID | B | X | Y | PROTOID
+//	KEY_SEED     = H(secret_input, t_key)
+//	verify       = H(secret_input, t_verify)
+//	auth_input   = verify | ID | B | Y | X | PROTOID | "Server"
+//	AUTH         = H(auth_input, t_mac)
+//
+// where ID is the relay identity key, B its ntor key, X/Y the client/relay ephemeral keys.
+const (
+	NTOR_PROTOID = "marshmello-ntor-curve25519-sha256-1"
+
+	ntorKeyExtract = NTOR_PROTOID + ":key_extract"
+	ntorVerify     = NTOR_PROTOID + ":verify"
+	ntorMac        = NTOR_PROTOID + ":mac"
+	ntorKeyExpand  = NTOR_PROTOID + ":key_expand"
+)
+
+var ErrNtorAuth = errors.New("ntor handshake: relay failed to authenticate")
+
+// NtorServerHandshake answers the client's ephemeral key, returning the relay ephemeral key, the AUTH proof and the AES key,
+// of size bytes
+func NtorServerHandshake(id *IdentityKey, clientKey *ecdh.PublicKey, size int) (*ecdh.PublicKey, []byte, []byte, error) {
+	var relayKey X25519KeyPair
+
+	err := relayKey.GenerateKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	xy, err := relayKey.PrivateKey.ECDH(clientKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	xb, err := id.NtorKey.ECDH(clientKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	aesKey, auth, err := ntorDerive(xy, xb, id.PublicKey(), id.NtorKey.PublicKey(), clientKey, relayKey.PublicKey, size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return relayKey.PublicKey, auth, aesKey, nil
+}
+
+// NtorClientHandshake verifies the relay's AUTH proof for the expected identity and ntor key, returning the AES key,
+// of size bytes
+func (x *X25519KeyPair) NtorClientHandshake(identity ed25519.PublicKey, ntorKey *ecdh.PublicKey, relayKey *ecdh.PublicKey, auth []byte, size int) ([]byte, error) {
+	xy, err := x.PrivateKey.ECDH(relayKey)
+	if err != nil {
+		return nil, err
+	}
+
+	xb, err := x.PrivateKey.ECDH(ntorKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aesKey, expectedAuth, err := ntorDerive(xy, xb, identity, ntorKey, x.PublicKey, relayKey, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(auth, expectedAuth) {
+		return nil, ErrNtorAuth
+	}
+
+	return aesKey, nil
+}
+
+// ntorDerive computes the session key and the AUTH value from both Diffie-Hellman results
+func ntorDerive(xy, xb []byte, identity ed25519.PublicKey, ntorKey, clientKey, relayKey *ecdh.PublicKey, size int) ([]byte, []byte, error) {
+	var secretInput []byte
+	secretInput = append(secretInput, xy...)
+	secretInput = append(secretInput, xb...)
+	secretInput = append(secretInput, identity...)
+	secretInput = append(secretInput, ntorKey.Bytes()...)
+	secretInput = append(secretInput, clientKey.Bytes()...)
+	secretInput = append(secretInput, relayKey.Bytes()...)
+	secretInput = append(secretInput, NTOR_PROTOID...)
+
+	keySeed := ntorHash(secretInput, ntorKeyExtract)
+	verify := ntorHash(secretInput, ntorVerify)
+
+	var authInput []byte
+	authInput = append(authInput, verify...)
+	authInput = append(authInput, identity...)
+	authInput = append(authInput, ntorKey.Bytes()...)
+	authInput = append(authInput, relayKey.Bytes()...)
+	authInput = append(authInput, clientKey.Bytes()...)
+	authInput = append(authInput, NTOR_PROTOID...)
+	authInput = append(authInput, "Server"...)
+
+	auth := ntorHash(authInput, ntorMac)
+
+	aesKey, err := hkdfExpand(keySeed, ntorKeyExpand, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aesKey, auth, nil
+}
+
+// ntorHash is HMAC-SHA256 keyed with the tweak
+func ntorHash(msg []byte, tweak string) []byte {
+	mac := hmac.New(sha256.New, []byte(tweak))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,135 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Cipher suites a session can be encrypted with, negotiated in /get-aes. Clients that don't offer any get SUITE_AES_128_GCM.
+const (
+	SUITE_AES_128_GCM       = 1
+	SUITE_AES_256_GCM       = 2
+	SUITE_CHACHA20_POLY1305 = 3
+)
+
+var ErrUnsupportedSuite = errors.New("unsupported cipher suite")
+
+// SessionCipher is the AEAD of a cipher suite, everything a session encrypts goes through it
+type SessionCipher interface {
+	Encrypor
+
+	EncryptWithAD(text []byte, ad []byte) ([]byte, error)
+	DecryptWithAD(ciphertext []byte, ad []byte) ([]byte, error)
+	EncryptBase64(textBase64 string) (string, error)
+	DecryptBase64(ciphertextBase64 string) (string, error)
+	EncryptBase64WithAD(textBase64 string, ad []byte) (string, error)
+	DecryptBase64WithAD(ciphertextBase64 string, ad []byte) (string, error)
+
+	// Layers of the fixed-size cells, see keystream.go
+	SealLayer(nonce []byte, text []byte, ad []byte) ([]byte, error)
+	OpenLayer(layer []byte, ad []byte) ([]byte, error)
+	KeyStream(nonce []byte, offset int, length int) ([]byte, error)
+	Filler(nonce []byte, length int) ([]byte, error)
+
+	// AEAD is the cipher of the key, for the chunked streams
+	AEAD() (cipher.AEAD, error)
+
+	// Suite is the cipher suite of the key
+	Suite() int
+	// KeyBytes is the key, the ratchet derives the next one from it
+	KeyBytes() []byte
+}
+
+// NewSessionCipher returns the cipher of the suite with the key, which must have the suite's key size
+func NewSessionCipher(suite int, key []byte) (SessionCipher, error) {
+	size, err := SuiteKeySize(suite)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, errors.New("key size doesn't match the cipher suite")
+	}
+
+	if suite == SUITE_CHACHA20_POLY1305 {
+		return &ChaChaEncryptor{Key: key}, nil
+	}
+	return &AESEncryptor{Key: key}, nil
+}
+
+// SuiteKeySize is the size of the keys of the suite, and of the key agreed in the handshake for it
+func SuiteKeySize(suite int) (int, error) {
+	switch suite {
+	case SUITE_AES_128_GCM:
+		return AES_KEY_SIZE, nil
+	case SUITE_AES_256_GCM:
+		return AES_256_KEY_SIZE, nil
+	case SUITE_CHACHA20_POLY1305:
+		return CHACHA_KEY_SIZE, nil
+	}
+	return 0, ErrUnsupportedSuite
+}
+
+// NewKey returns a random key of size bytes
+func NewKey(size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SuiteName is the name of the suite, for logs and metrics
+func SuiteName(suite int) string {
+	switch suite {
+	case SUITE_AES_128_GCM:
+		return "aes-128-gcm"
+	case SUITE_AES_256_GCM:
+		return "aes-256-gcm"
+	case SUITE_CHACHA20_POLY1305:
+		return "chacha20-poly1305"
+	}
+	return "unknown"
+}
+
+// PreferredSuites are the suites in the order this machine runs them best: AES-GCM when the CPU has AES instructions,
+// ChaCha20-Poly1305 first otherwise, as it is much faster than AES in software
+func PreferredSuites() []int {
+	if cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ || cpu.ARM64.HasAES && cpu.ARM64.HasPMULL || cpu.S390X.HasAES {
+		return []int{SUITE_AES_256_GCM, SUITE_AES_128_GCM, SUITE_CHACHA20_POLY1305}
+	}
+	return []int{SUITE_CHACHA20_POLY1305, SUITE_AES_256_GCM, SUITE_AES_128_GCM}
+}
+
+// SelectSuite picks the first of the preferred suites the peer offered. A peer that offered none gets SUITE_AES_128_GCM.
+func SelectSuite(preferred []int, offered []int) (int, error) {
+	if len(offered) == 0 {
+		return SUITE_AES_128_GCM, nil
+	}
+
+	for _, suite := range preferred {
+		for _, o := range offered {
+			if o == suite {
+				return suite, nil
+			}
+		}
+	}
+	return 0, ErrUnsupportedSuite
+}
+
+// SuiteTranscript is what the direction keys are bound to, the suite picked and the ones offered in the order they were,
+// so a suite list tampered with on the way leaves the two sides with different keys instead of a weaker suite.
+// It's empty when nothing was offered, which keeps the keys of clients that don't negotiate as they were.
+func SuiteTranscript(suite int, offered []int) []byte {
+	if len(offered) == 0 {
+		return nil
+	}
+
+	transcript := []byte{byte(suite)}
+	for _, o := range offered {
+		transcript = append(transcript, byte(o))
+	}
+	return transcript
+}
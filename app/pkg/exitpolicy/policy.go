@@ -0,0 +1,334 @@
+package exitpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"marshmello/pkg/logging"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+An exit policy is the list of rules that decide which addresses the relay forwards to, the next relay of
+the circuit or the destination when it is the last one. Every rule is written as
+
+	accept|reject <address>:<ports>
+
+where <address> is an IP, a CIDR or "*" for every address, and <ports> is a port, a range ("8000-8100")
+or "*" for every port. For example:
+
+	accept 10.0.0.0/8:8000
+	reject *:25
+	accept *:*
+
+The rules are checked in order and the first one matching the destination decides. DEFAULT_RULES come after
+the operator's rules, so any destination they don't reject is accepted unless a rule rejects it. The networks
+DEFAULT_RULES reject (private networks, loopback, link-local and multicast) are only accepted by a rule naming
+an address or network inside them, like "accept 172.16.0.0/12:8080": a broad accept like "accept *:*" never
+reaches them. An address that can't be parsed, like a zoned IPv6 one, is never accepted.
+
+The policy is checked when the client sets the redirect address, against every address the name
+resolves to, and again on every connection the relay opens, against the address actually dialed.
+*/
+
+const (
+	ACCEPT = "accept"
+	REJECT = "reject"
+
+	DIAL_TIMEOUT     = 10 * time.Second
+	RESPONSE_TIMEOUT = 30 * time.Second // for the redirect address to start answering
+)
+
+// DEFAULT_RULES keep the relay from reaching into the networks it runs on, like its own Redis
+var DEFAULT_RULES = []string{
+	"reject 0.0.0.0/8:*",
+	"reject 127.0.0.0/8:*",
+	"reject 10.0.0.0/8:*",
+	"reject 100.64.0.0/10:*",
+	"reject 169.254.0.0/16:*",
+	"reject 172.16.0.0/12:*",
+	"reject 192.168.0.0/16:*",
+	"reject 224.0.0.0/4:*",
+	"reject ::/128:*",
+	"reject ::1/128:*",
+	"reject fc00::/7:*",
+	"reject fe80::/10:*",
+	"reject ff00::/8:*",
+}
+
+var ErrRejected = errors.New("address rejected by the exit policy")
+
+// Rule accepts or rejects the addresses of Network on the ports from MinPort to MaxPort
+type Rule struct {
+	Accept  bool
+	Network *net.IPNet // nil matches every address
+	MinPort int
+	MaxPort int
+	names   bool // Network is inside a network DEFAULT_RULES reject, so the rule can accept it
+}
+
+// Policy is the list of rules of the relay, in the order they are checked
+type Policy struct {
+	Rules       []Rule
+	protected   []*net.IPNet // networks DEFAULT_RULES reject
+	client      *http.Client
+	dialTimeout time.Duration
+}
+
+// Parse parses every rule and appends DEFAULT_RULES, the errors of all the invalid rules are reported together
+func Parse(rules []string) (*Policy, error) {
+	policy := &Policy{}
+	var errs []error
+
+	var defaults []Rule
+	for _, line := range DEFAULT_RULES {
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		defaults = append(defaults, rule)
+		policy.protected = append(policy.protected, rule.Network)
+	}
+
+	for _, line := range rules {
+		rule, err := ParseRule(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rule.names = rule.Network != nil && policy.isProtected(rule.Network)
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	policy.Rules = append(policy.Rules, defaults...)
+
+	policy.SetTimeouts(DIAL_TIMEOUT, RESPONSE_TIMEOUT)
+
+	return policy, nil
+}
+
+// SetTimeouts sets how long the relay waits to connect to an address, and for a redirect address to start answering.
+// It is called before the policy is used, the answer itself can take as long as it streams.
+func (p *Policy) SetTimeouts(dial time.Duration, response time.Duration) {
+	p.dialTimeout = dial
+
+	// Every request to a redirect address goes through this client, so it can only dial what the policy accepts
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = p.DialContext
+	transport.ResponseHeaderTimeout = response
+	p.client = &http.Client{Transport: transport}
+}
+
+// DialTimeout is how long the relay waits to connect to an address
+func (p *Policy) DialTimeout() time.Duration {
+	return p.dialTimeout
+}
+
+// Allows reports whether the policy accepts the destination, a nil IP is never accepted
+func (p *Policy) Allows(ip net.IP, port int) bool {
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	protected := p.isProtected(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	for _, rule := range p.Rules {
+		if port < rule.MinPort || port > rule.MaxPort {
+			continue
+		}
+		if rule.Network != nil && !rule.Network.Contains(ip) {
+			continue
+		}
+		// A broad accept never reaches the networks DEFAULT_RULES reject, only a rule naming them does
+		if rule.Accept && protected && !rule.names {
+			continue
+		}
+		return rule.Accept
+	}
+
+	return true
+}
+
+// isProtected reports whether the network is inside one that DEFAULT_RULES reject
+func (p *Policy) isProtected(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	for _, outer := range p.protected {
+		outerOnes, outerBits := outer.Mask.Size()
+		if outerBits == bits && outerOnes <= ones && outer.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an IP address without its IPv6 zone, IPv4-mapped IPv6 addresses as IPv4. It returns nil for anything else.
+func parseIP(host string) net.IP {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	return net.IP(addr.WithZone("").Unmap().AsSlice())
+}
+
+// Check checks a host:port address, a name is resolved and every address it resolves to must be accepted
+func (p *Policy) Check(ctx context.Context, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%q is not a host:port address", addr)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%q has an invalid port", addr)
+	}
+
+	ips := []net.IP{parseIP(host)}
+	if ips[0] == nil {
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("can't resolve %q: %w", host, err)
+		}
+
+		ips = ips[:0]
+		for _, ip := range resolved {
+			ips = append(ips, parseIP(ip.IP.String()))
+		}
+	}
+
+	for _, ip := range ips {
+		if !p.Allows(ip, port) {
+			return fmt.Errorf("%s: %w", addr, ErrRejected)
+		}
+	}
+
+	return nil
+}
+
+// DialContext dials like net.Dialer, refusing to connect to an address the policy rejects.
+// The address is checked once resolved, so a name can't be pointed at another address after Check.
+func (p *Policy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: p.dialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			// The address dialed may carry an IPv6 zone, it's checked without it and rejected when it doesn't parse
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !p.Allows(parseIP(addrPort.Addr().String()), int(addrPort.Port())) {
+				slog.Warn("Connection rejected by the exit policy", logging.Addr("addr", address))
+				return ErrRejected
+			}
+			return nil
+		},
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Client returns the HTTP client used to reach redirect addresses, it dials through DialContext
+func (p *Policy) Client() *http.Client {
+	return p.client
+}
+
+// ParseRule parses a single "accept|reject <address>:<ports>" rule
+func ParseRule(line string) (Rule, error) {
+	var rule Rule
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return rule, fmt.Errorf("exit policy rule %q: expected \"accept|reject <address>:<ports>\"", line)
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case ACCEPT:
+		rule.Accept = true
+	case REJECT:
+		rule.Accept = false
+	default:
+		return rule, fmt.Errorf("exit policy rule %q: action must be %s or %s", line, ACCEPT, REJECT)
+	}
+
+	// The ports come after the last colon, CIDRs don't have one
+	sep := strings.LastIndex(fields[1], ":")
+	if sep == -1 {
+		return rule, fmt.Errorf("exit policy rule %q: missing the ports", line)
+	}
+	addr, ports := fields[1][:sep], fields[1][sep+1:]
+
+	network, err := parseAddress(addr)
+	if err != nil {
+		return rule, fmt.Errorf("exit policy rule %q: %w", line, err)
+	}
+	rule.Network = network
+
+	rule.MinPort, rule.MaxPort, err = parsePorts(ports)
+	if err != nil {
+		return rule, fmt.Errorf("exit policy rule %q: %w", line, err)
+	}
+
+	return rule, nil
+}
+
+// parseAddress parses "*", an IP or a CIDR, a single IP is a network of its own
+func parseAddress(addr string) (*net.IPNet, error) {
+	if addr == "*" {
+		return nil, nil
+	}
+
+	if strings.Contains(addr, "/") {
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", addr)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parsePorts parses "*", a port or a "min-max" range
+func parsePorts(ports string) (int, int, error) {
+	if ports == "*" {
+		return 1, 65535, nil
+	}
+
+	low, high, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		high = low
+	}
+
+	minPort, err := strconv.Atoi(low)
+	if err != nil || minPort < 1 || minPort > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", low)
+	}
+
+	maxPort, err := strconv.Atoi(high)
+	if err != nil || maxPort < 1 || maxPort > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", high)
+	}
+
+	if minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+
+	return minPort, maxPort, nil
+}
@@ -0,0 +1,177 @@
+package exitpolicy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		accept  bool
+		network string // "" for every address
+		minPort int
+		maxPort int
+	}{
+		{"accept *:*", true, "", 1, 65535},
+		{"reject *:25", false, "", 25, 25},
+		{"ACCEPT 10.0.0.0/8:8000-8100", true, "10.0.0.0/8", 8000, 8100},
+		{"accept 192.168.1.1:443", true, "192.168.1.1/32", 443, 443},
+		{"reject ::1:*", false, "::1/128", 1, 65535},
+		{"reject fe80::/10:*", false, "fe80::/10", 1, 65535},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rule, err := ParseRule(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			network := ""
+			if rule.Network != nil {
+				network = rule.Network.String()
+			}
+			if rule.Accept != tt.accept || network != tt.network || rule.MinPort != tt.minPort || rule.MaxPort != tt.maxPort {
+				t.Fatalf("got %+v (network %q), want accept %v network %q ports %d-%d", rule, network, tt.accept, tt.network, tt.minPort, tt.maxPort)
+			}
+		})
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"accept",
+		"allow *:*",
+		"accept *",
+		"accept 10.0.0.0/33:80",
+		"accept 10.0.0.300:80",
+		"accept *:0",
+		"accept *:65536",
+		"accept *:90-80",
+		"accept *:http",
+	} {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("ParseRule(%q) accepted an invalid rule", line)
+		}
+	}
+}
+
+func TestParseReportsEveryInvalidRule(t *testing.T) {
+	_, err := Parse([]string{"accept *:0", "accept *:*", "drop *:*"})
+	if err == nil {
+		t.Fatal("invalid rules accepted")
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != 2 {
+		t.Fatalf("got %v, want both invalid rules reported", err)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		ip    net.IP
+		port  int
+		allow bool
+	}{
+		{"nil IP", []string{"accept *:*"}, nil, 80, false},
+		{"public address without rules", nil, net.ParseIP("8.8.8.8"), 80, true},
+		{"first matching rule wins", []string{"reject *:25", "accept *:*"}, net.ParseIP("8.8.8.8"), 25, false},
+		{"port outside the rule", []string{"reject *:25"}, net.ParseIP("8.8.8.8"), 26, true},
+		{"port range", []string{"reject 8.8.8.0/24:8000-8100"}, net.ParseIP("8.8.8.8"), 8100, false},
+
+		// DEFAULT_RULES can't be opened by a broad accept
+		{"loopback", []string{"accept *:*"}, net.ParseIP("127.0.0.1"), 80, false},
+		{"IPv4-mapped loopback", []string{"accept *:*"}, net.ParseIP("::ffff:127.0.0.1"), 80, false},
+		{"IPv6 loopback", []string{"accept *:*"}, net.ParseIP("::1"), 80, false},
+		{"link-local", []string{"accept *:*"}, net.ParseIP("fe80::1"), 80, false},
+		{"private network", []string{"accept 0.0.0.0/0:*"}, net.ParseIP("10.1.1.1"), 6379, false},
+		{"16 byte IPv4", []string{"accept *:*"}, net.ParseIP("172.17.0.2").To16(), 80, false},
+
+		// but a rule naming an address inside them can
+		{"named address", []string{"accept 127.0.0.1:*"}, net.ParseIP("127.0.0.1"), 8080, true},
+		{"named network", []string{"accept 172.16.0.0/12:8080"}, net.ParseIP("172.17.0.2"), 8080, true},
+		{"named network on another port", []string{"accept 172.16.0.0/12:8080"}, net.ParseIP("172.17.0.2"), 6379, false},
+		{"network wider than the protected one", []string{"accept 172.0.0.0/8:*"}, net.ParseIP("172.17.0.2"), 80, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := Parse(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := policy.Allows(tt.ip, tt.port); got != tt.allow {
+				t.Fatalf("Allows(%v, %d) with %q = %v, want %v", tt.ip, tt.port, tt.rules, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	tests := []struct {
+		host string
+		want string // "" for nil
+	}{
+		{"8.8.8.8", "8.8.8.8"},
+		{"::ffff:127.0.0.1", "127.0.0.1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"example.com", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got := parseIP(tt.host)
+		if (got == nil) != (tt.want == "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("parseIP(%q) = %v, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	policy, err := Parse([]string{"accept *:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"[fe80::1%lo]:80", "[::ffff:127.0.0.1]:80", "127.0.0.1:6379"} {
+		if err := policy.Check(context.Background(), addr); !errors.Is(err, ErrRejected) {
+			t.Errorf("Check(%q) = %v, want ErrRejected", addr, err)
+		}
+	}
+
+	for _, addr := range []string{"8.8.8.8", "8.8.8.8:0", "8.8.8.8:http"} {
+		if err := policy.Check(context.Background(), addr); err == nil || errors.Is(err, ErrRejected) {
+			t.Errorf("Check(%q) = %v, want an invalid address error", addr, err)
+		}
+	}
+
+	if err := policy.Check(context.Background(), "8.8.8.8:443"); err != nil {
+		t.Errorf("Check of a public address: %v", err)
+	}
+}
+
+func TestDialContextRejects(t *testing.T) {
+	policy, err := Parse([]string{"accept *:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused in the Control hook, before any packet is sent
+	for _, addr := range []string{"127.0.0.1:1", "[::1]:1", "[fe80::1%lo]:1"} {
+		conn, err := policy.DialContext(context.Background(), "tcp", addr)
+		if conn != nil {
+			conn.Close()
+		}
+		if !errors.Is(err, ErrRejected) {
+			t.Errorf("DialContext(%q) = %v, want ErrRejected", addr, err)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"marshmello/pkg/encryption"
+)
+
+/*
+Cells are the fixed-size units exchanged on /cell, so every hop sees the same amount of traffic
+whatever its position in the circuit and whatever the message is. A message is split in as many
+cells as needed and all the cells of a message travel in one request (or one response).
+
+Cell on the wire (CELL_SIZE bytes):
+
+	[0:32]   session token of the receiving relay, raw bytes
+	[32:]    layer: nonce (12) | GCM tag (16) | ciphertext
+
+Plaintext of a layer:
+
+	[0]      command: CELL_RELAY (pass the inner layer on), CELL_DATA (a fragment of the message)
+	         or CELL_DESTROY (pass the inner layer on, then delete the session)
+	[1]      flags: CELL_FLAG_LAST on the last fragment, or on the destroy cell of the last relay
+	[2:4]    payload length
+	[4:6]    status code of the response (backward cells)
+	[6:14]   sequence number of the message for this relay (forward cells)
+	[14:46]  session token of the next relay (relay cells)
+	[46:]    payload, or the next relay's layer for relay cells
+
+Forward cells are sealed with the forward key of each hop and backward cells with its backward key.
+Every cell of a message carries the same sequence number in the layer of a relay, taken from the
+numbers of its session like the sequence number of a request, so a relay refuses replayed cells.
+
+Every layer authenticates the AssociatedData of the relay's session, its direction and the "cell" message
+type, so a layer doesn't open for another session or in the other direction. A backward layer is bound to
+the sequence number of the message it answers. A forward layer is bound to 0 instead, the relay only
+learns the sequence number from the header it opens, which the tag covers anyway.
+
+Forward, a relay that peels a relay cell drops its header and layer overhead and appends as many
+bytes of filler derived from its key, so the cell keeps its size. The client computes that filler
+in advance (as in Sphinx) so that the tag of every inner layer still verifies.
+
+Backward, each relay encrypts all but the last LAYER_OVERHEAD bytes of the cell it got. The relay
+answering keeps the end of its plaintext zeroed for CELL_MAX_HOPS hops, which lets the client
+rebuild the dropped bytes and verify every layer.
+*/
+
+const (
+	CELL_SIZE              = 1024
+	CELL_SESSION_SIZE      = 32
+	CELL_BODY_SIZE         = CELL_SIZE - CELL_SESSION_SIZE
+	CELL_HEADER_SIZE       = 46
+	CELL_PLAINTEXT_SIZE    = CELL_BODY_SIZE - encryption.LAYER_OVERHEAD
+	CELL_HOP_OVERHEAD      = encryption.LAYER_OVERHEAD + CELL_HEADER_SIZE
+	CELL_MAX_HOPS          = 8
+	CELL_BACKWARD_RESERVED = (CELL_MAX_HOPS - 1) * encryption.LAYER_OVERHEAD
+
+	// Payload carried by one cell, sized for the longest circuit so the cell count doesn't tell the circuit length
+	CELL_PAYLOAD_SIZE          = CELL_PLAINTEXT_SIZE - CELL_HEADER_SIZE - (CELL_MAX_HOPS-1)*CELL_HOP_OVERHEAD
+	CELL_BACKWARD_PAYLOAD_SIZE = CELL_PLAINTEXT_SIZE - CELL_HEADER_SIZE - CELL_BACKWARD_RESERVED
+
+	CELL_RELAY   = 1
+	CELL_DATA    = 2
+	CELL_DESTROY = 3
+
+	CELL_FLAG_LAST = 1
+)
+
+type CellHeader struct {
+	Command byte
+	Flags   byte
+	Length  int
+	Status  int
+	Seq     uint64 // sequence number of the message for the relay
+	Session string // hex token of the next relay
+}
+
+type Cell struct {
+	Session string // hex token of the receiving relay
+	Body    []byte // the layer, CELL_BODY_SIZE bytes
+}
+
+// ParseCells splits a request or response body into cells
+func ParseCells(data []byte) ([]Cell, error) {
+	if len(data) == 0 || len(data)%CELL_SIZE != 0 {
+		return nil, errors.New("body is not a whole number of cells")
+	}
+
+	cells := make([]Cell, 0, len(data)/CELL_SIZE)
+	for i := 0; i < len(data); i += CELL_SIZE {
+		cells = append(cells, Cell{
+			Session: hex.EncodeToString(data[i : i+CELL_SESSION_SIZE]),
+			Body:    data[i+CELL_SESSION_SIZE : i+CELL_SIZE],
+		})
+	}
+
+	return cells, nil
+}
+
+// MarshalCells joins cells into a request or response body
+func MarshalCells(cells []Cell) ([]byte, error) {
+	data := make([]byte, 0, len(cells)*CELL_SIZE)
+
+	for _, cell := range cells {
+		session, err := decodeCellSession(cell.Session)
+		if err != nil {
+			return nil, err
+		}
+		if len(cell.Body) != CELL_BODY_SIZE {
+			return nil, errors.New("cell body has the wrong size")
+		}
+
+		data = append(data, session...)
+		data = append(data, cell.Body...)
+	}
+
+	return data, nil
+}
+
+// cellAD is the additional data of the layer of the relay of session
+func cellAD(session string, direction byte, seq uint64) []byte {
+	return AssociatedData(session, direction, "cell", seq)
+}
+
+// PeelCell removes the relay's layer from a forward cell.
+// For a relay or destroy cell it returns the body to send to the next relay, for a data cell the payload fragment.
+func PeelCell(aesEncryptor encryption.SessionCipher, cell Cell) (CellHeader, []byte, error) {
+	plaintext, err := aesEncryptor.OpenLayer(cell.Body, cellAD(cell.Session, DIRECTION_FORWARD, 0))
+	if err != nil {
+		return CellHeader{}, nil, err
+	}
+
+	header, err := decodeCellHeader(plaintext)
+	if err != nil {
+		return CellHeader{}, nil, err
+	}
+
+	switch header.Command {
+	case CELL_RELAY, CELL_DESTROY:
+		filler, err := aesEncryptor.Filler(cell.Body[:encryption.GCM_NONCE_SIZE], CELL_HOP_OVERHEAD)
+		if err != nil {
+			return CellHeader{}, nil, err
+		}
+		next := append(plaintext[CELL_HEADER_SIZE:], filler...)
+		return header, next, nil
+	case CELL_DATA:
+		return header, plaintext[CELL_HEADER_SIZE : CELL_HEADER_SIZE+header.Length], nil
+	}
+
+	return CellHeader{}, nil, errors.New("unknown cell command")
+}
+
+// WrapBackwardCell adds the layer of the relay of session to a cell answering the message seq
+func WrapBackwardCell(aesEncryptor encryption.SessionCipher, session string, seq uint64, cell Cell) (Cell, error) {
+	nonce, err := encryption.NewNonce()
+	if err != nil {
+		return Cell{}, err
+	}
+
+	body, err := aesEncryptor.SealLayer(nonce, cell.Body[:CELL_PLAINTEXT_SIZE], cellAD(session, DIRECTION_BACKWARD, seq))
+	if err != nil {
+		return Cell{}, err
+	}
+
+	return Cell{Session: cell.Session, Body: body}, nil
+}
+
+// CreateBackwardCells splits the answer to the message seq into the cells the answering relay sends back
+func CreateBackwardCells(aesEncryptor encryption.SessionCipher, session string, seq uint64, status int, payload []byte) ([]Cell, error) {
+	var cells []Cell
+
+	fragments := fragment(payload, CELL_BACKWARD_PAYLOAD_SIZE)
+	for i, frag := range fragments {
+		header := CellHeader{Command: CELL_DATA, Length: len(frag), Status: status}
+		if i == len(fragments)-1 {
+			header.Flags = CELL_FLAG_LAST
+		}
+
+		// The padding after the payload, including the reserved end, stays zeroed
+		plaintext := make([]byte, CELL_PLAINTEXT_SIZE)
+		if err := encodeCellHeader(plaintext, header); err != nil {
+			return nil, err
+		}
+		copy(plaintext[CELL_HEADER_SIZE:], frag)
+
+		nonce, err := encryption.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := aesEncryptor.SealLayer(nonce, plaintext, cellAD(session, DIRECTION_BACKWARD, seq))
+		if err != nil {
+			return nil, err
+		}
+
+		cells = append(cells, Cell{Session: session, Body: body})
+	}
+
+	return cells, nil
+}
+
+// CreateForwardCells splits a message into cells for the last of the hops, each hop given by its key, session
+// and the sequence number of the message for it
+func CreateForwardCells(hops []encryption.SessionCipher, sessions []string, seqs []uint64, payload []byte) ([]Cell, error) {
+	if len(hops) == 0 || len(hops) > CELL_MAX_HOPS || len(hops) != len(sessions) || len(hops) != len(seqs) {
+		return nil, fmt.Errorf("cells need between 1 and %d hops", CELL_MAX_HOPS)
+	}
+
+	var cells []Cell
+
+	fragments := fragment(payload, CELL_PAYLOAD_SIZE)
+	for i, frag := range fragments {
+		header := CellHeader{Command: CELL_DATA, Length: len(frag)}
+		if i == len(fragments)-1 {
+			header.Flags = CELL_FLAG_LAST
+		}
+
+		body, err := createForwardLayers(hops, sessions, seqs, header, frag, CELL_RELAY)
+		if err != nil {
+			return nil, err
+		}
+
+		cells = append(cells, Cell{Session: sessions[0], Body: body})
+	}
+
+	return cells, nil
+}
+
+// CreateDestroyCell makes the cell that tears the circuit down, every hop deletes its session and passes it on
+func CreateDestroyCell(hops []encryption.SessionCipher, sessions []string, seqs []uint64) (Cell, error) {
+	if len(hops) == 0 || len(hops) > CELL_MAX_HOPS || len(hops) != len(sessions) || len(hops) != len(seqs) {
+		return Cell{}, fmt.Errorf("cells need between 1 and %d hops", CELL_MAX_HOPS)
+	}
+
+	body, err := createForwardLayers(hops, sessions, seqs, CellHeader{Command: CELL_DESTROY, Flags: CELL_FLAG_LAST}, nil, CELL_DESTROY)
+	if err != nil {
+		return Cell{}, err
+	}
+
+	return Cell{Session: sessions[0], Body: body}, nil
+}
+
+// createForwardLayers builds the onion of one forward cell, innermost layer first.
+// header is the innermost layer's, every outer layer passes the next one on with command.
+func createForwardLayers(hops []encryption.SessionCipher, sessions []string, seqs []uint64, header CellHeader, frag []byte, command byte) ([]byte, error) {
+	nonces := make([][]byte, len(hops))
+	for i := range nonces {
+		nonce, err := encryption.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+		nonces[i] = nonce
+	}
+
+	// junk is what the body of each hop ends with once the previous hops peeled their layers
+	junk := []byte{}
+	for i := 0; i < len(hops)-1; i++ {
+		stream, err := hops[i].KeyStream(nonces[i], CELL_PLAINTEXT_SIZE-len(junk), len(junk))
+		if err != nil {
+			return nil, err
+		}
+		filler, err := hops[i].Filler(nonces[i], CELL_HOP_OVERHEAD)
+		if err != nil {
+			return nil, err
+		}
+		junk = append(xorBytes(junk, stream), filler...)
+	}
+
+	// The last hop's plaintext ends with whatever encrypts to the junk
+	last := len(hops) - 1
+	header.Seq = seqs[last]
+	plaintext := make([]byte, CELL_PLAINTEXT_SIZE)
+	if err := encodeCellHeader(plaintext, header); err != nil {
+		return nil, err
+	}
+	copy(plaintext[CELL_HEADER_SIZE:], frag)
+
+	stream, err := hops[last].KeyStream(nonces[last], CELL_PLAINTEXT_SIZE-len(junk), len(junk))
+	if err != nil {
+		return nil, err
+	}
+	copy(plaintext[CELL_PLAINTEXT_SIZE-len(junk):], xorBytes(junk, stream))
+
+	body, err := hops[last].SealLayer(nonces[last], plaintext, cellAD(sessions[last], DIRECTION_FORWARD, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	// Every previous hop relays the layer of the next one
+	for i := last - 1; i >= 0; i-- {
+		plaintext := make([]byte, CELL_PLAINTEXT_SIZE)
+		if err := encodeCellHeader(plaintext, CellHeader{Command: command, Seq: seqs[i], Session: sessions[i+1]}); err != nil {
+			return nil, err
+		}
+		copy(plaintext[CELL_HEADER_SIZE:], body[:CELL_BODY_SIZE-CELL_HOP_OVERHEAD])
+
+		body, err = hops[i].SealLayer(nonces[i], plaintext, cellAD(sessions[i], DIRECTION_FORWARD, 0))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+// OpenBackwardCells removes every layer of the cells answered through the hops and joins the fragments,
+// each hop given by its key, session and the sequence number of the message it answers
+func OpenBackwardCells(hops []encryption.SessionCipher, sessions []string, seqs []uint64, cells []Cell) (int, []byte, error) {
+	if len(hops) != len(sessions) || len(hops) != len(seqs) {
+		return 0, nil, errors.New("every hop needs a session and a sequence number")
+	}
+
+	ads := make([][]byte, len(hops))
+	for i := range hops {
+		ads[i] = cellAD(sessions[i], DIRECTION_BACKWARD, seqs[i])
+	}
+
+	var payload []byte
+	status := 0
+
+	for i, cell := range cells {
+		header, frag, err := openBackwardCell(hops, ads, cell.Body)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		payload = append(payload, frag...)
+		status = header.Status
+
+		if header.Flags&CELL_FLAG_LAST != 0 {
+			if i != len(cells)-1 {
+				return 0, nil, errors.New("cells after the last fragment")
+			}
+			return status, payload, nil
+		}
+	}
+
+	return 0, nil, errors.New("response has no last fragment")
+}
+
+// openBackwardCell finds which hop answered the cell and verifies every layer up to it
+func openBackwardCell(hops []encryption.SessionCipher, ads [][]byte, body []byte) (CellHeader, []byte, error) {
+	for origin := range hops {
+		plaintext, err := openBackwardLayers(hops[:origin+1], ads[:origin+1], body)
+		if err != nil {
+			continue
+		}
+
+		// The answering hop zeroes everything after the payload, a layer that only wraps another one doesn't look like that
+		header, err := decodeCellHeader(plaintext)
+		if err != nil || header.Command != CELL_DATA || !allZero(plaintext[CELL_HEADER_SIZE+header.Length:]) {
+			continue
+		}
+
+		return header, plaintext[CELL_HEADER_SIZE : CELL_HEADER_SIZE+header.Length], nil
+	}
+
+	return CellHeader{}, nil, errors.New("error decrypting response cell")
+}
+
+// openBackwardLayers opens a backward cell assuming the last of the hops answered it, ads are the additional data of the layers
+func openBackwardLayers(hops []encryption.SessionCipher, ads [][]byte, body []byte) ([]byte, error) {
+	// Peel without verifying to learn every layer's nonce and tag, each layer misses its last bytes
+	layers := [][]byte{body}
+	for i := 0; i < len(hops)-1; i++ {
+		layer := layers[i]
+		stream, err := hops[i].KeyStream(layer[:encryption.GCM_NONCE_SIZE], 0, len(layer)-encryption.LAYER_OVERHEAD)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, xorBytes(layer[encryption.LAYER_OVERHEAD:], stream))
+	}
+
+	// The answering hop's plaintext ends with zeros, so its missing ciphertext is plain keystream
+	last := len(hops) - 1
+	known := len(layers[last]) - encryption.LAYER_OVERHEAD
+	stream, err := hops[last].KeyStream(layers[last][:encryption.GCM_NONCE_SIZE], known, CELL_PLAINTEXT_SIZE-known)
+	if err != nil {
+		return nil, err
+	}
+	layer := append(append([]byte{}, layers[last]...), stream...)
+
+	plaintext, err := hops[last].OpenLayer(layer, ads[last])
+	if err != nil {
+		return nil, err
+	}
+	answer := plaintext
+
+	// Rebuild and verify every outer layer from the plaintext it wraps
+	for i := last - 1; i >= 0; i-- {
+		inner := layer[:CELL_PLAINTEXT_SIZE]
+		nonce := layers[i][:encryption.GCM_NONCE_SIZE]
+		tag := layers[i][encryption.GCM_NONCE_SIZE:encryption.LAYER_OVERHEAD]
+
+		stream, err := hops[i].KeyStream(nonce, 0, CELL_PLAINTEXT_SIZE)
+		if err != nil {
+			return nil, err
+		}
+
+		layer = append(append(append([]byte{}, nonce...), tag...), xorBytes(inner, stream)...)
+		if _, err := hops[i].OpenLayer(layer, ads[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return answer, nil
+}
+
+// fragment splits the payload in pieces of at most size bytes, an empty payload still makes one piece
+func fragment(payload []byte, size int) [][]byte {
+	fragments := [][]byte{}
+	for len(payload) > size {
+		fragments = append(fragments, payload[:size])
+		payload = payload[size:]
+	}
+	return append(fragments, payload)
+}
+
+func encodeCellHeader(plaintext []byte, header CellHeader) error {
+	plaintext[0] = header.Command
+	plaintext[1] = header.Flags
+	binary.BigEndian.PutUint16(plaintext[2:4], uint16(header.Length))
+	binary.BigEndian.PutUint16(plaintext[4:6], uint16(header.Status))
+	binary.BigEndian.PutUint64(plaintext[6:14], header.Seq)
+
+	if header.Session != "" {
+		session, err := decodeCellSession(header.Session)
+		if err != nil {
+			return err
+		}
+		copy(plaintext[14:CELL_HEADER_SIZE], session)
+	}
+
+	return nil
+}
+
+func decodeCellHeader(plaintext []byte) (CellHeader, error) {
+	header := CellHeader{
+		Command: plaintext[0],
+		Flags:   plaintext[1],
+		Length:  int(binary.BigEndian.Uint16(plaintext[2:4])),
+		Status:  int(binary.BigEndian.Uint16(plaintext[4:6])),
+		Seq:     binary.BigEndian.Uint64(plaintext[6:14]),
+		Session: hex.EncodeToString(plaintext[14:CELL_HEADER_SIZE]),
+	}
+
+	if header.Length > len(plaintext)-CELL_HEADER_SIZE {
+		return CellHeader{}, errors.New("cell payload length out of range")
+	}
+
+	return header, nil
+}
+
+func decodeCellSession(session string) ([]byte, error) {
+	raw, err := hex.DecodeString(session)
+	if err != nil || len(raw) != CELL_SESSION_SIZE {
+		return nil, errors.New("session token can't be carried in a cell")
+	}
+	return raw, nil
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"marshmello/pkg/encryption"
+	"testing"
+)
+
+// testCircuit is a circuit of hops with the given suites, their sessions and the sequence numbers of a message
+func testCircuit(t *testing.T, suites ...int) ([]encryption.SessionCipher, []string, []uint64) {
+	t.Helper()
+
+	var hops []encryption.SessionCipher
+	var sessions []string
+	var seqs []uint64
+	for i, suite := range suites {
+		size, err := encryption.SuiteKeySize(suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := encryption.NewKey(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := encryption.NewSessionCipher(suite, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session := make([]byte, CELL_SESSION_SIZE)
+		if _, err := rand.Read(session); err != nil {
+			t.Fatal(err)
+		}
+
+		hops = append(hops, c)
+		sessions = append(sessions, hex.EncodeToString(session))
+		seqs = append(seqs, uint64(10*i+3))
+	}
+	return hops, sessions, seqs
+}
+
+var testCircuits = map[string][]int{
+	"one hop":         {encryption.SUITE_AES_128_GCM},
+	"ChaCha20":        {encryption.SUITE_CHACHA20_POLY1305, encryption.SUITE_CHACHA20_POLY1305, encryption.SUITE_CHACHA20_POLY1305},
+	"mixed suites":    {encryption.SUITE_AES_128_GCM, encryption.SUITE_CHACHA20_POLY1305, encryption.SUITE_AES_256_GCM},
+	"longest circuit": {encryption.SUITE_CHACHA20_POLY1305, encryption.SUITE_AES_128_GCM, encryption.SUITE_AES_256_GCM, encryption.SUITE_CHACHA20_POLY1305, encryption.SUITE_AES_128_GCM, encryption.SUITE_CHACHA20_POLY1305, encryption.SUITE_AES_256_GCM, encryption.SUITE_CHACHA20_POLY1305},
+}
+
+func testPayload(size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+// relayForward passes a forward cell through every hop like the relays do, and returns the header and payload of the last one
+func relayForward(t *testing.T, hops []encryption.SessionCipher, sessions []string, seqs []uint64, cell Cell) (CellHeader, []byte) {
+	t.Helper()
+
+	for i := range hops {
+		if cell.Session != sessions[i] {
+			t.Fatalf("hop %d got a cell for another session", i)
+		}
+
+		header, next, err := PeelCell(hops[i], cell)
+		if err != nil {
+			t.Fatalf("hop %d: %v", i, err)
+		}
+		if header.Seq != seqs[i] {
+			t.Fatalf("hop %d: sequence number %d, want %d", i, header.Seq, seqs[i])
+		}
+
+		if i == len(hops)-1 {
+			if header.Command != CELL_DATA {
+				t.Fatalf("last hop got command %d", header.Command)
+			}
+			return header, next
+		}
+
+		if header.Command != CELL_RELAY {
+			t.Fatalf("hop %d got command %d", i, header.Command)
+		}
+		if len(next) != CELL_BODY_SIZE {
+			t.Fatalf("hop %d passes on %d bytes, want %d", i, len(next), CELL_BODY_SIZE)
+		}
+		cell = Cell{Session: header.Session, Body: next}
+	}
+
+	return CellHeader{}, nil
+}
+
+func TestForwardCells(t *testing.T) {
+	for name, suites := range testCircuits {
+		t.Run(name, func(t *testing.T) {
+			hops, sessions, seqs := testCircuit(t, suites...)
+
+			for _, size := range []int{0, 1, CELL_PAYLOAD_SIZE, 2*CELL_PAYLOAD_SIZE + 5} {
+				payload := testPayload(size)
+				cells, err := CreateForwardCells(hops, sessions, seqs, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got []byte
+				for i, cell := range cells {
+					header, frag := relayForward(t, hops, sessions, seqs, cell)
+					if last := header.Flags&CELL_FLAG_LAST != 0; last != (i == len(cells)-1) {
+						t.Fatalf("cell %d of %d: last flag %v", i, len(cells), last)
+					}
+					got = append(got, frag...)
+				}
+
+				if !bytes.Equal(got, payload) {
+					t.Fatalf("%d bytes sent, %d different bytes received", size, len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestForwardCellRefused(t *testing.T) {
+	hops, sessions, seqs := testCircuit(t, encryption.SUITE_AES_128_GCM, encryption.SUITE_CHACHA20_POLY1305)
+	cells, err := CreateForwardCells(hops, sessions, seqs, []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell := cells[0]
+
+	// The layer is bound to the session it's addressed to
+	if _, _, err := PeelCell(hops[0], Cell{Session: sessions[1], Body: cell.Body}); err == nil {
+		t.Error("cell opened for another session")
+	}
+
+	tampered := append([]byte{}, cell.Body...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := PeelCell(hops[0], Cell{Session: cell.Session, Body: tampered}); err == nil {
+		t.Error("tampered cell opened")
+	}
+
+	// A backward layer doesn't open forward
+	backward, err := CreateBackwardCells(hops[0], sessions[0], 0, 200, []byte("answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := PeelCell(hops[0], backward[0]); err == nil {
+		t.Error("backward cell opened forward")
+	}
+}
+
+func TestDestroyCell(t *testing.T) {
+	hops, sessions, seqs := testCircuit(t, testCircuits["mixed suites"]...)
+	cell, err := CreateDestroyCell(hops, sessions, seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range hops {
+		header, next, err := PeelCell(hops[i], cell)
+		if err != nil {
+			t.Fatalf("hop %d: %v", i, err)
+		}
+		if header.Command != CELL_DESTROY || header.Seq != seqs[i] {
+			t.Fatalf("hop %d: command %d sequence number %d", i, header.Command, header.Seq)
+		}
+		if last := header.Flags&CELL_FLAG_LAST != 0; last != (i == len(hops)-1) {
+			t.Fatalf("hop %d: last flag %v", i, last)
+		}
+		cell = Cell{Session: header.Session, Body: next}
+	}
+}
+
+// answerBackward makes the cells the hop origin answers with, wrapped by every hop before it
+func answerBackward(t *testing.T, hops []encryption.SessionCipher, sessions []string, seqs []uint64, origin int, status int, payload []byte) []Cell {
+	t.Helper()
+
+	cells, err := CreateBackwardCells(hops[origin], sessions[origin], seqs[origin], status, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := origin - 1; i >= 0; i-- {
+		for j, cell := range cells {
+			cells[j], err = WrapBackwardCell(hops[i], sessions[i], seqs[i], cell)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cells[j].Body) != CELL_BODY_SIZE {
+				t.Fatalf("hop %d wraps a cell of %d bytes", i, len(cells[j].Body))
+			}
+		}
+	}
+	return cells
+}
+
+func TestBackwardCells(t *testing.T) {
+	for name, suites := range testCircuits {
+		t.Run(name, func(t *testing.T) {
+			hops, sessions, seqs := testCircuit(t, suites...)
+
+			// Any hop can answer, the last with the destination's answer and the others with an error
+			for origin := range hops {
+				for _, size := range []int{0, CELL_BACKWARD_PAYLOAD_SIZE, 2*CELL_BACKWARD_PAYLOAD_SIZE + 5} {
+					payload := testPayload(size)
+					cells := answerBackward(t, hops, sessions, seqs, origin, 201, payload)
+
+					status, got, err := OpenBackwardCells(hops, sessions, seqs, cells)
+					if err != nil {
+						t.Fatalf("answer of hop %d: %v", origin, err)
+					}
+					if status != 201 || !bytes.Equal(got, payload) {
+						t.Fatalf("answer of hop %d: status %d and %d bytes, want 201 and %d bytes", origin, status, len(got), size)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBackwardCellsRefused(t *testing.T) {
+	hops, sessions, seqs := testCircuit(t, testCircuits["mixed suites"]...)
+	cells := answerBackward(t, hops, sessions, seqs, len(hops)-1, 200, []byte("answer"))
+
+	for i := range hops {
+		otherSeqs := append([]uint64{}, seqs...)
+		otherSeqs[i]++
+		if _, _, err := OpenBackwardCells(hops, sessions, otherSeqs, cells); err == nil {
+			t.Errorf("answer opened with another sequence number for hop %d", i)
+		}
+
+		otherSessions := append([]string{}, sessions...)
+		otherSessions[i] = sessions[(i+1)%len(sessions)]
+		if _, _, err := OpenBackwardCells(hops, otherSessions, seqs, cells); err == nil {
+			t.Errorf("answer opened with another session for hop %d", i)
+		}
+	}
+
+	tampered := Cell{Session: cells[0].Session, Body: append([]byte{}, cells[0].Body...)}
+	tampered.Body[CELL_BODY_SIZE/2] ^= 1
+	if _, _, err := OpenBackwardCells(hops, sessions, seqs, []Cell{tampered}); err == nil {
+		t.Error("tampered answer opened")
+	}
+
+	if _, _, err := OpenBackwardCells(hops, sessions, seqs, nil); err == nil {
+		t.Error("answer without cells opened")
+	}
+}
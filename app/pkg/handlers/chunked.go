@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/exitpolicy"
+	"marshmello/pkg/logging"
+	"marshmello/pkg/metrics"
+	"marshmello/pkg/session"
+	"net/http"
+)
+
+/*
+A redirect sent with "chunked" is answered in a chunked stream (see encryption.ChunkWriter) sealed with the backward
+key of the session, so the relay sends the answer as it comes instead of holding it whole, and holds at most a chunk
+of it per circuit. The relay answers with the status of the answer it got, and the stream opens to a kind byte:
+
+	CHUNK_KIND_BODY    the answer as it is: the destination's, or a previous relay's that doesn't stream
+	CHUNK_KIND_NESTED  the chunked stream of the next relay, to open with its key
+	CHUNK_KIND_EXIT    length (4 bytes, big endian) | ExitResponse without its body | the destination's body
+
+Errors of the relay itself are answered as without "chunked".
+*/
+
+const CHUNKED_CONTENT_TYPE = "application/x-marshmello-chunked"
+
+const (
+	CHUNK_KIND_BODY   = 1
+	CHUNK_KIND_NESTED = 2
+	CHUNK_KIND_EXIT   = 3
+
+	MAX_EXIT_HEAD_SIZE = 1 << 20 // most bytes of the ExitResponse before the body of a CHUNK_KIND_EXIT stream
+)
+
+// streamRedirect is SerializeAndRedirect answering in a chunked stream
+func streamRedirect(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, token string, reqJson RedirectRequestJson, sessionData *session.SessionData, policy *exitpolicy.Policy, ad []byte) {
+	if IsStreamMsgType(reqJson.MsgType) {
+		statusCode, respBody := Streams.Handle(token, reqJson, policy)
+		writeChunked(w, aesEncryptor, ad, statusCode, CHUNK_KIND_BODY, nil, bytes.NewReader(respBody))
+		return
+	}
+
+	resp, statusCode, err := sendExitRequest(reqJson, sessionData, policy)
+	if err != nil {
+		exitError(w, aesEncryptor, err, statusCode, ad)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case reqJson.HTTP != nil:
+		// The destination's status travels in the head, the relays on the way only tell whether they got it
+		head, err := json.Marshal(ExitResponse{Status: resp.StatusCode, Headers: endToEndHeaders(resp.Header)})
+		if err != nil {
+			http.Error(w, "Failed to serialize response data", http.StatusInternalServerError)
+			return
+		}
+		head = append(binary.BigEndian.AppendUint32(nil, uint32(len(head))), head...)
+		writeChunked(w, aesEncryptor, ad, http.StatusOK, CHUNK_KIND_EXIT, head, resp.Body)
+	case reqJson.MsgType == "redirect" && resp.Header.Get("Content-Type") == CHUNKED_CONTENT_TYPE:
+		writeChunked(w, aesEncryptor, ad, resp.StatusCode, CHUNK_KIND_NESTED, nil, resp.Body)
+	default:
+		writeChunked(w, aesEncryptor, ad, resp.StatusCode, CHUNK_KIND_BODY, nil, resp.Body)
+	}
+}
+
+// writeChunked answers the kind, head and body in a chunked stream, the body is sealed as it's read.
+// When the body fails the stream is left without its last chunk, so it can't be taken for a shorter answer.
+func writeChunked(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, ad []byte, statusCode int, kind byte, head []byte, body io.Reader) {
+	w.Header().Set("Content-Type", CHUNKED_CONTENT_TYPE)
+	w.WriteHeader(statusCode)
+
+	cw, err := encryption.NewChunkWriter(aesEncryptor, flushWriter{w}, ad)
+	if err != nil {
+		return
+	}
+
+	if _, err := cw.Write(append([]byte{kind}, head...)); err != nil {
+		return
+	}
+
+	n, err := io.CopyBuffer(cw, body, make([]byte, encryption.CHUNK_SIZE))
+	metrics.Relayed(0, int(n))
+	if err != nil {
+		slog.Debug("Chunked answer cut", "bytes", n, logging.Sensitive("error", err))
+		return
+	}
+
+	cw.Close()
+}
+
+// flushWriter sends every chunk to the previous hop as soon as it's written, through the wrappers of the writer
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f flushWriter) Flush() {
+	http.NewResponseController(f.w).Flush()
+}
@@ -1,27 +1,67 @@
 package handlers
 
-type GetAesRequest struct {
-	RsaKey string
-}
+import "net/http"
 
-type AuthUserRequest struct {
-	Username string
-	Password string
-}
+// Handshake versions negotiated in /get-aes, older clients don't send a version and get RSA
+const (
+	HANDSHAKE_RSA    = 1
+	HANDSHAKE_X25519 = 2
+	HANDSHAKE_NTOR   = 3
+)
 
-type SendMessage struct {
-	Username string
-	Message  string
-	Token    string
-}
+// Directions of a message on a circuit, authenticated with it so an answer can't pass for a request
+const (
+	DIRECTION_FORWARD  = 1 // from the client towards the destination
+	DIRECTION_BACKWARD = 2 // the answer, back to the client
+)
+
+// Error answered, encrypted, when the exit policy of the relay rejects the redirect address
+const EXIT_POLICY_ERROR = "Address rejected by the exit policy."
+
+// Error answered, encrypted, when the message is exit traffic to a path the relay doesn't allow
+const EXIT_PATH_ERROR = "Path rejected by the exit paths of the relay."
+
+// Error answered, encrypted, with 409 for a message whose sequence number was already seen or is too old
+const REPLAY_ERROR = "Message replayed or out of the window."
 
-type GetMessages struct {
-	Token string
+// Error answered, encrypted, with 409 for a rekey to a key generation that doesn't follow the session's
+const KEY_GENERATION_ERROR = "Unexpected key generation."
+
+// Error answered with 429 when a remote address or a session goes over its rate limit
+const RATE_LIMIT_ERROR = "Too many requests."
+
+// Error answered with 413 when a request is over the body size cap, unencrypted since its session can't be read
+const BODY_TOO_LARGE_ERROR = "Request body too large."
+
+// Error answered, encrypted, with 504 when the next hop doesn't connect or start answering in time
+const HOP_TIMEOUT_ERROR = "Next hop timed out."
+
+// Error answered, encrypted, with 502 when an answer the relay encrypts whole is over MaxAnswerSize
+const ANSWER_TOO_LARGE_ERROR = "Answer too large."
+
+type GetAesRequest struct {
+	Version   int
+	Suites    []int // cipher suites the client supports, see encryption.SUITE_AES_128_GCM
+	RsaKey    string
+	X25519Key string
 }
 
 type GetAesResponse struct {
-	Session string
-	Aes_key string
+	Version     int
+	Suite       int // cipher suite picked for the session
+	Session     string
+	Aes_key     string
+	X25519Key   string
+	IdentityKey string
+	NtorKey     string
+	NtorKeySig  string
+	Auth        string
+}
+
+// ErrorResponse is an error the relay answers unencrypted, like the ones of the router and of links
+type ErrorResponse struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds to wait before trying again, on RATE_LIMIT_ERROR
 }
 
 type RegularResponse struct {
@@ -34,17 +74,47 @@ type EncryptedResponse struct {
 
 type SetRedirectRequest struct {
 	Session string
+	Seq     uint64 // sequence number on the session, authenticated with the address
 	Addr    string
 }
 
 type RedirectRequest struct {
 	Session string
+	Seq     uint64 // sequence number on the session, authenticated with the message
 	Message string //base64
+	Chunked bool   `json:",omitempty"` // answer in a chunked stream, see CHUNKED_CONTENT_TYPE
+}
+
+type RekeyRequest struct {
+	Session string
+	Seq     uint64 // sequence number on the session, authenticated with the message
+	Message string //base64, the key generation asked for
+}
+
+type DestroyRequest struct {
+	Session string
+	Seq     uint64 // sequence number on the session, authenticated with the message
+	Message string //base64, the DestroyRequest of the next relay (empty on the last one)
 }
 
 type RedirectRequestJson struct {
 	MsgType string
 	Data    string
+	HTTP    *ExitRequest `json:",omitempty"` // exit traffic sent as an HTTP request, MsgType is its path and Data its raw body
+}
+
+// ExitRequest is the HTTP request the exit relay makes for the client, it's answered with an ExitResponse
+type ExitRequest struct {
+	Method  string
+	Query   string      // raw query, without the '?'
+	Headers http.Header // hop-by-hop headers are dropped
+}
+
+// ExitResponse is the answer of the destination to an ExitRequest, the relays answer it with 200 whatever Status is
+type ExitResponse struct {
+	Status  int
+	Headers http.Header
+	Body    string // base64
 }
 
 type ReceiveRequest struct {
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"marshmello/pkg/exitpolicy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DEFAULT_MAX_ANSWER_SIZE is the most bytes of an answer the relay holds to encrypt it whole, chunked answers
+// are streamed instead and aren't capped
+const DEFAULT_MAX_ANSWER_SIZE = 4 << 20
+
+// MaxAnswerSize caps the answers the relay holds, it is set once at startup
+var MaxAnswerSize int64 = DEFAULT_MAX_ANSWER_SIZE
+
+var (
+	ErrHopTimeout     = errors.New("next hop timed out")
+	ErrAnswerTooLarge = errors.New("answer too large")
+)
+
+// Methods an ExitRequest can use, CONNECT and TRACE are never forwarded
+var EXIT_METHODS = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// Headers of a single connection, they are never passed on (RFC 9110 section 7.6.1), nor the ones the relay sets itself
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Host",
+	"Content-Length",
+}
+
+// exitClient is the client of the policy without following redirects, the client gets them like any other answer
+// so the relay never reaches a path the exit paths don't allow
+func exitClient(policy *exitpolicy.Policy) *http.Client {
+	client := *policy.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &client
+}
+
+// newExitRequest builds the request the relay sends to addr for the message, with body as its body.
+// Messages without an ExitRequest are POSTed as JSON, like every message before ExitRequest existed.
+func newExitRequest(reqJson RedirectRequestJson, addr string, body []byte) (*http.Request, error) {
+	target := url.URL{Scheme: "http", Host: addr, Path: "/" + reqJson.MsgType}
+
+	if reqJson.HTTP == nil {
+		req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.New("Invalid redirect request.")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+
+	// The next relay's API is only reached with its own messages
+	if Messages.Control(reqJson.MsgType) {
+		return nil, errors.New("Relay messages can't be sent as HTTP requests.")
+	}
+
+	if !EXIT_METHODS[reqJson.HTTP.Method] {
+		return nil, fmt.Errorf("Method %q not allowed.", reqJson.HTTP.Method)
+	}
+
+	if _, err := url.ParseQuery(reqJson.HTTP.Query); err != nil {
+		return nil, errors.New("Invalid query.")
+	}
+	target.RawQuery = reqJson.HTTP.Query
+
+	req, err := http.NewRequest(reqJson.HTTP.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.New("Invalid redirect request.")
+	}
+	req.Header = endToEndHeaders(reqJson.HTTP.Headers)
+
+	return req, nil
+}
+
+// endToEndHeaders returns a copy of header, with canonical names, without the hop-by-hop headers and the ones
+// Connection names
+func endToEndHeaders(header http.Header) http.Header {
+	clean := http.Header{}
+	for name, values := range header {
+		for _, value := range values {
+			clean.Add(name, value)
+		}
+	}
+
+	for _, value := range clean.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			clean.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		clean.Del(name)
+	}
+
+	return clean
+}
+
+// readAnswer reads an answer the relay holds whole, up to MaxAnswerSize
+func readAnswer(body io.Reader) ([]byte, error) {
+	answer, err := io.ReadAll(io.LimitReader(body, MaxAnswerSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(answer)) > MaxAnswerSize {
+		return nil, ErrAnswerTooLarge
+	}
+	return answer, nil
+}
+
+// hopError is the error of a request to the next hop that failed, with the status code the relay answers it with.
+// Not connecting or not getting an answer in time returns ErrHopTimeout.
+func hopError(err error, action string) (int, error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout, ErrHopTimeout
+	}
+	return http.StatusBadGateway, fmt.Errorf("Failed to %s: %s", action, err.Error())
+}
+
+// exitErrorMessage is the error answered to the client for an error of the exit
+func exitErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, exitpolicy.ErrRejected):
+		return EXIT_POLICY_ERROR
+	case errors.Is(err, ErrExitPathRejected):
+		return EXIT_PATH_ERROR
+	case errors.Is(err, ErrHopTimeout):
+		return HOP_TIMEOUT_ERROR
+	case errors.Is(err, ErrAnswerTooLarge):
+		return ANSWER_TOO_LARGE_ERROR
+	default:
+		return err.Error()
+	}
+}
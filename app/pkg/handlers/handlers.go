@@ -3,20 +3,32 @@ package handlers
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"marshmello/pkg/encryption"
+	"marshmello/pkg/exitpolicy"
+	"marshmello/pkg/link"
+	"marshmello/pkg/logging"
+	"marshmello/pkg/metrics"
+	"marshmello/pkg/ratelimit"
 	"marshmello/pkg/session"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Security Notes:
-// 1. All data is encrypted using AES encryption
+// 1. All data is encrypted with the cipher suite of the session, AES-GCM or ChaCha20-Poly1305
 // 2. Session management is required for all endpoints except /get-aes
-// 3. The AES key is exchanged securely using RSA encryption
-// 4. All binary data is encoded using base64 for safe transmission
+// 3. The AES key is exchanged using X25519 + HKDF, or RSA encryption for older clients
+// 4. HKDF derives a forward key (requests and forward cells) and a backward key (answers and backward cells) from it
+// 5. All binary data is encoded using base64 for safe transmission
+// 6. Clients ratchet both keys with /rekey on long-lived circuits, the old keys are deleted once the new ones are used
 
 /*
 General API Response format:
@@ -26,7 +38,12 @@ General API Response format:
 	}
 */
 
-func EncryptResponse(w http.ResponseWriter, aesEncryptor encryption.AESEncryptor, data interface{}, statusCode int) {
+func EncryptResponse(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, data interface{}, statusCode int) {
+	EncryptResponseWithAD(w, aesEncryptor, data, statusCode, nil)
+}
+
+// EncryptResponseWithAD is EncryptResponse authenticating ad with the answer, see AssociatedData
+func EncryptResponseWithAD(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, data interface{}, statusCode int, ad []byte) {
 	// Marshal the data into JSON if it's a struct
 	var responseJSON []byte
 	var err error
@@ -45,7 +62,7 @@ func EncryptResponse(w http.ResponseWriter, aesEncryptor encryption.AESEncryptor
 	}
 
 	// Encrypt the JSON response using AES
-	encryptedData, err := aesEncryptor.Encrypt(responseJSON)
+	encryptedData, err := aesEncryptor.EncryptWithAD(responseJSON, ad)
 	if err != nil {
 		http.Error(w, "Error encrypting response data.", http.StatusInternalServerError)
 		return
@@ -62,6 +79,84 @@ func EncryptResponse(w http.ResponseWriter, aesEncryptor encryption.AESEncryptor
 	})
 }
 
+// AssociatedData is the additional data authenticated with a message encrypted for a session: the session token,
+// the direction, the message type (the endpoint it is sent to) and the sequence number of the request.
+// A message only opens in the context it was encrypted for, it can't be pasted into another session, type or direction.
+func AssociatedData(session string, direction byte, msgType string, seq uint64) []byte {
+	ad := []byte{direction}
+	ad = binary.BigEndian.AppendUint16(ad, uint16(len(session)))
+	ad = append(ad, session...)
+	ad = binary.BigEndian.AppendUint16(ad, uint16(len(msgType)))
+	ad = append(ad, msgType...)
+	return binary.BigEndian.AppendUint64(ad, seq)
+}
+
+// sessionKeys decodes the keys of the session with its cipher suite: forward opens what the client sends,
+// backward encrypts the answers. Sessions created before suites were negotiated are SUITE_AES_128_GCM.
+func sessionKeys(sessionData *session.SessionData) (encryption.SessionCipher, encryption.SessionCipher, error) {
+	suite := sessionData.Suite
+	if suite == 0 {
+		suite = encryption.SUITE_AES_128_GCM
+	}
+
+	forwardKey, err := encryption.DecodeAESKey(sessionData.ForwardKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backwardKey, err := encryption.DecodeAESKey(sessionData.BackwardKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	forward, err := encryption.NewSessionCipher(suite, forwardKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backward, err := encryption.NewSessionCipher(suite, backwardKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return forward, backward, nil
+}
+
+// checkSequence accepts the sequence number of a decrypted message, answering the error (with respAD) when it can't
+func checkSequence(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, sm session.SessionStore, token string, seq uint64, respAD []byte) bool {
+	err := sm.CheckSequence(token, seq)
+	if errors.Is(err, session.ErrReplay) {
+		slog.Info("Replayed message refused", logging.Session(token), "seq", seq)
+		EncryptResponseWithAD(w, aesEncryptor, map[string]string{"error": REPLAY_ERROR}, http.StatusConflict, respAD)
+		return false
+	}
+	if err != nil {
+		EncryptResponseWithAD(w, aesEncryptor, map[string]string{"error": "Error checking sequence number."}, http.StatusInternalServerError, respAD)
+		return false
+	}
+
+	return true
+}
+
+// dropPreviousKeys deletes the keys the session had before its last rekey, once a message opened with the current
+// ones shows the client switched (see RekeyHandler)
+func dropPreviousKeys(sm session.SessionStore, token string, sessionData *session.SessionData) {
+	if sessionData.PreviousForwardKey == "" {
+		return
+	}
+
+	if err := sm.DropPreviousKeys(token, sessionData.Generation); err != nil {
+		slog.Warn("Error deleting previous keys", logging.Session(token), "error", err)
+	}
+}
+
+// SendRateLimited answers RATE_LIMIT_ERROR with 429, telling the client how long to wait before trying again
+func SendRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	SendResponse(w, ErrorResponse{Error: RATE_LIMIT_ERROR, RetryAfter: seconds}, http.StatusTooManyRequests)
+}
+
 // SendResponse writes a JSON response without encryption
 func SendResponse(w http.ResponseWriter, data interface{}, statusCode int) {
 	// Marshal the response data into JSON
@@ -77,31 +172,45 @@ func SendResponse(w http.ResponseWriter, data interface{}, statusCode int) {
 	w.Write(responseJSON)
 }
 
-// GetAesHandler generates and encrypts an AES key, returning it with a session token
+// GetAesHandler performs the key exchange for the requested handshake version, returning the key material with a session token
 //
 // Request Type: "/get-aes"
 // Request Payload (after decryption):
 //
 //	{
-//	    "rsa_key": string  // Client's RSA public key in PEM format
+//	    "version": int,      // 1 (RSA, default when missing), 2 (X25519) or 3 (ntor)
+//	    "suites": [int],     // Cipher suites the client supports, AES-128-GCM when missing (see encryption.SUITE_AES_128_GCM)
+//	    "rsa_key": string,   // Version 1: client's RSA public key, base64 DER encoded
+//	    "x25519_key": string // Versions 2 and 3: client's ephemeral X25519 public key, base64 encoded
 //	}
 //
 // Response (after decryption):
 //
 //	{
-//	    "session": string,  // Session token for subsequent requests
-//	    "aes_key": string   // AES key encrypted with client's RSA public key, base64 encoded
+//	    "version": int,       // Handshake version that was used
+//	    "suite": int,         // Cipher suite of the session, the first of the relay's preferred suites the client offered
+//	    "session": string,    // Session token for subsequent requests
+//	    "aes_key": string,    // Version 1: AES key encrypted with client's RSA public key, base64 encoded
+//	    "x25519_key": string, // Versions 2 and 3: relay's ephemeral X25519 public key, base64 encoded
+//	    "identity_key": string, // Version 3: relay's Ed25519 identity key, base64 encoded
+//	    "ntor_key": string,     // Version 3: relay's long-term X25519 ntor key, base64 encoded
+//	    "ntor_key_sig": string, // Version 3: signature of the ntor key by the identity key, base64 encoded
+//	    "auth": string          // Version 3: ntor AUTH value proving possession of the ntor key, base64 encoded
 //	}
 //
+// For version 2 both sides derive the AES key with HKDF over the X25519 shared secret.
+// For version 3 the relay also proves it holds the identity the client expects (see encryption.NtorServerHandshake).
+// The key agreed has the key size of the suite, the direction keys derived from it are bound to the suites offered
+// and the one picked (see encryption.SuiteTranscript), so a client whose offer was tampered with can't use the session.
+//
 // Error Responses:
-// - 400 Bad Request: "Error reading json data." or "Error reading RSA key."
-// - 500 Internal Server Error: "Error creating session key." or "Error encrypting AES key."
-func GetAesHandler(w http.ResponseWriter, r *http.Request, sm session.SessionManager) {
+// - 400 Bad Request: "Error reading json data.", "Error reading RSA key.", "Error reading X25519 key.", "Unsupported handshake version." or "Unsupported cipher suite."
+// - 500 Internal Server Error: "Error creating session key.", "Error encrypting AES key." or "Error deriving AES key."
+func GetAesHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore, identity *encryption.IdentityKey) {
 	var getAesRequest GetAesRequest
-	var rsaEncryptor encryption.RSAEncryptor
-	var aesEncryption encryption.AESEncryptor
-	var aesKey string
+	var aesKey []byte
 	var ans GetAesResponse
+	var statusCode int
 
 	// Decode the incoming JSON request
 	err := json.NewDecoder(r.Body).Decode(&getAesRequest)
@@ -110,39 +219,162 @@ func GetAesHandler(w http.ResponseWriter, r *http.Request, sm session.SessionMan
 		return
 	}
 
-	// Decode the RSA public key
-	rsaEncryptor.PublicKey, err = encryption.DecodeRSAPublicKey(getAesRequest.RsaKey)
+	if getAesRequest.Version == 0 {
+		getAesRequest.Version = HANDSHAKE_RSA
+	}
+
+	// The relay picks the suite it runs best among the ones the client offered
+	suite, err := encryption.SelectSuite(encryption.PreferredSuites(), getAesRequest.Suites)
 	if err != nil {
-		http.Error(w, "Error reading RSA key.", http.StatusBadRequest)
+		http.Error(w, "Unsupported cipher suite.", http.StatusBadRequest)
 		return
 	}
+	keySize, _ := encryption.SuiteKeySize(suite)
 
-	// Generate the AES key
-	aesEncryption.GenerateKey()
-	aesKey = encryption.EncodeAESKey(aesEncryption.Key)
+	switch getAesRequest.Version {
+	case HANDSHAKE_RSA:
+		aesKey, ans, statusCode, err = rsaHandshake(getAesRequest, keySize)
+	case HANDSHAKE_X25519:
+		aesKey, ans, statusCode, err = x25519Handshake(getAesRequest, keySize)
+	case HANDSHAKE_NTOR:
+		if identity == nil {
+			http.Error(w, "Unsupported handshake version.", http.StatusBadRequest)
+			return
+		}
+		aesKey, ans, statusCode, err = ntorHandshake(getAesRequest, identity, keySize)
+	default:
+		http.Error(w, "Unsupported handshake version.", http.StatusBadRequest)
+		return
+	}
 
-	// Create session and store the AES key
-	sessionToken, err := sm.CreateSession(aesKey)
 	if err != nil {
-		http.Error(w, "Error creating session key.", http.StatusInternalServerError)
+		http.Error(w, err.Error(), statusCode)
 		return
 	}
 
-	// Encrypt the AES key using the RSA public key
-	encryptedKey, err := rsaEncryptor.Encrypt(aesEncryption.Key)
+	// Each direction gets its own key, derived from the one agreed in the handshake and bound to the suites offered
+	forwardKey, backwardKey, err := encryption.DeriveDirectionKeys(aesKey, encryption.SuiteTranscript(suite, getAesRequest.Suites))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error deriving AES key.", http.StatusInternalServerError)
 		return
 	}
 
-	// Build the response with session token and encrypted AES key
+	// Create session and store the AES keys
+	sessionToken, err := sm.CreateSession(suite, encryption.EncodeAESKey(forwardKey), encryption.EncodeAESKey(backwardKey))
+	if err != nil {
+		slog.Error("Error creating session", "error", err)
+		http.Error(w, "Error creating session key.", http.StatusInternalServerError)
+		return
+	}
+
+	// Build the response with session token and the handshake material
+	ans.Version = getAesRequest.Version
+	ans.Suite = suite
 	ans.Session = sessionToken
-	ans.Aes_key = base64.StdEncoding.EncodeToString(encryptedKey)
+
+	metrics.Handshakes.WithLabelValues(handshakeName(getAesRequest.Version)).Inc()
+	metrics.CipherSuites.WithLabelValues(encryption.SuiteName(suite)).Inc()
 
 	// Send the response without encryption (AES not required here)
 	SendResponse(w, ans, http.StatusOK)
 }
 
+// handshakeName is the metrics label of a handshake version
+func handshakeName(version int) string {
+	switch version {
+	case HANDSHAKE_RSA:
+		return "rsa"
+	case HANDSHAKE_X25519:
+		return "x25519"
+	default:
+		return "ntor"
+	}
+}
+
+// rsaHandshake generates the key, of keySize bytes, and encrypts it to the client's RSA public key
+func rsaHandshake(req GetAesRequest, keySize int) ([]byte, GetAesResponse, int, error) {
+	var rsaEncryptor encryption.RSAEncryptor
+	var ans GetAesResponse
+	var err error
+
+	// Decode the RSA public key
+	rsaEncryptor.PublicKey, err = encryption.DecodeRSAPublicKey(req.RsaKey)
+	if err != nil {
+		return nil, ans, http.StatusBadRequest, errors.New("Error reading RSA key.")
+	}
+
+	// Generate the key
+	key, err := encryption.NewKey(keySize)
+	if err != nil {
+		return nil, ans, http.StatusInternalServerError, errors.New("Error creating session key.")
+	}
+
+	// Encrypt the key using the RSA public key
+	encryptedKey, err := rsaEncryptor.Encrypt(key)
+	if err != nil {
+		return nil, ans, http.StatusInternalServerError, errors.New("Error encrypting AES key.")
+	}
+
+	ans.Aes_key = base64.StdEncoding.EncodeToString(encryptedKey)
+
+	return key, ans, http.StatusOK, nil
+}
+
+// x25519Handshake answers with an ephemeral X25519 key and derives the key, of keySize bytes, from the shared secret
+func x25519Handshake(req GetAesRequest, keySize int) ([]byte, GetAesResponse, int, error) {
+	var relayKey encryption.X25519KeyPair
+	var ans GetAesResponse
+
+	// Decode the client's ephemeral public key
+	clientKey, err := encryption.DecodeX25519PublicKey(req.X25519Key)
+	if err != nil {
+		return nil, ans, http.StatusBadRequest, errors.New("Error reading X25519 key.")
+	}
+
+	err = relayKey.GenerateKey()
+	if err != nil {
+		return nil, ans, http.StatusInternalServerError, errors.New("Error creating session key.")
+	}
+
+	sharedSecret, err := relayKey.SharedSecret(clientKey)
+	if err != nil {
+		return nil, ans, http.StatusBadRequest, errors.New("Error reading X25519 key.")
+	}
+
+	aesKey, err := encryption.DeriveSessionKey(sharedSecret, clientKey, relayKey.PublicKey, keySize)
+	if err != nil {
+		return nil, ans, http.StatusInternalServerError, errors.New("Error deriving AES key.")
+	}
+
+	ans.X25519Key = encryption.EncodeX25519PublicKey(relayKey.PublicKey)
+
+	return aesKey, ans, http.StatusOK, nil
+}
+
+// ntorHandshake runs the relay side of the ntor handshake with the relay identity key, for a key of keySize bytes
+func ntorHandshake(req GetAesRequest, identity *encryption.IdentityKey, keySize int) ([]byte, GetAesResponse, int, error) {
+	var ans GetAesResponse
+
+	// Decode the client's ephemeral public key
+	clientKey, err := encryption.DecodeX25519PublicKey(req.X25519Key)
+	if err != nil {
+		return nil, ans, http.StatusBadRequest, errors.New("Error reading X25519 key.")
+	}
+
+	relayKey, auth, aesKey, err := encryption.NtorServerHandshake(identity, clientKey, keySize)
+	if err != nil {
+		return nil, ans, http.StatusBadRequest, errors.New("Error deriving AES key.")
+	}
+
+	ans.X25519Key = encryption.EncodeX25519PublicKey(relayKey)
+	ans.IdentityKey = encryption.EncodeIdentityPublicKey(identity.PublicKey())
+	ans.NtorKey = encryption.EncodeX25519PublicKey(identity.NtorKey.PublicKey())
+	ans.NtorKeySig = base64.StdEncoding.EncodeToString(identity.NtorKeySignature())
+	ans.Auth = base64.StdEncoding.EncodeToString(auth)
+
+	return aesKey, ans, http.StatusOK, nil
+}
+
 // SetRedirectHandler sets the redirect address in a session, using AES encryption for the address
 //
 // Request Type: "/set-redirect"
@@ -150,6 +382,7 @@ func GetAesHandler(w http.ResponseWriter, r *http.Request, sm session.SessionMan
 //
 //	{
 //	    "session": string,  // Session token from /get-aes
+//	    "seq": number,      // Sequence number on the session, starting at 1, authenticated with the address
 //	    "addr": string      // Base64 encoded, AES encrypted redirect address (format: "ip:port")
 //	}
 //
@@ -160,12 +393,14 @@ func GetAesHandler(w http.ResponseWriter, r *http.Request, sm session.SessionMan
 //	}
 //
 // Error Responses:
-// - 400 Bad Request: "Error reading JSON data." or "Error decrypting address."
+// - 400 Bad Request: "Error reading JSON data.", "Error decrypting address." or "Invalid redirect address."
 // - 401 Unauthorized: "Error retrieving session data."
+// - 403 Forbidden: EXIT_POLICY_ERROR, the exit policy rejects the address
+// - 409 Conflict: REPLAY_ERROR, the sequence number was already seen or is too old
 // - 500 Internal Server Error: "Error decoding AES key." or "Error decoding base64 address."
-func SetRedirectHandler(w http.ResponseWriter, r *http.Request, sm session.SessionManager) {
+func SetRedirectHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore, policy *exitpolicy.Policy) {
 	var setRedirectRequest SetRedirectRequest
-	var aesDecryption encryption.AESEncryptor
+	var forward, backward encryption.SessionCipher
 	var sessionData *session.SessionData
 	var err error
 
@@ -183,41 +418,63 @@ func SetRedirectHandler(w http.ResponseWriter, r *http.Request, sm session.Sessi
 		return
 	}
 
-	// Decode the AES key from the session
-	aesDecryption.Key, err = base64.StdEncoding.DecodeString(sessionData.AESKey)
+	// Decode the AES keys from the session
+	forward, backward, err = sessionKeys(sessionData)
 	if err != nil {
 		SendResponse(w, map[string]string{"error": "Error decoding AES key."}, http.StatusInternalServerError)
 		return
 	}
 
+	// The address only opens for this session, type and sequence number, the answer is bound to them the same way
+	reqAD := AssociatedData(setRedirectRequest.Session, DIRECTION_FORWARD, "set-redirect", setRedirectRequest.Seq)
+	respAD := AssociatedData(setRedirectRequest.Session, DIRECTION_BACKWARD, "set-redirect", setRedirectRequest.Seq)
+
 	// Decrypt the base64-encoded address using AES
-	b64decodedAddr, err := aesDecryption.DecryptBase64(setRedirectRequest.Addr)
+	b64decodedAddr, err := forward.DecryptBase64WithAD(setRedirectRequest.Addr, reqAD)
 	if err != nil {
-		EncryptResponse(w, aesDecryption, map[string]string{"error": "Error decrypting address."}, http.StatusBadRequest)
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decrypting address."}, http.StatusBadRequest, respAD)
+		return
+	}
+
+	if !checkSequence(w, backward, sm, setRedirectRequest.Session, setRedirectRequest.Seq, respAD) {
 		return
 	}
+	dropPreviousKeys(sm, setRedirectRequest.Session, sessionData)
 
 	// Decode the base64-encoded address string (ip:port)
 	addr, err := base64.StdEncoding.DecodeString(b64decodedAddr)
 	if err != nil {
-		EncryptResponse(w, aesDecryption, map[string]string{"error": "Error decoding base64 address."}, http.StatusInternalServerError)
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decoding base64 address."}, http.StatusInternalServerError, respAD)
+		return
+	}
+
+	// Refuse addresses the relay isn't allowed to reach, before anything is sent there
+	err = policy.Check(r.Context(), string(addr))
+	if errors.Is(err, exitpolicy.ErrRejected) {
+		slog.Info("Redirect address rejected by the exit policy", logging.Addr("addr", string(addr)))
+		EncryptResponseWithAD(w, backward, map[string]string{"error": EXIT_POLICY_ERROR}, http.StatusForbidden, respAD)
+		return
+	}
+	if err != nil {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Invalid redirect address."}, http.StatusBadRequest, respAD)
 		return
 	}
 
 	// Append the redirect address to the session
 	err = sm.UpdateAddress(setRedirectRequest.Session, string(addr))
 	if err != nil {
-		EncryptResponse(w, aesDecryption, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+		EncryptResponseWithAD(w, backward, map[string]string{"error": err.Error()}, http.StatusInternalServerError, respAD)
 		return
 	}
 
-	fmt.Println(string(addr))
+	slog.Debug("Redirect address set", logging.Session(setRedirectRequest.Session), logging.Addr("addr", string(addr)))
+	metrics.RedirectAddressesSet.Inc()
 
 	// Return an AES-encrypted "OK" response
 	successResponse := map[string]string{
 		"Message": "OK",
 	}
-	EncryptResponse(w, aesDecryption, successResponse, http.StatusOK)
+	EncryptResponseWithAD(w, backward, successResponse, http.StatusOK, respAD)
 }
 
 /*
@@ -225,21 +482,42 @@ GET /redirect
 
 	{
 	    "session": string,     // Session key for authentication
-	    "data": base64 string  // AES encrypted payload, encoded as base64
+	    "seq": number,         // Sequence number on the session
+	    "data": base64 string, // AES encrypted payload, encoded as base64
+	    "chunked": bool        // Optional, answer in a chunked stream (see streamRedirect)
 	}
 
+The session token, the direction, the message type ("redirect") and the sequence number are authenticated as the
+AES-GCM additional data (see AssociatedData), of the request and of its answer, so neither can be opened in
+another context.
+
+Every message of a session carries a higher sequence number than the ones before it, the relay accepts each
+number once and refuses the ones more than session.REPLAY_WINDOW below the highest seen (409, REPLAY_ERROR),
+so a captured request can't be sent again.
+
 The decrypted 'data' field contains:
 
 	{
 	    "type": string,        // Endpoint identifier (e.g., "/get-aes", "/set-redirect")
-	    "data": base64 string  // Endpoint-specific payload, left as-is
+	    "data": base64 string, // Endpoint-specific payload, left as-is
+	    "http": {              // Optional, exit traffic sent as an HTTP request (see ExitRequest)
+	        "method": string,
+	        "query": string,
+	        "headers": object
+	    }
 	}
+
+A message with "http" is sent with its method, query and headers, "data" as its raw body, and answered with 200 and
+the destination's status, headers and body (see ExitResponse). Without it the data is POSTed as JSON.
+
+The limits hit past the relay are answered encrypted: 504 HOP_TIMEOUT_ERROR when the next hop doesn't connect or
+start answering in time, 502 ANSWER_TOO_LARGE_ERROR when an answer that isn't chunked is over MaxAnswerSize.
 */
-func RedirectHandler(w http.ResponseWriter, r *http.Request, sm session.SessionManager) {
+func RedirectHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore, policy *exitpolicy.Policy) {
 	var redirectReq RedirectRequest
 	var reqJson RedirectRequestJson
 
-	var aesEncryptor encryption.AESEncryptor
+	var forward, backward encryption.SessionCipher
 	var err error
 	var sessionData *session.SessionData
 
@@ -257,8 +535,8 @@ func RedirectHandler(w http.ResponseWriter, r *http.Request, sm session.SessionM
 		return
 	}
 
-	// Decode the AES key from the session
-	aesEncryptor.Key, err = base64.StdEncoding.DecodeString(sessionData.AESKey)
+	// Decode the AES keys from the session
+	forward, backward, err = sessionKeys(sessionData)
 	if err != nil {
 		SendResponse(w, map[string]string{"error": "Error decoding AES key."}, http.StatusInternalServerError)
 		return
@@ -269,125 +547,691 @@ func RedirectHandler(w http.ResponseWriter, r *http.Request, sm session.SessionM
 		return
 	}
 
+	// The message only opens for this session, type and sequence number, the answer is bound to them the same way
+	reqAD := AssociatedData(redirectReq.Session, DIRECTION_FORWARD, "redirect", redirectReq.Seq)
+	respAD := AssociatedData(redirectReq.Session, DIRECTION_BACKWARD, "redirect", redirectReq.Seq)
+
 	// Decrypt the base64-encoded data using AES
-	b64encodedMsg, err := aesEncryptor.DecryptBase64(redirectReq.Message)
+	b64encodedMsg, err := forward.DecryptBase64WithAD(redirectReq.Message, reqAD)
 	if err != nil {
-		EncryptResponse(w, aesEncryptor, map[string]string{"error": "Error decrypting data."}, http.StatusBadRequest)
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decrypting data."}, http.StatusBadRequest, respAD)
 		return
 	}
 
+	// The same message, or an old one, is never forwarded twice
+	if !checkSequence(w, backward, sm, redirectReq.Session, redirectReq.Seq, respAD) {
+		return
+	}
+	dropPreviousKeys(sm, redirectReq.Session, sessionData)
+
 	reqJsonString, err := base64.StdEncoding.DecodeString(b64encodedMsg)
 	if err != nil {
-		EncryptResponse(w, aesEncryptor, map[string]string{"error": "Error decoding b64 data."}, http.StatusInternalServerError)
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decoding b64 data."}, http.StatusInternalServerError, respAD)
 		return
 	}
-	fmt.Println(reqJsonString)
+	slog.Debug("Redirect request", logging.Session(redirectReq.Session), logging.Payload("request", reqJsonString))
 	// Decode the incoming JSON data
 	err = json.Unmarshal(reqJsonString, &reqJson)
 	if err != nil {
-		EncryptResponse(w, aesEncryptor, map[string]string{"error": "Error reading JSON data."}, http.StatusBadRequest)
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error reading JSON data."}, http.StatusBadRequest, respAD)
 		return
 	}
 
-	SerializeAndRedirect(w, aesEncryptor, reqJson, sessionData)
+	if redirectReq.Chunked {
+		streamRedirect(w, backward, redirectReq.Session, reqJson, sessionData, policy, respAD)
+		return
+	}
+
+	SerializeAndRedirect(w, backward, redirectReq.Session, reqJson, sessionData, policy, respAD)
 }
 
-func SerializeAndRedirect(w http.ResponseWriter, aesEncryptor encryption.AESEncryptor, reqJson RedirectRequestJson, sessionData *session.SessionData) {
-	var requestData []byte
-	// Determine the target path
-	path := fmt.Sprintf("http://%s/%s", sessionData.Address, reqJson.MsgType)
+/*
+POST /rekey
+
+	{
+	    "session": string,        // Session key for authentication
+	    "seq": number,            // Sequence number on the session
+	    "message": base64 string  // AES encrypted, the key generation asked for, one above the session's
+	}
+
+Ratchets the keys of the session (see encryption.RatchetKeys) and deletes the current ones once the client used the
+new ones, so traffic sent before can't be opened with keys taken later. The request is authenticated like a redirect,
+with "rekey" as the message type, and the answer is still encrypted with the current backward key: the client
+switches once it reads it. A client that lost the answer asks again with the keys it had, for the same generation,
+and gets the same answer without the keys moving on (see answerRetriedRekey).
+The next relays are reached by sending "rekey" as the message type of a redirect, it needs no endpoint of its own.
 
-	// Decode and unmarshal the corresponding struct based on MsgType
-	requestStruct, err := CreateStructFromMsgType(reqJson.MsgType, reqJson.Data)
+Error Responses:
+- 400 Bad Request: "Error reading JSON data.", "Error decrypting data." or "Invalid key generation."
+- 401 Unauthorized: "Error retrieving session data."
+- 409 Conflict: REPLAY_ERROR or KEY_GENERATION_ERROR, the generation isn't the one after the session's
+- 500 Internal Server Error: "Error decoding AES key.", "Error deriving keys." or "Error storing keys."
+*/
+func RekeyHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore) {
+	var rekeyReq RekeyRequest
+	var forward, backward encryption.SessionCipher
+	var sessionData *session.SessionData
+	var err error
+
+	// Decode the incoming JSON request
+	err = json.NewDecoder(r.Body).Decode(&rekeyReq)
 	if err != nil {
-		http.Error(w, "Invalid MsgType or data format", http.StatusBadRequest)
+		SendResponse(w, map[string]string{"error": "Error reading JSON data."}, http.StatusBadRequest)
 		return
 	}
 
-	// Serialize request struct as JSON
-	requestData, err = json.Marshal(requestStruct)
+	// Retrieve session data, including the AES key
+	sessionData, err = sm.PullData(rekeyReq.Session)
 	if err != nil {
-		http.Error(w, "Failed to serialize request data", http.StatusInternalServerError)
+		SendResponse(w, map[string]string{"error": "Error retrieving session data."}, http.StatusUnauthorized)
 		return
 	}
 
-	// Send POST request
-	resp, err := http.Post(path, "application/json", bytes.NewBuffer(requestData))
+	// Decode the AES keys from the session
+	forward, backward, err = sessionKeys(sessionData)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send POST request: %s", err.Error()), http.StatusInternalServerError)
+		SendResponse(w, map[string]string{"error": "Error decoding AES key."}, http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read and print the response body
-	respBody, err := io.ReadAll(resp.Body)
+	reqAD := AssociatedData(rekeyReq.Session, DIRECTION_FORWARD, "rekey", rekeyReq.Seq)
+	respAD := AssociatedData(rekeyReq.Session, DIRECTION_BACKWARD, "rekey", rekeyReq.Seq)
+
+	// Only the client holding the key can rotate it
+	b64generation, err := forward.DecryptBase64WithAD(rekeyReq.Message, reqAD)
 	if err != nil {
-		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		if answerRetriedRekey(w, sm, rekeyReq, sessionData, reqAD, respAD) {
+			return
+		}
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decrypting data."}, http.StatusBadRequest, respAD)
 		return
 	}
-	fmt.Println("Redirection Response:", string(respBody))
 
-	// Encrypt and send the response back to the client
-	EncryptResponse(w, aesEncryptor, respBody, resp.StatusCode)
+	if !checkSequence(w, backward, sm, rekeyReq.Session, rekeyReq.Seq, respAD) {
+		return
+	}
+
+	generation, err := parseGeneration(b64generation)
+	if err != nil {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Invalid key generation."}, http.StatusBadRequest, respAD)
+		return
+	}
+
+	nextForward, nextBackward, err := encryption.RatchetKeys(forward.KeyBytes(), backward.KeyBytes())
+	if err != nil {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error deriving keys."}, http.StatusInternalServerError, respAD)
+		return
+	}
+
+	// The session only moves on from the generation the client had, a rekey that crossed another one is refused
+	err = sm.RotateKeys(rekeyReq.Session, generation, encryption.EncodeAESKey(nextForward), encryption.EncodeAESKey(nextBackward))
+	if errors.Is(err, session.ErrKeyGeneration) {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": KEY_GENERATION_ERROR}, http.StatusConflict, respAD)
+		return
+	}
+	if err != nil {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error storing keys."}, http.StatusInternalServerError, respAD)
+		return
+	}
+
+	slog.Debug("Session keys ratcheted", logging.Session(rekeyReq.Session), "generation", generation)
+	metrics.Rekeys.Inc()
+
+	EncryptResponseWithAD(w, backward, map[string]string{"Message": "OK"}, http.StatusOK, respAD)
 }
 
-func CreateStructFromMsgType(msgType string, encodedData string) (interface{}, error) {
-	// Decode Base64 data
-	fmt.Println(string(encodedData))
+// answerRetriedRekey answers a rekey that opens with the previous keys of the session: the client lost the answer
+// to the rekey that moved the session to its generation and asks for it again. It gets the same answer and the keys
+// aren't ratcheted twice. Nothing is answered, and false returned, when the message doesn't open with them.
+func answerRetriedRekey(w http.ResponseWriter, sm session.SessionStore, rekeyReq RekeyRequest, sessionData *session.SessionData, reqAD []byte, respAD []byte) bool {
+	if sessionData.PreviousForwardKey == "" {
+		return false
+	}
+
+	previous := *sessionData
+	previous.ForwardKey = sessionData.PreviousForwardKey
+	previous.BackwardKey = sessionData.PreviousBackwardKey
+
+	forward, backward, err := sessionKeys(&previous)
+	if err != nil {
+		return false
+	}
+
+	b64generation, err := forward.DecryptBase64WithAD(rekeyReq.Message, reqAD)
+	if err != nil {
+		return false
+	}
+
+	if !checkSequence(w, backward, sm, rekeyReq.Session, rekeyReq.Seq, respAD) {
+		return true
+	}
 
-	decodedData, err := base64.StdEncoding.DecodeString(encodedData)
+	generation, err := parseGeneration(b64generation)
 	if err != nil {
-		return nil, errors.New("failed to decode base64 data")
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Invalid key generation."}, http.StatusBadRequest, respAD)
+		return true
 	}
-	fmt.Println(string(decodedData))
-	// Unmarshal JSON into the corresponding struct based on MsgType
-	var result interface{}
-	switch msgType {
-	case "get-aes":
-		var request GetAesRequest
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+
+	// The previous keys only ever moved the session to the generation it has
+	if generation != sessionData.Generation {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": KEY_GENERATION_ERROR}, http.StatusConflict, respAD)
+		return true
+	}
+
+	slog.Debug("Rekey asked again", logging.Session(rekeyReq.Session), "generation", generation)
+	EncryptResponseWithAD(w, backward, map[string]string{"Message": "OK"}, http.StatusOK, respAD)
+	return true
+}
+
+// parseGeneration reads the key generation of a rekey message
+func parseGeneration(b64generation string) (uint64, error) {
+	message, err := base64.StdEncoding.DecodeString(b64generation)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(message), 10, 64)
+}
+
+/*
+POST /destroy
+
+	{
+	    "session": string,     // Session key for authentication
+	    "seq": number,         // Sequence number on the session
+	    "message": base64 string  // AES encrypted, the DestroyRequest for the next relay encoded as base64, empty on the last relay
+	}
+
+Deletes the session and passes the inner request on to the redirect address, so the whole circuit is torn down.
+The message and the answer are bound to the session, the "destroy" type and the sequence number like a redirect.
+*/
+func DestroyHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore, policy *exitpolicy.Policy) {
+	var destroyReq DestroyRequest
+	var forward, backward encryption.SessionCipher
+	var sessionData *session.SessionData
+	var err error
+
+	// Decode the incoming JSON request
+	err = json.NewDecoder(r.Body).Decode(&destroyReq)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": "Error reading JSON data."}, http.StatusBadRequest)
+		return
+	}
+
+	// Retrieve session data, including the AES key
+	sessionData, err = sm.PullData(destroyReq.Session)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": "Error retrieving session data."}, http.StatusUnauthorized)
+		return
+	}
+
+	// Decode the AES keys from the session
+	forward, backward, err = sessionKeys(sessionData)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": "Error decoding AES key."}, http.StatusInternalServerError)
+		return
+	}
+
+	reqAD := AssociatedData(destroyReq.Session, DIRECTION_FORWARD, "destroy", destroyReq.Seq)
+	respAD := AssociatedData(destroyReq.Session, DIRECTION_BACKWARD, "destroy", destroyReq.Seq)
+
+	// Only the client holding the key can tear the session down
+	b64encodedNext, err := forward.DecryptBase64WithAD(destroyReq.Message, reqAD)
+	if err != nil {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decrypting data."}, http.StatusBadRequest, respAD)
+		return
+	}
+
+	if !checkSequence(w, backward, sm, destroyReq.Session, destroyReq.Seq, respAD) {
+		return
+	}
+
+	err = sm.DeleteSession(destroyReq.Session)
+	if err != nil {
+		EncryptResponseWithAD(w, backward, map[string]string{"error": "Error deleting session."}, http.StatusInternalServerError, respAD)
+		return
+	}
+	Streams.CloseSession(destroyReq.Session)
+
+	// Pass the teardown on to the next relay
+	if b64encodedNext != "" && sessionData.Address != "" {
+		next, err := base64.StdEncoding.DecodeString(b64encodedNext)
+		if err != nil {
+			EncryptResponseWithAD(w, backward, map[string]string{"error": "Error decoding b64 data."}, http.StatusBadRequest, respAD)
+			return
+		}
+
+		resp, err := policy.Client().Post(fmt.Sprintf("http://%s/destroy", sessionData.Address), "application/json", bytes.NewBuffer(next))
+		if errors.Is(err, exitpolicy.ErrRejected) {
+			EncryptResponseWithAD(w, backward, map[string]string{"error": EXIT_POLICY_ERROR}, http.StatusForbidden, respAD)
+			return
+		}
+		if err != nil {
+			slog.Warn("Passing the teardown on failed", logging.Sensitive("error", err))
+			statusCode, err := hopError(err, "send POST request")
+			EncryptResponseWithAD(w, backward, map[string]string{"error": exitErrorMessage(err)}, statusCode, respAD)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			EncryptResponseWithAD(w, backward, map[string]string{"error": "Next relay failed to destroy its session."}, http.StatusBadGateway, respAD)
+			return
+		}
+	}
+
+	EncryptResponseWithAD(w, backward, map[string]string{"Message": "OK"}, http.StatusOK, respAD)
+}
+
+/*
+POST /cell
+
+The body is one or more fixed-size cells (see cell.go) for the same session, carrying one message.
+Relay cells are peeled and passed on to the next relay, over a link when it can open one, data cells
+are joined back into a RedirectRequestJson that is sent to the redirect address. The answer is a body
+of cells as well. Cells whose sequence number was already seen are answered REPLAY_ERROR (409) in cells.
+*/
+func CellHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore, links *link.Pool, policy *exitpolicy.Policy) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": "Error reading cells."}, http.StatusBadRequest)
+		return
+	}
+
+	cells, err := ParseCells(body)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	respCells, statusCode, err := ProcessCells(cells, sm, links, policy, nil)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": err.Error()}, statusCode)
+		return
+	}
+
+	writeCells(w, respCells)
+}
+
+/*
+GET /link
+
+Upgrades the connection to a link (see pkg/link), every request on it carries the cells of one message
+as the body of POST /cell does, on the circuit ID the other side gave to the session.
+
+sessions, when set, limits the messages of every session as the router does on the HTTP endpoints, a message
+over the limit is answered with RATE_LIMIT_ERROR.
+*/
+func LinkHandler(w http.ResponseWriter, r *http.Request, sm session.SessionStore, links *link.Pool, policy *exitpolicy.Policy, sessions *ratelimit.KeyedLimiter) {
+	if links == nil {
+		SendResponse(w, map[string]string{"error": "Links are not enabled."}, http.StatusNotFound)
+		return
+	}
+
+	links.Accept(w, r, func(l *link.Link, circID uint32, payload []byte) ([]byte, error) {
+		cells, err := ParseCells(payload)
+		if err != nil {
+			return nil, linkError(err.Error())
 		}
-		result = request
-	case "set-redirect":
-		var request SetRedirectRequest
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+
+		if sessions != nil && !sessions.Allow(cells[0].Session) {
+			metrics.Error("link", http.StatusTooManyRequests)
+			return nil, linkRateLimited(sessions.RetryAfter())
 		}
-		result = request
-	case "redirect":
-		var request RedirectRequest
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+
+		// A circuit ID carries a single circuit for the lifetime of the link
+		if !l.Bind(circID, cells[0].Session) {
+			return nil, linkError("Circuit ID already used by another circuit.")
 		}
-		result = request
-	case "auth/login":
-		var request AuthUserRequest
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+
+		// A destroyed circuit frees its ID
+		respCells, statusCode, err := ProcessCells(cells, sm, links, policy, func() { l.Unbind(circID) })
+		if err != nil {
+			metrics.Error("link", statusCode)
+			return nil, linkError(err.Error())
 		}
-		result = request
-	case "auth/register":
-		var request AuthUserRequest
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+
+		return MarshalCells(respCells)
+	})
+}
+
+// linkError formats an error the way the HTTP endpoints answer it
+func linkError(message string) error {
+	data, _ := json.Marshal(map[string]string{"error": message})
+	return errors.New(string(data))
+}
+
+// linkRateLimited is the RATE_LIMIT_ERROR of a link, the way SendRateLimited answers it
+func linkRateLimited(retryAfter time.Duration) error {
+	data, _ := json.Marshal(ErrorResponse{Error: RATE_LIMIT_ERROR, RetryAfter: int(retryAfter.Seconds())})
+	return errors.New(string(data))
+}
+
+// ProcessCells handles the cells of one message and returns the cells to answer.
+// When the cells can't be opened there is nothing to answer in cells, the error and its status are returned instead.
+// onDestroy, when set, is called once a destroy cell deleted the session.
+func ProcessCells(cells []Cell, sm session.SessionStore, links *link.Pool, policy *exitpolicy.Policy, onDestroy func()) ([]Cell, int, error) {
+	var forward, backward encryption.SessionCipher
+
+	token := cells[0].Session
+	for _, cell := range cells {
+		if cell.Session != token {
+			return nil, http.StatusBadRequest, errors.New("Cells of different sessions.")
 		}
-		result = request
-	case "messages/send":
-		var request SendMessage
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+	}
+
+	// Retrieve session data, including the AES key
+	sessionData, err := sm.PullData(token)
+	if err != nil {
+		return nil, http.StatusUnauthorized, errors.New("Error retrieving session data.")
+	}
+
+	// Decode the AES keys from the session
+	forward, backward, err = sessionKeys(sessionData)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Error decoding AES key.")
+	}
+
+	if sessionData.Address == "" {
+		return nil, http.StatusInternalServerError, errors.New("Addr no initialzied.")
+	}
+
+	// Peel every cell, they must all be relayed to the same session or all be data
+	var headers []CellHeader
+	var peeled [][]byte
+	for _, cell := range cells {
+		header, next, err := PeelCell(forward, cell)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Error decrypting cell.")
 		}
-		result = request
-	case "messages/fetch":
-		var request GetMessages
-		if err := json.Unmarshal(decodedData, &request); err != nil {
-			return nil, err
+		if len(headers) > 0 && (header.Command != headers[0].Command || header.Session != headers[0].Session || header.Seq != headers[0].Seq) {
+			return cellError(backward, token, headers[0].Seq, "Mixed cells in one message.", http.StatusBadRequest)
 		}
-		result = request
-	default:
-		return nil, errors.New("unknown MsgType")
+		headers = append(headers, header)
+		peeled = append(peeled, next)
+	}
+
+	// The cells of a message are accepted once, replayed ones are refused before they go any further
+	seq := headers[0].Seq
+	err = sm.CheckSequence(token, seq)
+	if errors.Is(err, session.ErrReplay) {
+		slog.Info("Replayed cells refused", logging.Session(token), "seq", seq)
+		return cellError(backward, token, seq, REPLAY_ERROR, http.StatusConflict)
+	}
+	if err != nil {
+		return cellError(backward, token, seq, "Error checking sequence number.", http.StatusInternalServerError)
+	}
+	dropPreviousKeys(sm, token, sessionData)
+
+	if headers[0].Command == CELL_RELAY {
+		return relayCells(backward, token, seq, headers[0].Session, peeled, sessionData.Address, links, policy)
+	}
+
+	if headers[0].Command == CELL_DESTROY {
+		return destroyCircuit(backward, token, headers[0], peeled, sessionData.Address, sm, links, policy, onDestroy)
+	}
+
+	// Join the fragments of the message
+	var message []byte
+	for i, frag := range peeled {
+		message = append(message, frag...)
+		if headers[i].Flags&CELL_FLAG_LAST != 0 && i != len(peeled)-1 {
+			return cellError(backward, token, seq, "Cells after the last fragment.", http.StatusBadRequest)
+		}
+	}
+	if headers[len(headers)-1].Flags&CELL_FLAG_LAST == 0 {
+		return cellError(backward, token, seq, "Message has no last fragment.", http.StatusBadRequest)
+	}
+
+	var reqJson RedirectRequestJson
+	err = json.Unmarshal(message, &reqJson)
+	if err != nil {
+		return cellError(backward, token, seq, "Error reading JSON data.", http.StatusBadRequest)
+	}
+
+	statusCode, respBody, err := answerExit(token, reqJson, sessionData, policy)
+	if err != nil {
+		return cellError(backward, token, seq, exitErrorMessage(err), statusCode)
+	}
+
+	return answerCells(backward, token, seq, respBody, statusCode)
+}
+
+// relayCells passes the peeled cells on to the next relay and adds this relay's layer to its answer
+func relayCells(aesEncryptor encryption.SessionCipher, token string, seq uint64, next string, bodies [][]byte, addr string, links *link.Pool, policy *exitpolicy.Policy) ([]Cell, int, error) {
+	var cells []Cell
+	for _, body := range bodies {
+		cells = append(cells, Cell{Session: next, Body: body})
+	}
+
+	data, err := MarshalCells(cells)
+	if err != nil {
+		return cellError(aesEncryptor, token, seq, err.Error(), http.StatusInternalServerError)
+	}
+
+	respBody, statusCode, err := sendCells(addr, next, data, links, policy)
+	if err != nil {
+		return cellError(aesEncryptor, token, seq, exitErrorMessage(err), statusCode)
+	}
+
+	respCells, err := ParseCells(respBody)
+	if err != nil {
+		return cellError(aesEncryptor, token, seq, "Failed to read response cells.", http.StatusBadGateway)
+	}
+	metrics.Relayed(len(data), len(respBody))
+
+	for i, cell := range respCells {
+		wrapped, err := WrapBackwardCell(aesEncryptor, token, seq, cell)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.New("Error encrypting cells.")
+		}
+		wrapped.Session = token
+		respCells[i] = wrapped
+	}
+
+	return respCells, http.StatusOK, nil
+}
+
+// destroyCircuit passes the destroy cell on to the next relay unless this is the last one, then deletes the session
+func destroyCircuit(aesEncryptor encryption.SessionCipher, token string, header CellHeader, bodies [][]byte, addr string, sm session.SessionStore, links *link.Pool, policy *exitpolicy.Policy, onDestroy func()) ([]Cell, int, error) {
+	// The session goes even if the rest of the circuit can't be reached, the client is done with it
+	defer func() {
+		sm.DeleteSession(token)
+		Streams.CloseSession(token)
+		if onDestroy != nil {
+			onDestroy()
+		}
+	}()
+
+	if header.Flags&CELL_FLAG_LAST != 0 {
+		return answerCells(aesEncryptor, token, header.Seq, []byte(`{"Message":"OK"}`), http.StatusOK)
+	}
+
+	respCells, statusCode, err := relayCells(aesEncryptor, token, header.Seq, header.Session, bodies, addr, links, policy)
+	if links != nil {
+		links.Forget(addr, header.Session)
+	}
+
+	return respCells, statusCode, err
+}
+
+// sendCells sends cells to the relay at addr over the link to it, or in a POST /cell when it has no link.
+// An error is returned with the status code the relay answers it with.
+func sendCells(addr string, session string, data []byte, links *link.Pool, policy *exitpolicy.Policy) ([]byte, int, error) {
+	if links != nil {
+		respBody, err := links.Send(addr, session, data)
+		if !errors.Is(err, link.ErrNoLink) {
+			if errors.Is(err, link.ErrTimeout) {
+				return nil, http.StatusGatewayTimeout, ErrHopTimeout
+			}
+			if err != nil {
+				return nil, http.StatusBadGateway, fmt.Errorf("Next relay error: %s", strings.TrimPrefix(err.Error(), "HTTP error: "))
+			}
+			return respBody, http.StatusOK, nil
+		}
+	}
+
+	resp, err := policy.Client().Post(fmt.Sprintf("http://%s/cell", addr), "application/octet-stream", bytes.NewBuffer(data))
+	if errors.Is(err, exitpolicy.ErrRejected) {
+		return nil, http.StatusForbidden, err
+	}
+	if err != nil {
+		slog.Warn("Sending cells failed", logging.Sensitive("error", err))
+		statusCode, err := hopError(err, "send cells")
+		return nil, statusCode, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := readAnswer(resp.Body)
+	if errors.Is(err, ErrAnswerTooLarge) {
+		return nil, http.StatusBadGateway, err
+	}
+	if err != nil {
+		return nil, http.StatusBadGateway, errors.New("Failed to read response cells.")
+	}
+
+	// A relay that couldn't even open its cells answers plain JSON
+	if resp.Header.Get("Content-Type") != "application/octet-stream" {
+		return nil, http.StatusBadGateway, fmt.Errorf("Next relay error: %s", string(respBody))
+	}
+
+	return respBody, http.StatusOK, nil
+}
+
+// answerCells splits the payload in backward cells answering the message seq
+func answerCells(aesEncryptor encryption.SessionCipher, token string, seq uint64, payload []byte, statusCode int) ([]Cell, int, error) {
+	cells, err := CreateBackwardCells(aesEncryptor, token, seq, statusCode, payload)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Error creating cells.")
+	}
+
+	return cells, http.StatusOK, nil
+}
+
+// cellError answers a JSON error in backward cells, so the client can tell which relay failed
+func cellError(aesEncryptor encryption.SessionCipher, token string, seq uint64, message string, statusCode int) ([]Cell, int, error) {
+	metrics.Error("cell", statusCode)
+
+	payload, err := json.Marshal(map[string]string{"error": message})
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Error encoding error.")
+	}
+
+	return answerCells(aesEncryptor, token, seq, payload, statusCode)
+}
+
+func writeCells(w http.ResponseWriter, cells []Cell) {
+	data, err := MarshalCells(cells)
+	if err != nil {
+		SendResponse(w, map[string]string{"error": "Error encoding cells."}, http.StatusInternalServerError)
+		return
+	}
+
+	// The status of the message travels inside the cells, the relay itself answered fine
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func SerializeAndRedirect(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, token string, reqJson RedirectRequestJson, sessionData *session.SessionData, policy *exitpolicy.Policy, ad []byte) {
+	statusCode, respBody, err := answerExit(token, reqJson, sessionData, policy)
+	if err != nil {
+		exitError(w, aesEncryptor, err, statusCode, ad)
+		return
+	}
+
+	// Encrypt and send the response back to the client
+	EncryptResponseWithAD(w, aesEncryptor, respBody, statusCode, ad)
+}
+
+// exitError answers an error of the exit encrypted, see exitErrorMessage
+func exitError(w http.ResponseWriter, aesEncryptor encryption.SessionCipher, err error, statusCode int, ad []byte) {
+	EncryptResponseWithAD(w, aesEncryptor, map[string]string{"error": exitErrorMessage(err)}, statusCode, ad)
+}
+
+// answerExit answers a message that reached the end of the circuit, stream messages are answered by this relay
+// and the others are forwarded to the session's redirect address
+func answerExit(token string, reqJson RedirectRequestJson, sessionData *session.SessionData, policy *exitpolicy.Policy) (int, []byte, error) {
+	if IsStreamMsgType(reqJson.MsgType) {
+		statusCode, respBody := Streams.Handle(token, reqJson, policy)
+		return statusCode, respBody, nil
+	}
+
+	return ForwardRequest(reqJson, sessionData, policy)
+}
+
+// ForwardRequest sends the request to the session's redirect address and returns the status code and body of the answer.
+// The policy is checked again on the address actually dialed, a rejected address returns exitpolicy.ErrRejected.
+// Exit traffic to a path the relay doesn't allow returns ErrExitPathRejected, see Registry.
+// A request sent as an ExitRequest is answered with 200 and the ExitResponse of the destination, whatever its status.
+func ForwardRequest(reqJson RedirectRequestJson, sessionData *session.SessionData, policy *exitpolicy.Policy) (int, []byte, error) {
+	resp, statusCode, err := sendExitRequest(reqJson, sessionData, policy)
+	if err != nil {
+		return statusCode, nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read and log the response body
+	respBody, err := readAnswer(resp.Body)
+	if errors.Is(err, ErrAnswerTooLarge) {
+		return http.StatusBadGateway, nil, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, errors.New("Failed to read response body")
+	}
+	slog.Debug("Redirection response", "status", resp.StatusCode, logging.Payload("body", respBody))
+	metrics.Relayed(0, len(respBody))
+
+	if reqJson.HTTP == nil {
+		return resp.StatusCode, respBody, nil
+	}
+
+	// The destination's status travels in the answer, the relays on the way only tell whether they got it
+	answer, err := json.Marshal(ExitResponse{
+		Status:  resp.StatusCode,
+		Headers: endToEndHeaders(resp.Header),
+		Body:    base64.StdEncoding.EncodeToString(respBody),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, nil, errors.New("Failed to serialize response data")
+	}
+
+	return http.StatusOK, answer, nil
+}
+
+// sendExitRequest sends the request to the session's redirect address and returns its answer before the body is read,
+// the caller closes it. An error is returned with the status code the relay answers it with, see ForwardRequest.
+func sendExitRequest(reqJson RedirectRequestJson, sessionData *session.SessionData, policy *exitpolicy.Policy) (*http.Response, int, error) {
+	// Relay-control types are checked, exit traffic is forwarded as sent when its path is allowed
+	requestData, err := Messages.Body(reqJson.MsgType, reqJson.Data)
+	if errors.Is(err, ErrExitPathRejected) {
+		return nil, http.StatusForbidden, err
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid MsgType or data format")
+	}
+
+	req, err := newExitRequest(reqJson, sessionData.Address, requestData)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	slog.Debug("Forwarding request", "type", reqJson.MsgType, "method", req.Method, logging.Addr("addr", sessionData.Address), logging.Payload("body", requestData))
+	msgType := metrics.MsgType(reqJson.MsgType)
+	metrics.Redirects.WithLabelValues(msgType).Inc()
+
+	start := time.Now()
+	resp, err := exitClient(policy).Do(req)
+	if errors.Is(err, exitpolicy.ErrRejected) {
+		return nil, http.StatusForbidden, err
+	}
+	if err != nil {
+		slog.Warn("Forwarding failed", logging.Sensitive("error", err))
+		statusCode, err := hopError(err, "send "+req.Method+" request")
+		return nil, statusCode, err
 	}
 
-	return result, nil
+	metrics.UpstreamLatency.WithLabelValues(msgType).Observe(time.Since(start).Seconds())
+	metrics.Relayed(len(requestData), 0)
+	return resp, resp.StatusCode, nil
 }
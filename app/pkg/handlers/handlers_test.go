@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"marshmello/pkg/encryption"
+	"marshmello/pkg/exitpolicy"
+	"marshmello/pkg/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *session.MemoryStore {
+	t.Helper()
+
+	ms := session.NewMemoryStore(time.Hour, time.Hour)
+	t.Cleanup(ms.Close)
+	return ms
+}
+
+func postJSON(t *testing.T, handler func(http.ResponseWriter, *http.Request), body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data)))
+	return w
+}
+
+// clientHandshake runs /get-aes with the X25519 handshake, offering suites, and returns the relay's answer
+// with the forward and backward ciphers the client derives from it
+func clientHandshake(t *testing.T, sm session.SessionStore, suites []int) (GetAesResponse, encryption.SessionCipher, encryption.SessionCipher) {
+	t.Helper()
+
+	var clientKey encryption.X25519KeyPair
+	if err := clientKey.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := postJSON(t, func(w http.ResponseWriter, r *http.Request) {
+		GetAesHandler(w, r, sm, nil)
+	}, GetAesRequest{
+		Version:   HANDSHAKE_X25519,
+		Suites:    suites,
+		X25519Key: encryption.EncodeX25519PublicKey(clientKey.PublicKey),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("handshake answered %d: %s", w.Code, w.Body)
+	}
+
+	var ans GetAesResponse
+	if err := json.NewDecoder(w.Body).Decode(&ans); err != nil {
+		t.Fatal(err)
+	}
+
+	relayKey, err := encryption.DecodeX25519PublicKey(ans.X25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := clientKey.SharedSecret(relayKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := encryption.SuiteKeySize(ans.Suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encryption.DeriveSessionKey(shared, clientKey.PublicKey, relayKey, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwardKey, backwardKey, err := encryption.DeriveDirectionKeys(key, encryption.SuiteTranscript(ans.Suite, suites))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward, err := encryption.NewSessionCipher(ans.Suite, forwardKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backward, err := encryption.NewSessionCipher(ans.Suite, backwardKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ans, forward, backward
+}
+
+func TestGetAesHandlerX25519(t *testing.T) {
+	for _, suites := range [][]int{
+		nil,
+		{encryption.SUITE_AES_128_GCM},
+		{encryption.SUITE_CHACHA20_POLY1305},
+		{encryption.SUITE_AES_128_GCM, encryption.SUITE_AES_256_GCM, encryption.SUITE_CHACHA20_POLY1305},
+	} {
+		ms := newTestStore(t)
+		ans, forward, backward := clientHandshake(t, ms, suites)
+
+		want, _ := encryption.SelectSuite(encryption.PreferredSuites(), suites)
+		if ans.Version != HANDSHAKE_X25519 || ans.Suite != want {
+			t.Fatalf("suites %v: version %d suite %d, want %d and %d", suites, ans.Version, ans.Suite, HANDSHAKE_X25519, want)
+		}
+
+		// The relay stored the keys the client derived
+		sessionData, err := ms.PullData(ans.Session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionData.Suite != ans.Suite ||
+			sessionData.ForwardKey != encryption.EncodeAESKey(forward.KeyBytes()) ||
+			sessionData.BackwardKey != encryption.EncodeAESKey(backward.KeyBytes()) {
+			t.Fatalf("suites %v: the relay and the client derived different keys", suites)
+		}
+	}
+}
+
+func TestGetAesHandlerErrors(t *testing.T) {
+	var clientKey encryption.X25519KeyPair
+	if err := clientKey.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+	publicKey := encryption.EncodeX25519PublicKey(clientKey.PublicKey)
+
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"bad JSON", "{", "Error reading json data."},
+		{"unknown version", `{"Version": 9, "X25519Key": "` + publicKey + `"}`, "Unsupported handshake version."},
+		{"ntor without identity", `{"Version": 3, "X25519Key": "` + publicKey + `"}`, "Unsupported handshake version."},
+		{"unknown suite", `{"Version": 2, "Suites": [99], "X25519Key": "` + publicKey + `"}`, "Unsupported cipher suite."},
+		{"bad X25519 key", `{"Version": 2, "X25519Key": "AAAA"}`, "Error reading X25519 key."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newTestStore(t)
+
+			w := httptest.NewRecorder()
+			GetAesHandler(w, httptest.NewRequest(http.MethodPost, "/get-aes", strings.NewReader(tt.body)), ms, nil)
+
+			if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != tt.message {
+				t.Fatalf("got %d %q, want 400 %q", w.Code, w.Body, tt.message)
+			}
+			if count, _ := ms.Count(); count != 0 {
+				t.Fatalf("%d sessions created", count)
+			}
+		})
+	}
+}
+
+// testRelay is a relay session whose redirect address is a test destination
+type testRelay struct {
+	sm       *session.MemoryStore
+	policy   *exitpolicy.Policy
+	token    string
+	forward  encryption.SessionCipher
+	backward encryption.SessionCipher
+}
+
+func newTestRelay(t *testing.T, rules []string, destination http.Handler) *testRelay {
+	t.Helper()
+
+	server := httptest.NewServer(destination)
+	t.Cleanup(server.Close)
+
+	policy, err := exitpolicy.Parse(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := newTestStore(t)
+	ans, forward, backward := clientHandshake(t, ms, []int{encryption.SUITE_CHACHA20_POLY1305})
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.UpdateAddress(ans.Session, addr.Host); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testRelay{sm: ms, policy: policy, token: ans.Session, forward: forward, backward: backward}
+}
+
+// redirectRequest seals the message for the redirect with sequence number seq
+func (r *testRelay) redirectRequest(t *testing.T, seq uint64, msgType string, data string) RedirectRequest {
+	t.Helper()
+
+	reqJson, err := json.Marshal(RedirectRequestJson{MsgType: msgType, Data: base64.StdEncoding.EncodeToString([]byte(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := r.forward.EncryptBase64WithAD(base64.StdEncoding.EncodeToString(reqJson), AssociatedData(r.token, DIRECTION_FORWARD, "redirect", seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return RedirectRequest{Session: r.token, Seq: seq, Message: message}
+}
+
+func (r *testRelay) redirect(t *testing.T, req RedirectRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return postJSON(t, func(w http.ResponseWriter, hr *http.Request) {
+		RedirectHandler(w, hr, r.sm, r.policy)
+	}, req)
+}
+
+// openAnswer opens the encrypted answer to the redirect with sequence number seq
+func (r *testRelay) openAnswer(t *testing.T, w *httptest.ResponseRecorder, seq uint64) string {
+	t.Helper()
+
+	var resp EncryptedResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := r.backward.DecryptWithAD(sealed, AssociatedData(r.token, DIRECTION_BACKWARD, "redirect", seq))
+	if err != nil {
+		t.Fatalf("answer to %d doesn't open: %v", seq, err)
+	}
+	return string(answer)
+}
+
+func echoDestination(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/auth/login" {
+			t.Errorf("destination got %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("hello "), body...))
+	})
+}
+
+func TestRedirectHandler(t *testing.T) {
+	relay := newTestRelay(t, []string{"accept 127.0.0.1:*"}, echoDestination(t))
+
+	req := relay.redirectRequest(t, 1, "auth/login", `{"user":"a"}`)
+	w := relay.redirect(t, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("answered %d, want the destination's 201", w.Code)
+	}
+	if answer := relay.openAnswer(t, w, 1); answer != `hello {"user":"a"}` {
+		t.Fatalf("answer %q", answer)
+	}
+
+	// The same request again is refused before reaching the destination
+	w = relay.redirect(t, req)
+	if w.Code != http.StatusConflict || !strings.Contains(relay.openAnswer(t, w, 1), REPLAY_ERROR) {
+		t.Fatalf("replay answered %d", w.Code)
+	}
+
+	// The message is bound to its sequence number, and a message that doesn't open doesn't use the number up
+	tampered := req
+	tampered.Seq = 2
+	w = relay.redirect(t, tampered)
+	if w.Code != http.StatusBadRequest || !strings.Contains(relay.openAnswer(t, w, 2), "Error decrypting data.") {
+		t.Fatalf("message with another sequence number answered %d", w.Code)
+	}
+
+	w = relay.redirect(t, relay.redirectRequest(t, 2, "auth/login", "again"))
+	if w.Code != http.StatusCreated || relay.openAnswer(t, w, 2) != "hello again" {
+		t.Fatalf("next message answered %d", w.Code)
+	}
+
+	// A late message inside the window is still forwarded
+	w = relay.redirect(t, relay.redirectRequest(t, 10, "auth/login", "ten"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("message 10 answered %d", w.Code)
+	}
+	w = relay.redirect(t, relay.redirectRequest(t, 5, "auth/login", "five"))
+	if w.Code != http.StatusCreated || relay.openAnswer(t, w, 5) != "hello five" {
+		t.Fatalf("late message answered %d", w.Code)
+	}
+}
+
+func TestRedirectHandlerRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		msgType string
+		status  int
+		message string
+	}{
+		{"address rejected by the exit policy", []string{"accept *:*"}, "auth/login", http.StatusForbidden, EXIT_POLICY_ERROR},
+		{"path outside the exit paths", []string{"accept 127.0.0.1:*"}, "admin/users", http.StatusForbidden, EXIT_PATH_ERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newTestRelay(t, tt.rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("destination reached for %s", r.URL.Path)
+			}))
+
+			w := relay.redirect(t, relay.redirectRequest(t, 1, tt.msgType, "{}"))
+			if w.Code != tt.status || !strings.Contains(relay.openAnswer(t, w, 1), tt.message) {
+				t.Fatalf("answered %d, want %d %q", w.Code, tt.status, tt.message)
+			}
+		})
+	}
+}
+
+func TestRedirectHandlerChunked(t *testing.T) {
+	relay := newTestRelay(t, []string{"accept 127.0.0.1:*"}, echoDestination(t))
+
+	body := strings.Repeat("x", 3*encryption.CHUNK_SIZE)
+	req := relay.redirectRequest(t, 1, "auth/login", body)
+	req.Chunked = true
+
+	w := relay.redirect(t, req)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != CHUNKED_CONTENT_TYPE {
+		t.Fatalf("answered %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	cr, err := encryption.NewChunkReader(relay.backward, w.Body, AssociatedData(relay.token, DIRECTION_BACKWARD, "redirect", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer) == 0 || answer[0] != CHUNK_KIND_BODY || string(answer[1:]) != "hello "+body {
+		t.Fatalf("chunked answer of %d bytes doesn't match", len(answer))
+	}
+}
+
+// rekeyRequest seals the rekey to generation with sequence number seq, with the forward key of the client
+func rekeyRequest(t *testing.T, token string, forward encryption.SessionCipher, seq uint64, generation uint64) RekeyRequest {
+	t.Helper()
+
+	b64generation := base64.StdEncoding.EncodeToString([]byte(strconv.FormatUint(generation, 10)))
+	message, err := forward.EncryptBase64WithAD(b64generation, AssociatedData(token, DIRECTION_FORWARD, "rekey", seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return RekeyRequest{Session: token, Seq: seq, Message: message}
+}
+
+// rekey sends the rekey to the relay and opens its answer with backward, failing when it doesn't open
+func (r *testRelay) rekey(t *testing.T, req RekeyRequest, backward encryption.SessionCipher) (int, string) {
+	t.Helper()
+
+	w := postJSON(t, func(w http.ResponseWriter, hr *http.Request) {
+		RekeyHandler(w, hr, r.sm)
+	}, req)
+
+	var resp EncryptedResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := backward.DecryptWithAD(sealed, AssociatedData(r.token, DIRECTION_BACKWARD, "rekey", req.Seq))
+	if err != nil {
+		t.Fatalf("answer to rekey %d doesn't open: %v", req.Seq, err)
+	}
+	return w.Code, string(answer)
+}
+
+func TestRekeyHandlerRetried(t *testing.T) {
+	relay := newTestRelay(t, []string{"accept 127.0.0.1:*"}, echoDestination(t))
+	oldForward, oldBackward := relay.forward, relay.backward
+
+	// The answer to the first rekey is lost, the client asks again with the keys it still has
+	if code, answer := relay.rekey(t, rekeyRequest(t, relay.token, oldForward, 1, 1), oldBackward); code != http.StatusOK {
+		t.Fatalf("rekey answered %d: %s", code, answer)
+	}
+	if code, answer := relay.rekey(t, rekeyRequest(t, relay.token, oldForward, 2, 1), oldBackward); code != http.StatusOK || !strings.Contains(answer, "OK") {
+		t.Fatalf("retried rekey answered %d: %s", code, answer)
+	}
+
+	sessionData, err := relay.sm.PullData(relay.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionData.Generation != 1 {
+		t.Fatalf("session at generation %d after a retried rekey, want 1", sessionData.Generation)
+	}
+
+	// The previous keys only answer for the generation they moved the session to
+	if code, answer := relay.rekey(t, rekeyRequest(t, relay.token, oldForward, 3, 2), oldBackward); code != http.StatusConflict || !strings.Contains(answer, KEY_GENERATION_ERROR) {
+		t.Fatalf("rekey past the generation with the previous keys answered %d: %s", code, answer)
+	}
+
+	// The client switches, its first message with the new keys drops the previous ones
+	nextForward, nextBackward, err := encryption.RatchetKeys(oldForward.KeyBytes(), oldBackward.KeyBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay.forward, err = encryption.NewSessionCipher(encryption.SUITE_CHACHA20_POLY1305, nextForward); err != nil {
+		t.Fatal(err)
+	}
+	if relay.backward, err = encryption.NewSessionCipher(encryption.SUITE_CHACHA20_POLY1305, nextBackward); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := relay.redirect(t, relay.redirectRequest(t, 4, "auth/login", `{}`)); w.Code != http.StatusCreated {
+		t.Fatalf("redirect with the new keys answered %d", w.Code)
+	}
+
+	if code, _ := relay.rekey(t, rekeyRequest(t, relay.token, oldForward, 5, 1), relay.backward); code != http.StatusBadRequest {
+		t.Fatalf("rekey with the dropped keys answered %d", code)
+	}
+}
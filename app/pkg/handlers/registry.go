@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+/*
+The message types a relay forwards in a redirect are either relay-control types, the API of the next relay
+(get-aes, set-redirect, redirect, rekey), or exit traffic, a path of the destination server.
+
+Relay-control types are registered with a handler that checks the data is the request the next relay expects.
+Exit traffic is forwarded as the bytes the client sent, the relay doesn't need to know the server's API, but only
+to the paths the operator allows. An allowed path is written as
+
+	auth/login     the path itself
+	messages/*     every path under messages/
+	*              every path
+
+DEFAULT_EXIT_PATHS are the paths of the chat server.
+*/
+
+// DEFAULT_EXIT_PATHS are the exit paths allowed when the operator configures none
+var DEFAULT_EXIT_PATHS = []string{"auth/*", "messages/*"}
+
+var (
+	ErrUnknownMsgType   = errors.New("unknown message type")
+	ErrExitPathRejected = errors.New("path rejected by the exit paths of the relay")
+)
+
+// MessageHandler checks the decoded data of a message type and returns the body forwarded for it
+type MessageHandler func(data []byte) ([]byte, error)
+
+// Registry holds the relay-control message types and the exit paths allowed
+type Registry struct {
+	mu        sync.RWMutex
+	types     map[string]MessageHandler
+	exitPaths []string
+}
+
+// Messages is the registry the relay forwards with
+var Messages = newDefaultRegistry()
+
+func newDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("get-aes", Typed[GetAesRequest]())
+	r.Register("set-redirect", Typed[SetRedirectRequest]())
+	r.Register("redirect", Typed[RedirectRequest]())
+	r.Register("rekey", Typed[RekeyRequest]())
+	return r
+}
+
+// NewRegistry returns a registry without message types, allowing DEFAULT_EXIT_PATHS
+func NewRegistry() *Registry {
+	return &Registry{types: map[string]MessageHandler{}, exitPaths: DEFAULT_EXIT_PATHS}
+}
+
+// Register adds a relay-control message type, a type registered twice keeps the last handler
+func (r *Registry) Register(msgType string, handler MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.types[msgType] = handler
+}
+
+// Control reports whether msgType is a registered relay-control type
+func (r *Registry) Control(msgType string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.types[msgType]
+	return ok
+}
+
+// Typed is the handler of a message type whose data is the JSON of T. The data is forwarded unchanged once it
+// decodes into T, so fields the relay doesn't know still reach the next relay.
+func Typed[T any]() MessageHandler {
+	return func(data []byte) ([]byte, error) {
+		var request T
+		if err := json.Unmarshal(data, &request); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// SetExitPaths replaces the exit paths allowed, nil allows DEFAULT_EXIT_PATHS
+func (r *Registry) SetExitPaths(patterns []string) error {
+	if err := CheckExitPaths(patterns); err != nil {
+		return err
+	}
+	if patterns == nil {
+		patterns = DEFAULT_EXIT_PATHS
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exitPaths = patterns
+	return nil
+}
+
+// Body decodes the base64 data of a message and returns the body forwarded for its type.
+// A type that isn't registered is exit traffic, it returns ErrExitPathRejected unless its path is allowed.
+func (r *Registry) Body(msgType string, encodedData string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encodedData)
+	if err != nil {
+		return nil, errors.New("failed to decode base64 data")
+	}
+
+	r.mu.RLock()
+	handler, ok := r.types[msgType]
+	exitPaths := r.exitPaths
+	r.mu.RUnlock()
+
+	if ok {
+		return handler(data)
+	}
+
+	if !validExitPath(msgType) {
+		return nil, ErrUnknownMsgType
+	}
+	if !exitPathAllowed(exitPaths, msgType) {
+		return nil, ErrExitPathRejected
+	}
+
+	return data, nil
+}
+
+// CheckExitPaths checks every allowed exit path, the invalid ones are reported together
+func CheckExitPaths(patterns []string) error {
+	var errs []error
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			continue
+		}
+		if !validExitPath(strings.TrimSuffix(pattern, "/*")) {
+			errs = append(errs, fmt.Errorf("exit path %q: must be a path like auth/login or messages/*", pattern))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validExitPath reports whether p is a clean relative path, so the relay never forwards outside the server's API
+func validExitPath(p string) bool {
+	if p == "" || p == "." || strings.HasPrefix(p, "/") || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return false
+	}
+
+	for _, c := range p {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// exitPathAllowed reports whether one of the patterns allows p
+func exitPathAllowed(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == p {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasSuffix(prefix, "/") && strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
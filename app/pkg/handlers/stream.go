@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"marshmello/pkg/exitpolicy"
+	"marshmello/pkg/logging"
+	"marshmello/pkg/metrics"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Streams carry a TCP connection of the client through the circuit, the exit relay connects to the target and
+the client moves the bytes with the message types:
+
+	begin  {"Stream": id, "Addr": "host:port"}  connects the stream to the target, checked with the exit policy
+	data   {"Stream": id, "Data": base64}       writes Data to the target and answers what it sent since
+	end    {"Stream": id}                       closes the stream
+
+Every message is answered with a StreamResponse. The relays only answer requests, so a data message without
+Data is how the client asks for what the target sent, the relay waits up to STREAM_READ_WAIT for it.
+A stream belongs to the session that began it and is closed with it, or after STREAM_IDLE_TIMEOUT without a message.
+*/
+
+const (
+	STREAM_BEGIN = "begin"
+	STREAM_DATA  = "data"
+	STREAM_END   = "end"
+
+	STREAM_DATA_SIZE        = 16 * 1024 // most bytes a data message or its answer carries
+	STREAM_READ_WAIT        = 200 * time.Millisecond
+	STREAM_WRITE_TIMEOUT    = 10 * time.Second
+	STREAM_IDLE_TIMEOUT     = 5 * time.Minute
+	MAX_STREAMS_PER_SESSION = 16
+	streamReadAheadChunks   = 8 // chunks read from the target before the client asks for them
+)
+
+// Errors answered, encrypted, to stream messages
+const (
+	STREAMS_DISABLED_ERROR = "Streams are disabled on this relay."
+	UNKNOWN_STREAM_ERROR   = "Unknown stream."
+)
+
+type StreamRequest struct {
+	Stream uint32
+	Addr   string `json:",omitempty"` // begin only
+	Data   string `json:",omitempty"` // base64, data only
+}
+
+type StreamResponse struct {
+	Stream uint32
+	Data   string `json:",omitempty"` // base64, what the target sent
+	Closed bool   `json:",omitempty"` // the target closed the connection after Data, the stream is gone
+}
+
+type streamKey struct {
+	session string
+	id      uint32
+}
+
+// stream is the connection of a stream to its target
+type stream struct {
+	mu      sync.Mutex // one message at a time
+	conn    net.Conn
+	chunks  chan []byte   // read from the target, closed once it's done
+	done    chan struct{} // closed with the stream, stops the reader
+	pending []byte        // read but not answered yet
+	eof     bool
+	idle    *time.Timer
+}
+
+// StreamTable holds the open streams of the relay
+type StreamTable struct {
+	mu      sync.Mutex
+	enabled bool
+	streams map[streamKey]*stream
+}
+
+// Streams is the stream table of the relay, disabled until the operator enables it
+var Streams = NewStreamTable()
+
+func NewStreamTable() *StreamTable {
+	return &StreamTable{streams: map[streamKey]*stream{}}
+}
+
+// SetEnabled allows or refuses new streams
+func (t *StreamTable) SetEnabled(enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.enabled = enabled
+}
+
+// IsStreamMsgType reports whether msgType is a stream message, answered by the exit relay instead of forwarded
+func IsStreamMsgType(msgType string) bool {
+	return msgType == STREAM_BEGIN || msgType == STREAM_DATA || msgType == STREAM_END
+}
+
+// Handle answers a stream message of the session with a status code and the JSON to encrypt for the client
+func (t *StreamTable) Handle(token string, reqJson RedirectRequestJson, policy *exitpolicy.Policy) (int, []byte) {
+	data, err := base64.StdEncoding.DecodeString(reqJson.Data)
+	if err != nil {
+		return streamError("Error decoding b64 data.", http.StatusBadRequest)
+	}
+
+	var req StreamRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return streamError("Error reading JSON data.", http.StatusBadRequest)
+	}
+
+	metrics.Redirects.WithLabelValues(metrics.MsgType(reqJson.MsgType)).Inc()
+
+	switch reqJson.MsgType {
+	case STREAM_BEGIN:
+		return t.begin(token, req, policy)
+	case STREAM_DATA:
+		return t.data(token, req)
+	default:
+		t.close(streamKey{token, req.Stream})
+		return streamAnswer(StreamResponse{Stream: req.Stream, Closed: true})
+	}
+}
+
+// begin connects a new stream of the session to its target
+func (t *StreamTable) begin(token string, req StreamRequest, policy *exitpolicy.Policy) (int, []byte) {
+	key := streamKey{token, req.Stream}
+
+	t.mu.Lock()
+	enabled := t.enabled
+	_, exists := t.streams[key]
+	count := 0
+	for k := range t.streams {
+		if k.session == token {
+			count++
+		}
+	}
+	t.mu.Unlock()
+
+	if !enabled {
+		return streamError(STREAMS_DISABLED_ERROR, http.StatusForbidden)
+	}
+	if exists {
+		return streamError("Stream already open.", http.StatusConflict)
+	}
+	if count >= MAX_STREAMS_PER_SESSION {
+		return streamError("Too many streams on the session.", http.StatusTooManyRequests)
+	}
+
+	if _, _, err := net.SplitHostPort(req.Addr); err != nil {
+		return streamError("Invalid stream address.", http.StatusBadRequest)
+	}
+
+	// The exit policy is checked on every address the target resolves to, and again on the address actually dialed
+	ctx, cancel := context.WithTimeout(context.Background(), policy.DialTimeout())
+	defer cancel()
+
+	err := policy.Check(ctx, req.Addr)
+	if errors.Is(err, exitpolicy.ErrRejected) {
+		return streamError(EXIT_POLICY_ERROR, http.StatusForbidden)
+	}
+	if err != nil {
+		slog.Debug("Stream address refused", logging.Addr("addr", req.Addr), logging.Sensitive("error", err))
+		return streamError("Stream target unreachable.", http.StatusBadGateway)
+	}
+
+	conn, err := policy.DialContext(ctx, "tcp", req.Addr)
+	if errors.Is(err, exitpolicy.ErrRejected) {
+		return streamError(EXIT_POLICY_ERROR, http.StatusForbidden)
+	}
+	if err != nil {
+		slog.Debug("Stream connection failed", logging.Addr("addr", req.Addr), logging.Sensitive("error", err))
+		return streamError("Stream target unreachable.", http.StatusBadGateway)
+	}
+
+	s := &stream{
+		conn:   conn,
+		chunks: make(chan []byte, streamReadAheadChunks),
+		done:   make(chan struct{}),
+	}
+	s.idle = time.AfterFunc(STREAM_IDLE_TIMEOUT, func() { t.close(key) })
+
+	t.mu.Lock()
+	if _, exists := t.streams[key]; exists {
+		t.mu.Unlock()
+		s.idle.Stop()
+		conn.Close()
+		return streamError("Stream already open.", http.StatusConflict)
+	}
+	t.streams[key] = s
+	t.mu.Unlock()
+
+	metrics.OpenStreams.Inc()
+	go s.read()
+
+	slog.Debug("Stream opened", logging.Session(token), logging.Addr("addr", req.Addr))
+	return streamAnswer(StreamResponse{Stream: req.Stream})
+}
+
+// data writes the client's bytes to the target and answers what the target sent
+func (t *StreamTable) data(token string, req StreamRequest) (int, []byte) {
+	key := streamKey{token, req.Stream}
+
+	t.mu.Lock()
+	s, ok := t.streams[key]
+	t.mu.Unlock()
+	if !ok {
+		return streamError(UNKNOWN_STREAM_ERROR, http.StatusNotFound)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(req.Data)
+	if err != nil || len(payload) > STREAM_DATA_SIZE {
+		return streamError("Invalid stream data.", http.StatusBadRequest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idle.Reset(STREAM_IDLE_TIMEOUT)
+
+	if len(payload) > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+		if _, err := s.conn.Write(payload); err != nil {
+			t.close(key)
+			return streamAnswer(StreamResponse{Stream: req.Stream, Closed: true})
+		}
+	}
+
+	out := s.collect()
+	metrics.Relayed(len(payload), len(out))
+
+	resp := StreamResponse{Stream: req.Stream, Data: base64.StdEncoding.EncodeToString(out)}
+	if s.eof && len(s.pending) == 0 {
+		t.close(key)
+		resp.Closed = true
+	}
+
+	return streamAnswer(resp)
+}
+
+// collect returns up to STREAM_DATA_SIZE bytes the target sent, waiting STREAM_READ_WAIT for some when none came yet.
+// The caller holds the stream lock.
+func (s *stream) collect() []byte {
+	out := s.pending
+	s.pending = nil
+
+	if len(out) == 0 && !s.eof {
+		select {
+		case chunk, ok := <-s.chunks:
+			out, s.eof = chunk, !ok
+		case <-time.After(STREAM_READ_WAIT):
+		}
+	}
+
+	// Take what is already there without waiting
+	for !s.eof && len(out) < STREAM_DATA_SIZE && len(s.chunks) > 0 {
+		chunk, ok := <-s.chunks
+		out, s.eof = append(out, chunk...), !ok
+	}
+
+	if len(out) > STREAM_DATA_SIZE {
+		s.pending = out[STREAM_DATA_SIZE:]
+		out = out[:STREAM_DATA_SIZE]
+	}
+
+	return out
+}
+
+// read moves what the target sends into the chunks, it stops reading while the client is behind
+func (s *stream) read() {
+	defer close(s.chunks)
+
+	for {
+		buf := make([]byte, STREAM_DATA_SIZE)
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			select {
+			case s.chunks <- buf[:n]:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close closes the stream and forgets it, closing a stream that is gone does nothing
+func (t *StreamTable) close(key streamKey) {
+	t.mu.Lock()
+	s, ok := t.streams[key]
+	delete(t.streams, key)
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	s.idle.Stop()
+	close(s.done)
+	s.conn.Close()
+	metrics.OpenStreams.Dec()
+}
+
+// CloseSession closes every stream of the session, when it's destroyed
+func (t *StreamTable) CloseSession(token string) {
+	t.mu.Lock()
+	var keys []streamKey
+	for key := range t.streams {
+		if key.session == token {
+			keys = append(keys, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range keys {
+		t.close(key)
+	}
+}
+
+func streamAnswer(resp StreamResponse) (int, []byte) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return streamError("Error encoding response data.", http.StatusInternalServerError)
+	}
+	return http.StatusOK, data
+}
+
+func streamError(message string, statusCode int) (int, []byte) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+	return statusCode, data
+}
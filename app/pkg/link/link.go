@@ -0,0 +1,413 @@
+package link
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+A link is a long-lived connection between two relays (or a client and its first relay) that carries
+the cells of every circuit going between them, so a message doesn't open a new connection per hop.
+
+The link starts as an HTTP request on the relay's usual port ("GET /link" with "Upgrade: LINK_PROTOCOL")
+and after the "101 Switching Protocols" answer both sides exchange frames:
+
+	[0:4]   circuit ID, chosen by the side that opened the link, one per circuit on this link
+	[4:8]   request ID, the response frame carries the ID of its request
+	[8]     command: LINK_REQUEST, LINK_RESPONSE or LINK_ERROR
+	[9:13]  payload length
+	[13:]   payload, the cells of one message (or a JSON error for LINK_ERROR)
+
+Requests are answered in any order, so a slow circuit doesn't hold back the others on the link.
+*/
+
+const (
+	LINK_PATH     = "/link"
+	LINK_PROTOCOL = "marshmello-link/1"
+
+	FRAME_HEADER_SIZE = 13
+	MAX_FRAME_PAYLOAD = 8 << 20 // the most a frame carries, request frames are held to Limits.MaxRequest
+
+	LINK_REQUEST  = 1
+	LINK_RESPONSE = 2
+	LINK_ERROR    = 3
+
+	DIAL_TIMEOUT    = 10 * time.Second
+	REQUEST_TIMEOUT = 30 * time.Second
+)
+
+// Limits bound the links of a pool: how long opening a link and waiting for the answer to a request take,
+// and the largest request frame read from the other side
+type Limits struct {
+	Dial       time.Duration
+	Request    time.Duration
+	MaxRequest int
+}
+
+var DEFAULT_LIMITS = Limits{Dial: DIAL_TIMEOUT, Request: REQUEST_TIMEOUT, MaxRequest: MAX_FRAME_PAYLOAD}
+
+var (
+	ErrLinkClosed = errors.New("link closed")
+	ErrNoAnswer   = errors.New("link closed before the answer")
+	ErrTimeout    = errors.New("link request timed out")
+)
+
+// RemoteError is an error answered by the other side of the link, Payload is its JSON error
+type RemoteError struct {
+	Payload []byte
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("HTTP error: %s", e.Payload)
+}
+
+type Frame struct {
+	CircID    uint32
+	RequestID uint32
+	Command   byte
+	Payload   []byte
+}
+
+// DialFunc opens the connection a link is carried on
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Handler answers the payload of a request frame received on a circuit of the link
+type Handler func(l *Link, circID uint32, payload []byte) ([]byte, error)
+
+type Link struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	limits Limits
+
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	pending       map[uint32]chan Frame // request ID -> waiting request
+	nextRequestID uint32
+	circuits      map[string]uint32 // session -> circuit ID, on links we opened
+	bound         map[uint32]string // circuit ID -> session, on links we accepted
+	nextCircID    uint32
+	draining      bool           // set on shutdown, new requests are refused
+	inflight      sync.WaitGroup // requests being answered on a link we accepted
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newLink(conn net.Conn, reader *bufio.Reader, limits Limits) *Link {
+	return &Link{
+		conn:     conn,
+		reader:   reader,
+		limits:   limits,
+		pending:  make(map[uint32]chan Frame),
+		circuits: make(map[string]uint32),
+		bound:    make(map[uint32]string),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Dial opens a link to the relay at addr
+func Dial(addr string) (*Link, error) {
+	return DialWith((&net.Dialer{}).DialContext, addr)
+}
+
+// DialWith opens a link to the relay at addr, connecting with dial
+func DialWith(dial DialFunc, addr string) (*Link, error) {
+	return dialLink(dial, addr, DEFAULT_LIMITS)
+}
+
+// dialLink is DialWith for a link bound by limits
+func dialLink(dial DialFunc, addr string, limits Limits) (*Link, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Dial)
+	defer cancel()
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask the relay to switch the connection to the link protocol
+	conn.SetDeadline(time.Now().Add(limits.Dial))
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", LINK_PATH, addr, LINK_PROTOCOL)
+	if _, err := io.WriteString(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != LINK_PROTOCOL {
+		conn.Close()
+		return nil, fmt.Errorf("relay at %s doesn't support links", addr)
+	}
+	conn.SetDeadline(time.Time{})
+
+	l := newLink(conn, reader, limits)
+	go l.readResponses()
+
+	return l, nil
+}
+
+// accept switches the HTTP connection of the request to the link protocol, it returns nil when the request can't be switched
+func accept(w http.ResponseWriter, r *http.Request, limits Limits) *Link {
+	if r.Header.Get("Upgrade") != LINK_PROTOCOL {
+		http.Error(w, "Expected an upgrade to "+LINK_PROTOCOL, http.StatusUpgradeRequired)
+		return nil
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Links are not supported on this connection", http.StatusInternalServerError)
+		return nil
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "Links are not supported on this connection", http.StatusInternalServerError)
+		return nil
+	}
+
+	// The server may have set deadlines for the HTTP request, the link lives on
+	conn.SetDeadline(time.Time{})
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", LINK_PROTOCOL)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+
+	return newLink(conn, rw.Reader, limits)
+}
+
+// Request sends the payload on the circuit and waits for the answer
+func (l *Link) Request(circID uint32, payload []byte) ([]byte, error) {
+	ch := make(chan Frame, 1)
+
+	l.mu.Lock()
+	l.nextRequestID++
+	requestID := l.nextRequestID
+	l.pending[requestID] = ch
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, requestID)
+		l.mu.Unlock()
+	}()
+
+	if l.Closed() {
+		return nil, ErrLinkClosed
+	}
+
+	// The request never left when the write fails, so it is safe to send it again on another link
+	err := l.writeFrame(Frame{CircID: circID, RequestID: requestID, Command: LINK_REQUEST, Payload: payload})
+	if err != nil {
+		l.Close()
+		return nil, ErrLinkClosed
+	}
+
+	select {
+	case frame := <-ch:
+		if frame.Command == LINK_ERROR {
+			return nil, &RemoteError{Payload: frame.Payload}
+		}
+		return frame.Payload, nil
+	case <-l.closed:
+		return nil, ErrNoAnswer
+	case <-time.After(l.limits.Request):
+		return nil, ErrTimeout
+	}
+}
+
+// CircuitID returns the ID of the circuit going to the session on this link, picking a new one the first time
+func (l *Link) CircuitID(session string) uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if id, ok := l.circuits[session]; ok {
+		return id
+	}
+
+	l.nextCircID++
+	l.circuits[session] = l.nextCircID
+	return l.nextCircID
+}
+
+// Bind ties a circuit ID of an accepted link to the session it carries.
+// It reports false when the ID already carries another session.
+func (l *Link) Bind(circID uint32, session string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bound, ok := l.bound[circID]; ok {
+		return bound == session
+	}
+
+	l.bound[circID] = session
+	return true
+}
+
+// Forget drops the circuit going to the session, once it is torn down
+func (l *Link) Forget(session string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.circuits, session)
+}
+
+// Unbind frees a circuit ID of an accepted link, once its circuit is torn down
+func (l *Link) Unbind(circID uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.bound, circID)
+}
+
+// Closed reports whether the link is closed
+func (l *Link) Closed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the link, requests waiting on it fail
+func (l *Link) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+// drain refuses new requests and waits for the ones being answered
+func (l *Link) drain() {
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+
+	l.inflight.Wait()
+}
+
+// readResponses hands the answers read on a link we opened to the waiting requests
+func (l *Link) readResponses() {
+	defer l.Close()
+
+	for {
+		frame, err := readFrame(l.reader, MAX_FRAME_PAYLOAD)
+		if err != nil {
+			return
+		}
+
+		l.mu.Lock()
+		ch, ok := l.pending[frame.RequestID]
+		l.mu.Unlock()
+
+		// The request may have timed out already
+		if ok {
+			ch <- frame
+		}
+	}
+}
+
+// serveRequests answers every request read on a link we accepted, each in its own goroutine
+func (l *Link) serveRequests(handler Handler) {
+	defer l.Close()
+
+	for {
+		frame, err := readFrame(l.reader, l.limits.MaxRequest)
+		if err != nil {
+			return
+		}
+
+		if frame.Command != LINK_REQUEST {
+			continue
+		}
+
+		l.mu.Lock()
+		if l.draining {
+			l.mu.Unlock()
+			l.writeFrame(Frame{CircID: frame.CircID, RequestID: frame.RequestID, Command: LINK_ERROR, Payload: []byte(`{"error":"Relay is shutting down."}`)})
+			continue
+		}
+		l.inflight.Add(1)
+		l.mu.Unlock()
+
+		go func(frame Frame) {
+			defer l.inflight.Done()
+
+			answer := Frame{CircID: frame.CircID, RequestID: frame.RequestID, Command: LINK_RESPONSE}
+
+			payload, err := handler(l, frame.CircID, frame.Payload)
+			if err != nil {
+				answer.Command = LINK_ERROR
+				payload = []byte(err.Error())
+			}
+			answer.Payload = payload
+
+			if err := l.writeFrame(answer); err != nil {
+				l.Close()
+			}
+		}(frame)
+	}
+}
+
+func (l *Link) writeFrame(frame Frame) error {
+	if len(frame.Payload) > MAX_FRAME_PAYLOAD {
+		return errors.New("frame payload too large")
+	}
+
+	buf := make([]byte, FRAME_HEADER_SIZE+len(frame.Payload))
+	binary.BigEndian.PutUint32(buf[0:4], frame.CircID)
+	binary.BigEndian.PutUint32(buf[4:8], frame.RequestID)
+	buf[8] = frame.Command
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(frame.Payload)))
+	copy(buf[FRAME_HEADER_SIZE:], frame.Payload)
+
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	_, err := l.conn.Write(buf)
+	return err
+}
+
+// readFrame reads the next frame, refusing one whose payload is larger than max
+func readFrame(reader io.Reader, max int) (Frame, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[9:13])
+	if length > uint32(min(max, MAX_FRAME_PAYLOAD)) {
+		return Frame{}, errors.New("frame payload too large")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{
+		CircID:    binary.BigEndian.Uint32(header[0:4]),
+		RequestID: binary.BigEndian.Uint32(header[4:8]),
+		Command:   header[8],
+		Payload:   payload,
+	}, nil
+}
@@ -0,0 +1,274 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer accepts links on a test server with the pool and returns the address it listens on
+func newTestServer(t *testing.T, pool *Pool, handler Handler) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool.Accept(w, r, handler)
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func echo(l *Link, circID uint32, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func TestFrameEncoding(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	l := newLink(client, nil, DEFAULT_LIMITS)
+	sent := Frame{CircID: 7, RequestID: 0x01020304, Command: LINK_RESPONSE, Payload: []byte("cells")}
+
+	go l.writeFrame(sent)
+
+	raw := make([]byte, FRAME_HEADER_SIZE+len(sent.Payload))
+	if _, err := io.ReadFull(server, raw); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0, 0, 0, 7, 1, 2, 3, 4, LINK_RESPONSE, 0, 0, 0, 5}, "cells"...)
+	if !bytes.Equal(raw, want) {
+		t.Fatalf("frame %v, want %v", raw, want)
+	}
+
+	frame, err := readFrame(bytes.NewReader(raw), MAX_FRAME_PAYLOAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.CircID != sent.CircID || frame.RequestID != sent.RequestID || frame.Command != sent.Command || string(frame.Payload) != "cells" {
+		t.Fatalf("read %+v, want %+v", frame, sent)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	header := make([]byte, FRAME_HEADER_SIZE)
+	header[12] = 17
+	buf.Write(header)
+	buf.Write(make([]byte, 17))
+
+	if _, err := readFrame(bytes.NewReader(buf.Bytes()), 16); err == nil {
+		t.Fatal("frame over the limit was read")
+	}
+	if _, err := readFrame(bytes.NewReader(buf.Bytes()), 17); err != nil {
+		t.Fatalf("frame at the limit: %v", err)
+	}
+
+	l := newLink(nil, nil, DEFAULT_LIMITS)
+	if err := l.writeFrame(Frame{Payload: make([]byte, MAX_FRAME_PAYLOAD+1)}); err == nil {
+		t.Fatal("frame over MAX_FRAME_PAYLOAD was written")
+	}
+}
+
+func TestRequestMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	addr := newTestServer(t, NewPool(), func(l *Link, circID uint32, payload []byte) ([]byte, error) {
+		switch string(payload) {
+		case "slow":
+			<-release
+		case "fail":
+			return nil, errors.New(`{"error":"refused"}`)
+		}
+		return append([]byte("answer to "), payload...), nil
+	})
+
+	l, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The slow request doesn't hold back the others, each gets its own answer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		answer, err := l.Request(l.CircuitID("a"), []byte("slow"))
+		if err != nil || string(answer) != "answer to slow" {
+			t.Errorf("slow request: %q, %v", answer, err)
+		}
+	}()
+
+	for _, payload := range []string{"one", "two", "three"} {
+		answer, err := l.Request(l.CircuitID("b"), []byte(payload))
+		if err != nil || string(answer) != "answer to "+payload {
+			t.Fatalf("request %s: %q, %v", payload, answer, err)
+		}
+	}
+
+	_, err = l.Request(l.CircuitID("b"), []byte("fail"))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || string(remote.Payload) != `{"error":"refused"}` {
+		t.Fatalf("refused request: got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if l.CircuitID("a") == l.CircuitID("b") {
+		t.Fatal("two sessions share a circuit ID")
+	}
+}
+
+func TestOversizeFrameClosesLink(t *testing.T) {
+	pool := NewPool()
+	pool.SetLimits(Limits{Dial: DIAL_TIMEOUT, Request: REQUEST_TIMEOUT, MaxRequest: 16})
+	addr := newTestServer(t, pool, echo)
+
+	l, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if answer, err := l.Request(1, make([]byte, 16)); err != nil || len(answer) != 16 {
+		t.Fatalf("request at the limit: %d bytes, %v", len(answer), err)
+	}
+
+	if _, err := l.Request(1, make([]byte, 17)); !errors.Is(err, ErrNoAnswer) {
+		t.Fatalf("request over the limit: got %v, want ErrNoAnswer", err)
+	}
+	if !l.Closed() {
+		t.Fatal("link still open after a frame over the limit")
+	}
+	if _, err := l.Request(1, []byte("again")); !errors.Is(err, ErrLinkClosed) {
+		t.Fatalf("request on the closed link: got %v, want ErrLinkClosed", err)
+	}
+}
+
+func TestPoolSendWithoutLinks(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	pool := NewPool()
+	defer pool.Close()
+
+	if _, err := pool.Send(strings.TrimPrefix(server.URL, "http://"), "a", []byte("cells")); !errors.Is(err, ErrNoLink) {
+		t.Fatalf("relay without links: got %v, want ErrNoLink", err)
+	}
+}
+
+// waitDraining waits until every link the pool accepted refuses new requests
+func waitDraining(t *testing.T, pool *Pool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		pool.mu.Lock()
+		draining := len(pool.accepted) > 0
+		for l := range pool.accepted {
+			l.mu.Lock()
+			draining = draining && l.draining
+			l.mu.Unlock()
+		}
+		pool.mu.Unlock()
+
+		if draining {
+			return
+		}
+	}
+	t.Fatal("links not draining")
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pool := NewPool()
+	addr := newTestServer(t, pool, func(l *Link, circID uint32, payload []byte) ([]byte, error) {
+		if string(payload) == "slow" {
+			close(started)
+			<-release
+		}
+		return payload, nil
+	})
+
+	l, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	inflight := make(chan error, 1)
+	go func() {
+		answer, err := l.Request(1, []byte("slow"))
+		if err == nil && string(answer) != "slow" {
+			err = errors.New("wrong answer " + string(answer))
+		}
+		inflight <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- pool.Shutdown(context.Background())
+	}()
+	waitDraining(t, pool)
+
+	// New requests are refused while the one in flight is answered
+	_, err = l.Request(1, []byte("new"))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || !strings.Contains(string(remote.Payload), "shutting down") {
+		t.Fatalf("request during shutdown: got %v", err)
+	}
+
+	close(release)
+	if err := <-inflight; err != nil {
+		t.Fatalf("request in flight: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	pool := NewPool()
+	addr := newTestServer(t, pool, func(l *Link, circID uint32, payload []byte) ([]byte, error) {
+		close(started)
+		<-release
+		return payload, nil
+	})
+
+	l, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go l.Request(1, []byte("stuck"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := pool.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown with a request stuck: got %v, want DeadlineExceeded", err)
+	}
+
+	// The accepted links are closed once the deadline passed
+	for deadline := time.Now().Add(5 * time.Second); !l.Closed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("link still open after shutdown")
+		}
+	}
+}
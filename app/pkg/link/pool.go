@@ -0,0 +1,176 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Peers that can't open a link are asked again after this long, in between the caller falls back to plain HTTP
+const RETRY_INTERVAL = 5 * time.Minute
+
+var ErrNoLink = errors.New("no link to the relay")
+
+// Pool keeps one open link per peer address, and the links other peers opened to us
+type Pool struct {
+	dial     DialFunc
+	limits   Limits
+	mu       sync.Mutex
+	links    map[string]*Link
+	failed   map[string]time.Time // addr -> when opening a link last failed
+	accepted map[*Link]struct{}
+}
+
+func NewPool() *Pool {
+	return NewPoolWithDialer((&net.Dialer{}).DialContext)
+}
+
+// NewPoolWithDialer creates a pool whose links are opened with dial
+func NewPoolWithDialer(dial DialFunc) *Pool {
+	return &Pool{
+		dial:     dial,
+		limits:   DEFAULT_LIMITS,
+		links:    make(map[string]*Link),
+		failed:   make(map[string]time.Time),
+		accepted: make(map[*Link]struct{}),
+	}
+}
+
+// SetLimits sets the limits of the links the pool opens and accepts, it is called before the pool is used
+func (p *Pool) SetLimits(limits Limits) {
+	p.limits = limits
+}
+
+// Accept switches the HTTP connection of the request to the link protocol and serves it until it closes
+func (p *Pool) Accept(w http.ResponseWriter, r *http.Request, handler Handler) {
+	l := accept(w, r, p.limits)
+	if l == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.accepted[l] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.accepted, l)
+		p.mu.Unlock()
+	}()
+
+	l.serveRequests(handler)
+}
+
+// Get returns the open link to addr, dialing a new one when there is none
+func (p *Pool) Get(addr string) (*Link, error) {
+	p.mu.Lock()
+	if l, ok := p.links[addr]; ok && !l.Closed() {
+		p.mu.Unlock()
+		return l, nil
+	}
+	if at, ok := p.failed[addr]; ok && time.Since(at) < RETRY_INTERVAL {
+		p.mu.Unlock()
+		return nil, ErrNoLink
+	}
+	p.mu.Unlock()
+
+	// Dial without holding the pool, a slow peer shouldn't hold back the others
+	l, err := dialLink(p.dial, addr, p.limits)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.failed[addr] = time.Now()
+		return nil, ErrNoLink
+	}
+	delete(p.failed, addr)
+
+	// Someone else may have opened one meanwhile
+	if existing, ok := p.links[addr]; ok && !existing.Closed() {
+		l.Close()
+		return existing, nil
+	}
+
+	p.links[addr] = l
+	return l, nil
+}
+
+// Send sends the payload on the circuit going to the session at addr and returns the answer.
+// It returns ErrNoLink when addr can't be reached over a link.
+func (p *Pool) Send(addr string, session string, payload []byte) ([]byte, error) {
+	l, err := p.Get(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := l.Request(l.CircuitID(session), payload)
+	if errors.Is(err, ErrLinkClosed) {
+		// The peer may have restarted, the request didn't leave so try once on a fresh link
+		l, err = p.Get(addr)
+		if err != nil {
+			return nil, err
+		}
+		return l.Request(l.CircuitID(session), payload)
+	}
+
+	return answer, err
+}
+
+// Forget drops the circuit going to the session at addr, once it is torn down
+func (p *Pool) Forget(addr string, session string) {
+	p.mu.Lock()
+	l, ok := p.links[addr]
+	p.mu.Unlock()
+
+	if ok {
+		l.Forget(session)
+	}
+}
+
+// Shutdown stops answering new requests on the accepted links and waits for the ones in flight, until ctx is done.
+// Every link is closed afterwards.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	accepted := make([]*Link, 0, len(p.accepted))
+	for l := range p.accepted {
+		accepted = append(accepted, l)
+	}
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		for _, l := range accepted {
+			l.drain()
+		}
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, l := range accepted {
+		l.Close()
+	}
+	p.Close()
+
+	return err
+}
+
+// Close closes every link the pool opened
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, l := range p.links {
+		l.Close()
+		delete(p.links, addr)
+	}
+}
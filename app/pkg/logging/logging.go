@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+The relay logs through log/slog. It runs in one of two modes:
+
+	safe   the default, addresses, session tokens and payloads are never written, only redacted placeholders
+	debug  everything is written as it is, for development only, it must be enabled explicitly
+
+Anything that could tie a circuit to a user goes through Addr, Session, Payload or Sensitive, which check the
+mode, never straight into a log call.
+*/
+
+const (
+	MODE_SAFE  = "safe"
+	MODE_DEBUG = "debug"
+
+	REDACTED = "[redacted]"
+)
+
+var debugMode atomic.Bool
+
+// Setup makes a text logger writing to w at level the default slog logger, and selects the mode
+func Setup(w io.Writer, level slog.Level, mode string) *slog.Logger {
+	debugMode.Store(mode == MODE_DEBUG)
+
+	logger := slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	return logger
+}
+
+// DebugMode reports whether sensitive values are logged
+func DebugMode() bool {
+	return debugMode.Load()
+}
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+
+	switch strings.ToLower(name) {
+	case "debug", "info", "warn", "error":
+		err := level.UnmarshalText([]byte(name))
+		return level, err
+	default:
+		return level, fmt.Errorf("%q must be debug, info, warn or error", name)
+	}
+}
+
+// ParseMode checks a mode name: safe or debug
+func ParseMode(name string) (string, error) {
+	switch name {
+	case MODE_SAFE, MODE_DEBUG:
+		return name, nil
+	default:
+		return "", fmt.Errorf("%q must be %s or %s", name, MODE_SAFE, MODE_DEBUG)
+	}
+}
+
+// Sensitive is an attribute only written in debug mode
+func Sensitive(key string, value any) slog.Attr {
+	if !DebugMode() {
+		return slog.String(key, REDACTED)
+	}
+	return slog.Any(key, value)
+}
+
+// Addr is an address a request came from or goes to
+func Addr(key string, addr string) slog.Attr {
+	return Sensitive(key, addr)
+}
+
+// Session is a session token
+func Session(token string) slog.Attr {
+	return Sensitive("session", token)
+}
+
+// Payload is the body of a request or answer, not even its size is written in safe mode
+func Payload(key string, data []byte) slog.Attr {
+	if !DebugMode() {
+		return slog.String(key, REDACTED)
+	}
+	return slog.String(key, string(data))
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+Relay metrics, served in the Prometheus format on the admin listener of the node.
+
+Labels only ever hold values from a small fixed set (handler names, message types, handshake versions,
+status codes), never an address, a session token or anything else that comes from a circuit.
+*/
+
+const NAMESPACE = "marshmello"
+
+// Message types the relay forwards, anything else is counted as "other" so a client can't create labels
+var knownMsgTypes = map[string]bool{
+	"get-aes":        true,
+	"set-redirect":   true,
+	"redirect":       true,
+	"auth/register":  true,
+	"auth/login":     true,
+	"messages/send":  true,
+	"messages/fetch": true,
+	"rekey":          true,
+	"begin":          true,
+	"data":           true,
+	"end":            true,
+}
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	Handshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "handshakes_total",
+		Help:      "Key exchanges completed, by handshake version.",
+	}, []string{"version"})
+
+	CipherSuites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "cipher_suites_total",
+		Help:      "Sessions created, by the cipher suite negotiated.",
+	}, []string{"suite"})
+
+	Redirects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "redirects_total",
+		Help:      "Requests forwarded to the redirect address, by message type.",
+	}, []string{"msg_type"})
+
+	RedirectAddressesSet = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "redirect_addresses_set_total",
+		Help:      "Redirect addresses set by clients.",
+	})
+
+	Rekeys = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "rekeys_total",
+		Help:      "Session keys ratcheted on the request of clients.",
+	})
+
+	OpenStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "open_streams",
+		Help:      "Client streams connected to their target by this relay.",
+	})
+
+	UpstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "upstream_duration_seconds",
+		Help:      "Time for the redirect address to answer a forwarded request, by message type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"msg_type"})
+
+	Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "errors_total",
+		Help:      "Error answers, by handler and status code.",
+	}, []string{"handler", "code"})
+
+	BytesRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "relayed_bytes_total",
+		Help:      "Bytes relayed, forward (towards the destination) or backward (towards the client).",
+	}, []string{"direction"})
+)
+
+func init() {
+	Registry.MustRegister(
+		Handshakes,
+		CipherSuites,
+		Redirects,
+		RedirectAddressesSet,
+		Rekeys,
+		OpenStreams,
+		UpstreamLatency,
+		Errors,
+		BytesRelayed,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// RegisterActiveSessions adds a gauge of the live sessions, count is called on every scrape
+func RegisterActiveSessions(count func() (int, error)) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "active_sessions",
+		Help:      "Circuit sessions currently stored.",
+	}, func() float64 {
+		n, err := count()
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	}))
+}
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// MsgType is the label for a message type
+func MsgType(msgType string) string {
+	if knownMsgTypes[msgType] {
+		return msgType
+	}
+	return "other"
+}
+
+// Error counts an error answered by handler
+func Error(handler string, statusCode int) {
+	Errors.WithLabelValues(handler, strconv.Itoa(statusCode)).Inc()
+}
+
+// Relayed counts the bytes of a message forwarded and of its answer
+func Relayed(forward int, backward int) {
+	BytesRelayed.WithLabelValues("forward").Add(float64(forward))
+	BytesRelayed.WithLabelValues("backward").Add(float64(backward))
+}
+
+// Instrument counts the error answers of the handler
+func Instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status >= http.StatusBadRequest {
+			Error(handler, rec.status)
+		}
+	}
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets instrumented handlers take the connection over, like links do
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap lets instrumented handlers flush what they wrote, like chunked answers do
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
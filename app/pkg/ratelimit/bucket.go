@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket refills at rate tokens per second up to burst tokens, every operation spends some of them
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last call, the caller holds the lock
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow spends n tokens if the bucket has them, and reports whether it did
+func (b *TokenBucket) Allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// Wait spends n tokens, sleeping until the bucket has earned them.
+// The bucket may go below zero, so an n larger than the burst still goes through at the bucket's rate.
+func (b *TokenBucket) Wait(n float64) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= n
+	missing := -b.tokens
+	b.mu.Unlock()
+
+	if missing > 0 {
+		time.Sleep(time.Duration(missing / b.rate * float64(time.Second)))
+	}
+}
+
+// full reports whether the bucket has refilled up to its burst by now
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
@@ -0,0 +1,43 @@
+package ratelimit
+
+import "net"
+
+// throttledListener hands out connections that share one bandwidth bucket
+type throttledListener struct {
+	net.Listener
+	bucket *TokenBucket
+}
+
+type throttledConn struct {
+	net.Conn
+	bucket *TokenBucket
+}
+
+// Listener limits the bytes read and written on every connection accepted by l to the rate of bucket, in bytes per second.
+// The limit is shared by all the connections, links included since they are hijacked from them.
+func Listener(l net.Listener, bucket *TokenBucket) net.Listener {
+	return &throttledListener{Listener: l, bucket: bucket}
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledConn{Conn: conn, bucket: l.bucket}, nil
+}
+
+// Read pays for the bytes once they are read, so a slow peer doesn't hold tokens it hasn't used
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.bucket.Wait(float64(n))
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	c.bucket.Wait(float64(len(p)))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// How often the buckets left alone are dropped
+const SWEEP_INTERVAL = time.Minute
+
+// KeyedLimiter keeps a token bucket per key, like a remote IP or a session
+type KeyedLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*TokenBucket
+	lastSweep time.Time
+}
+
+// NewKeyedLimiter allows every key rate requests per second, and burst at once
+func NewKeyedLimiter(rate float64, burst float64) *KeyedLimiter {
+	return &KeyedLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*TokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow spends a token of the key's bucket, and reports whether there was one
+func (l *KeyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > SWEEP_INTERVAL {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	return bucket.Allow(1)
+}
+
+// RetryAfter is how long a refused key waits for its next token
+func (l *KeyedLimiter) RetryAfter() time.Duration {
+	return time.Duration(math.Ceil(1/l.rate)) * time.Second
+}
+
+// sweep drops the buckets that filled up again, a new bucket is the same, the caller holds the lock
+func (l *KeyedLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// ConcurrencyLimit caps how many operations run at once
+type ConcurrencyLimit struct {
+	slots chan struct{}
+}
+
+func NewConcurrencyLimit(max int) *ConcurrencyLimit {
+	return &ConcurrencyLimit{slots: make(chan struct{}, max)}
+}
+
+// TryAcquire takes a slot without waiting, and reports whether there was one. A taken slot must be released.
+func (c *ConcurrencyLimit) TryAcquire() bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ConcurrencyLimit) Release() {
+	<-c.slots
+}
@@ -0,0 +1,229 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	data      SessionData
+	expiresAt time.Time
+}
+
+// MemoryStore keeps sessions in process memory, expired sessions are swept periodically
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memoryEntry
+	ttl      time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewMemoryStore creates an in-memory store whose sessions live for ttl, expired sessions are swept every sweepInterval
+func NewMemoryStore(sweepInterval time.Duration, ttl time.Duration) *MemoryStore {
+	ms := &MemoryStore{
+		sessions: make(map[string]*memoryEntry),
+		ttl:      ttl,
+		stop:     make(chan struct{}),
+	}
+
+	go ms.sweep(sweepInterval)
+
+	return ms
+}
+
+// sweep removes expired sessions until the store is closed
+func (ms *MemoryStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.stop:
+			return
+		case now := <-ticker.C:
+			ms.mu.Lock()
+			for token, entry := range ms.sessions {
+				if now.After(entry.expiresAt) {
+					delete(ms.sessions, token)
+				}
+			}
+			ms.mu.Unlock()
+		}
+	}
+}
+
+// Close stops the sweeping goroutine
+func (ms *MemoryStore) Close() {
+	ms.once.Do(func() {
+		close(ms.stop)
+	})
+}
+
+// lookup returns a live session entry, the caller must hold the lock
+func (ms *MemoryStore) lookup(sessionToken string) (*memoryEntry, error) {
+	entry, ok := ms.sessions[sessionToken]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(ms.sessions, sessionToken)
+		return nil, ErrSessionNotFound
+	}
+
+	return entry, nil
+}
+
+// CreateSession creates a new session with the cipher suite and the provided forward and backward keys
+func (ms *MemoryStore) CreateSession(suite int, forwardKey string, backwardKey string) (string, error) {
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sessions[sessionToken] = &memoryEntry{
+		data: SessionData{
+			Suite:       suite,
+			ForwardKey:  forwardKey,
+			BackwardKey: backwardKey,
+			Address:     "",
+		},
+		expiresAt: time.Now().Add(ms.ttl),
+	}
+
+	return sessionToken, nil
+}
+
+// UpdateAddress updates the address in the session
+func (ms *MemoryStore) UpdateAddress(sessionToken, addr string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, err := ms.lookup(sessionToken)
+	if err != nil {
+		return err
+	}
+
+	entry.data.Address = addr
+	return nil
+}
+
+// PullData retrieves a copy of the session data
+func (ms *MemoryStore) PullData(sessionToken string) (*SessionData, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, err := ms.lookup(sessionToken)
+	if err != nil {
+		return nil, err
+	}
+
+	data := entry.data
+	return &data, nil
+}
+
+// DeleteSession removes the session
+func (ms *MemoryStore) DeleteSession(sessionToken string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, err := ms.lookup(sessionToken); err != nil {
+		return err
+	}
+
+	delete(ms.sessions, sessionToken)
+	return nil
+}
+
+// Expire resets the time to live of the session
+func (ms *MemoryStore) Expire(sessionToken string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, err := ms.lookup(sessionToken)
+	if err != nil {
+		return err
+	}
+
+	entry.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+// Count returns the number of sessions that haven't expired
+func (ms *MemoryStore) Count() (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, entry := range ms.sessions {
+		if !now.After(entry.expiresAt) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// CheckSequence accepts the sequence number of a message once
+func (ms *MemoryStore) CheckSequence(sessionToken string, seq uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, err := ms.lookup(sessionToken)
+	if err != nil {
+		return err
+	}
+
+	last, window, ok := acceptSequence(entry.data.LastSeq, entry.data.SeqWindow, seq)
+	if !ok {
+		return ErrReplay
+	}
+
+	entry.data.LastSeq = last
+	entry.data.SeqWindow = window
+	return nil
+}
+
+// RotateKeys replaces the keys of the session with the ones of generation, the replaced ones become the previous keys
+func (ms *MemoryStore) RotateKeys(sessionToken string, generation uint64, forwardKey string, backwardKey string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, err := ms.lookup(sessionToken)
+	if err != nil {
+		return err
+	}
+
+	if generation != entry.data.Generation+1 {
+		return ErrKeyGeneration
+	}
+
+	entry.data.PreviousForwardKey = entry.data.ForwardKey
+	entry.data.PreviousBackwardKey = entry.data.BackwardKey
+	entry.data.ForwardKey = forwardKey
+	entry.data.BackwardKey = backwardKey
+	entry.data.Generation = generation
+	return nil
+}
+
+// DropPreviousKeys deletes the previous keys if the session still has the keys of generation
+func (ms *MemoryStore) DropPreviousKeys(sessionToken string, generation uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, err := ms.lookup(sessionToken)
+	if err != nil {
+		return err
+	}
+
+	if entry.data.Generation == generation {
+		entry.data.PreviousForwardKey = ""
+		entry.data.PreviousBackwardKey = ""
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How many times a sequence check or a key rotation is tried again when another request on the session updated it first
+const MAX_SEQUENCE_RETRIES = 10
+
+// RedisStore keeps sessions as Redis hashes under "session:<token>"
+type RedisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisStore(redisAddr string, ttl time.Duration) (*RedisStore, error) {
+	err := error(nil)
+	client := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+
+	// Create context for Redis operations
+	ctx := context.Background()
+
+	// Test the connection
+	_, err = client.Ping(ctx).Result()
+
+	return &RedisStore{
+		client: client,
+		ttl:    ttl,
+	}, err
+}
+
+// CreateSession creates a new session with the cipher suite and the provided forward and backward keys
+func (rs *RedisStore) CreateSession(suite int, forwardKey string, backwardKey string) (string, error) {
+	ctx := context.Background()
+
+	// Generate session token
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	// Create session data
+	sessionData := SessionData{
+		Suite:       suite,
+		ForwardKey:  forwardKey,
+		BackwardKey: backwardKey,
+		Address:     "",
+	}
+
+	// Store in Redis, expiring after the session TTL
+	err = rs.client.HSet(ctx, "session:"+sessionToken, "suite", strconv.Itoa(sessionData.Suite), "forward_key", sessionData.ForwardKey, "backward_key", sessionData.BackwardKey).Err()
+	if err != nil {
+		return "", err
+	}
+
+	err = rs.client.HSet(ctx, "session:"+sessionToken, "address", sessionData.Address).Err()
+	if err != nil {
+		return "", err
+	}
+
+	err = rs.client.Expire(ctx, "session:"+sessionToken, rs.ttl).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return sessionToken, nil
+}
+
+// UpdateAddress updates the address in the session
+func (rs *RedisStore) UpdateAddress(sessionToken, addr string) error {
+	ctx := context.Background()
+
+	// Check if session exists
+	exists, err := rs.client.Exists(ctx, "session:"+sessionToken).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrSessionNotFound
+	}
+
+	// Update address
+	err = rs.client.HSet(ctx, "session:"+sessionToken, "address", addr).Err()
+	return err
+}
+
+// PullData retrieves all session data
+func (rs *RedisStore) PullData(sessionToken string) (*SessionData, error) {
+	ctx := context.Background()
+
+	// Check if session exists
+	exists, err := rs.client.Exists(ctx, "session:"+sessionToken).Result()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	// Get the cipher suite and the keys of both directions
+	keys, err := rs.client.HMGet(ctx, "session:"+sessionToken, "suite", "forward_key", "backward_key", "previous_forward_key", "previous_backward_key").Result()
+	if err != nil {
+		return nil, err
+	}
+	forwardKey, _ := keys[1].(string)
+	backwardKey, _ := keys[2].(string)
+	previousForwardKey, _ := keys[3].(string)
+	previousBackwardKey, _ := keys[4].(string)
+
+	// Get address
+	address, err := rs.client.HGet(ctx, "session:"+sessionToken, "address").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the sequence numbers seen and the key generation, they aren't set before the first message and rekey
+	counters, err := rs.client.HMGet(ctx, "session:"+sessionToken, "last_seq", "seq_window", "generation").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionData{
+		Suite:       int(parseUint(keys[0])),
+		ForwardKey:  forwardKey,
+		BackwardKey: backwardKey,
+		Address:     address,
+		LastSeq:     parseUint(counters[0]),
+		SeqWindow:   parseUint(counters[1]),
+		Generation:  parseUint(counters[2]),
+
+		PreviousForwardKey:  previousForwardKey,
+		PreviousBackwardKey: previousBackwardKey,
+	}, nil
+}
+
+// DeleteSession removes the session hash
+func (rs *RedisStore) DeleteSession(sessionToken string) error {
+	ctx := context.Background()
+
+	deleted, err := rs.client.Del(ctx, "session:"+sessionToken).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// Expire resets the expiration of the session hash
+func (rs *RedisStore) Expire(sessionToken string, ttl time.Duration) error {
+	ctx := context.Background()
+
+	ok, err := rs.client.Expire(ctx, "session:"+sessionToken, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// Count counts the session hashes, scanning in batches so Redis isn't blocked
+func (rs *RedisStore) Count() (int, error) {
+	ctx := context.Background()
+
+	count := 0
+	iter := rs.client.Scan(ctx, 0, "session:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		count++
+	}
+
+	return count, iter.Err()
+}
+
+// CheckSequence accepts the sequence number of a message once. The check and the update run in a transaction
+// watching the session, so two requests with the same number can't both go through.
+func (rs *RedisStore) CheckSequence(sessionToken string, seq uint64) error {
+	ctx := context.Background()
+	key := "session:" + sessionToken
+
+	check := func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, key, "forward_key", "last_seq", "seq_window").Result()
+		if err != nil {
+			return err
+		}
+		if values[0] == nil {
+			return ErrSessionNotFound
+		}
+
+		last, window, ok := acceptSequence(parseUint(values[1]), parseUint(values[2]), seq)
+		if !ok {
+			return ErrReplay
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "last_seq", strconv.FormatUint(last, 10), "seq_window", strconv.FormatUint(window, 10))
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < MAX_SEQUENCE_RETRIES; i++ {
+		err := rs.client.Watch(ctx, check, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// RotateKeys replaces the keys of the session with the ones of generation, the replaced ones become the previous
+// keys. The check of the generation and the update run in a transaction watching the session, like CheckSequence.
+func (rs *RedisStore) RotateKeys(sessionToken string, generation uint64, forwardKey string, backwardKey string) error {
+	ctx := context.Background()
+	key := "session:" + sessionToken
+
+	rotate := func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, key, "forward_key", "generation", "backward_key").Result()
+		if err != nil {
+			return err
+		}
+		if values[0] == nil {
+			return ErrSessionNotFound
+		}
+
+		if generation != parseUint(values[1])+1 {
+			return ErrKeyGeneration
+		}
+		previousForwardKey, _ := values[0].(string)
+		previousBackwardKey, _ := values[2].(string)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "previous_forward_key", previousForwardKey, "previous_backward_key", previousBackwardKey,
+				"forward_key", forwardKey, "backward_key", backwardKey, "generation", strconv.FormatUint(generation, 10))
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < MAX_SEQUENCE_RETRIES; i++ {
+		err := rs.client.Watch(ctx, rotate, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// DropPreviousKeys deletes the previous keys if the session still has the keys of generation, in a transaction
+// watching the session like RotateKeys
+func (rs *RedisStore) DropPreviousKeys(sessionToken string, generation uint64) error {
+	ctx := context.Background()
+	key := "session:" + sessionToken
+
+	drop := func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, key, "forward_key", "generation").Result()
+		if err != nil {
+			return err
+		}
+		if values[0] == nil {
+			return ErrSessionNotFound
+		}
+
+		if parseUint(values[1]) != generation {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, key, "previous_forward_key", "previous_backward_key")
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < MAX_SEQUENCE_RETRIES; i++ {
+		err := rs.client.Watch(ctx, drop, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// parseUint reads a number of a session hash, a field that isn't set is 0
+func parseUint(value interface{}) uint64 {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
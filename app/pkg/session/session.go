@@ -1,131 +1,118 @@
 package session
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
-type SessionManager struct {
-	client *redis.Client
-}
-
-type SessionData struct {
-	AESKey  string `json:"aes_key"`
-	Address string `json:"address"`
-}
+const (
+	SESSION_TTL = 24 * time.Hour
 
-func NewSessionManager(redisAddr string) (*SessionManager, error) {
-	err := error(nil)
-	client := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
+	STORE_REDIS  = "redis"
+	STORE_MEMORY = "memory"
 
-	// Create context for Redis operations
-	ctx := context.Background()
+	// How far below the highest sequence number seen a message is still accepted, messages sent at the same
+	// time on a circuit may arrive out of order
+	REPLAY_WINDOW = 64
+)
 
-	// Test the connection
-	_, err = client.Ping(ctx).Result()
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrReplay          = errors.New("sequence number already seen or out of the window")
+	ErrKeyGeneration   = errors.New("unexpected key generation")
+)
 
-	return &SessionManager{
-		client: client,
-	}, err
+// SessionStore is the storage backend used by the relay handlers to keep per-circuit state
+type SessionStore interface {
+	// CreateSession creates a new session with the cipher suite and the provided forward and backward keys and returns its token
+	CreateSession(suite int, forwardKey string, backwardKey string) (string, error)
+	// PullData retrieves all session data
+	PullData(sessionToken string) (*SessionData, error)
+	// UpdateAddress updates the redirect address in the session
+	UpdateAddress(sessionToken, addr string) error
+	// DeleteSession removes the session and all of its data
+	DeleteSession(sessionToken string) error
+	// Expire resets the time to live of the session
+	Expire(sessionToken string, ttl time.Duration) error
+	// Count returns the number of live sessions
+	Count() (int, error)
+	// CheckSequence accepts the sequence number of a message once, it fails with ErrReplay for a number
+	// already seen or too far below the highest one
+	CheckSequence(sessionToken string, seq uint64) error
+	// RotateKeys replaces the keys of the session with the ones of generation and keeps the replaced ones as the
+	// previous keys, it fails with ErrKeyGeneration unless the session has the keys of the generation before
+	RotateKeys(sessionToken string, generation uint64, forwardKey string, backwardKey string) error
+	// DropPreviousKeys deletes the previous keys once the client used the keys of generation, it does nothing
+	// when the session moved to another generation since
+	DropPreviousKeys(sessionToken string, generation uint64) error
 }
 
-// generateSessionToken creates a random session token
-func generateSessionToken() (string, error) {
-	b := make([]byte, 32)
-	_, err := rand.Read(b)
-	if err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(b), nil
+type SessionData struct {
+	Suite       int    `json:"suite"`        // cipher suite of the keys, see encryption.NewSessionCipher
+	ForwardKey  string `json:"forward_key"`  // opens what the client sends
+	BackwardKey string `json:"backward_key"` // encrypts the answers
+	Address     string `json:"address"`
+	LastSeq     uint64 `json:"last_seq"`   // highest sequence number seen
+	SeqWindow   uint64 `json:"seq_window"` // bit i is set when LastSeq-i was seen
+	Generation  uint64 `json:"generation"` // how many times the keys were ratcheted
+
+	// Keys of the generation before, kept until the client uses the current ones so a rekey whose answer was
+	// lost can be asked again, empty otherwise
+	PreviousForwardKey  string `json:"previous_forward_key"`
+	PreviousBackwardKey string `json:"previous_backward_key"`
 }
 
-// CreateSession creates a new session with the provided AES key
-func (sm *SessionManager) CreateSession(aesKey string) (string, error) {
-	ctx := context.Background()
-
-	// Generate session token
-	sessionToken, err := generateSessionToken()
-	if err != nil {
-		return "", err
-	}
-
-	// Create session data
-	sessionData := SessionData{
-		AESKey:  aesKey,
-		Address: "",
-	}
-
-	// Store in Redis with 24-hour expiration
-	err = sm.client.HSet(ctx, "session:"+sessionToken, "aes_key", sessionData.AESKey).Err()
-	if err != nil {
-		return "", err
-	}
-
-	err = sm.client.HSet(ctx, "session:"+sessionToken, "address", sessionData.Address).Err()
-	if err != nil {
-		return "", err
+// acceptSequence checks seq against the highest number seen and the window below it,
+// and returns them updated. Sequence numbers start at 1.
+func acceptSequence(last uint64, window uint64, seq uint64) (uint64, uint64, bool) {
+	if seq == 0 {
+		return last, window, false
 	}
 
-	err = sm.client.Expire(ctx, "session:"+sessionToken, 24*time.Hour).Err()
-	if err != nil {
-		return "", err
+	if seq > last {
+		shift := seq - last
+		if shift >= REPLAY_WINDOW {
+			window = 0
+		} else {
+			window <<= shift
+		}
+		return seq, window | 1, true
 	}
 
-	return sessionToken, nil
-}
-
-// UpdateAddress updates the address in the session
-func (sm *SessionManager) UpdateAddress(sessionToken, addr string) error {
-	ctx := context.Background()
-
-	// Check if session exists
-	exists, err := sm.client.Exists(ctx, "session:"+sessionToken).Result()
-	if err != nil {
-		return err
-	}
-	if exists == 0 {
-		return errors.New("session not found")
+	offset := last - seq
+	if offset >= REPLAY_WINDOW || window&(1<<offset) != 0 {
+		return last, window, false
 	}
 
-	// Update address
-	err = sm.client.HSet(ctx, "session:"+sessionToken, "address", addr).Err()
-	return err
+	return last, window | 1<<offset, true
 }
 
-// PullData retrieves all session data
-func (sm *SessionManager) PullData(sessionToken string) (*SessionData, error) {
-	ctx := context.Background()
-
-	// Check if session exists
-	exists, err := sm.client.Exists(ctx, "session:"+sessionToken).Result()
-	if err != nil {
-		return nil, err
-	}
-	if exists == 0 {
-		return nil, errors.New("session not found")
+// NewSessionStore creates the session store selected by backend ("redis" or "memory"),
+// sessions expire after ttl (SESSION_TTL when zero)
+func NewSessionStore(backend string, redisAddr string, ttl time.Duration) (SessionStore, error) {
+	if ttl <= 0 {
+		ttl = SESSION_TTL
 	}
 
-	// Get AES key
-	aesKey, err := sm.client.HGet(ctx, "session:"+sessionToken, "aes_key").Result()
-	if err != nil {
-		return nil, err
+	switch backend {
+	case STORE_REDIS, "":
+		return NewRedisStore(redisAddr, ttl)
+	case STORE_MEMORY:
+		return NewMemoryStore(time.Minute, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown session store: %s", backend)
 	}
+}
 
-	// Get address
-	address, err := sm.client.HGet(ctx, "session:"+sessionToken, "address").Result()
+// generateSessionToken creates a random session token
+func generateSessionToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	return &SessionData{
-		AESKey:  aesKey,
-		Address: address,
-	}, nil
+	return hex.EncodeToString(b), nil
 }
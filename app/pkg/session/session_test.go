@@ -0,0 +1,109 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcceptSequence(t *testing.T) {
+	tests := []struct {
+		name  string
+		seqs  []uint64 // accepted in order before seq
+		seq   uint64
+		allow bool
+	}{
+		{"zero", nil, 0, false},
+		{"first", nil, 1, true},
+		{"next", []uint64{1}, 2, true},
+		{"same", []uint64{1}, 1, false},
+		{"gap", []uint64{1}, 10, true},
+		{"late inside the window", []uint64{1, 10}, 5, true},
+		{"late seen", []uint64{1, 10, 5}, 5, false},
+		{"oldest of the window", []uint64{REPLAY_WINDOW}, 1, true},
+		{"just below the window", []uint64{REPLAY_WINDOW + 1}, 1, false},
+		{"highest kept after a shift inside the window", []uint64{1, REPLAY_WINDOW}, 1, false},
+		{"window cleared by a shift of its size", []uint64{1, 1 + REPLAY_WINDOW}, 2, true},
+		{"previous highest out of a shift of the window size", []uint64{1, 1 + REPLAY_WINDOW}, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var last, window uint64
+			for _, seq := range tt.seqs {
+				var ok bool
+				last, window, ok = acceptSequence(last, window, seq)
+				if !ok {
+					t.Fatalf("setup: sequence number %d refused", seq)
+				}
+			}
+
+			newLast, newWindow, ok := acceptSequence(last, window, tt.seq)
+			if ok != tt.allow {
+				t.Fatalf("acceptSequence(%d) after %v = %v, want %v", tt.seq, tt.seqs, ok, tt.allow)
+			}
+			if !ok && (newLast != last || newWindow != window) {
+				t.Fatalf("refused sequence number %d changed the window", tt.seq)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreCheckSequence(t *testing.T) {
+	ms := NewMemoryStore(time.Hour, time.Hour)
+	defer ms.Close()
+
+	token, err := ms.CreateSession(1, "forward", "backward")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.CheckSequence(token, 1); err != nil {
+		t.Fatalf("first message refused: %v", err)
+	}
+	if err := ms.CheckSequence(token, 1); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replayed message: got %v, want ErrReplay", err)
+	}
+	if err := ms.CheckSequence("unknown", 1); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("unknown session: got %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestMemoryStoreRotateKeys(t *testing.T) {
+	ms := NewMemoryStore(time.Hour, time.Hour)
+	defer ms.Close()
+
+	token, err := ms.CreateSession(1, "forward", "backward")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.RotateKeys(token, 2, "forward2", "backward2"); !errors.Is(err, ErrKeyGeneration) {
+		t.Fatalf("skipped generation: got %v, want ErrKeyGeneration", err)
+	}
+	if err := ms.RotateKeys(token, 1, "forward1", "backward1"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ms.PullData(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Generation != 1 || data.ForwardKey != "forward1" || data.PreviousForwardKey != "forward" || data.PreviousBackwardKey != "backward" {
+		t.Fatalf("rotated session: %+v", data)
+	}
+
+	// Only the generation the session has lets its previous keys go
+	if err := ms.DropPreviousKeys(token, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ms.PullData(token); data.PreviousForwardKey == "" {
+		t.Fatal("previous keys dropped for another generation")
+	}
+	if err := ms.DropPreviousKeys(token, 1); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ms.PullData(token); data.PreviousForwardKey != "" || data.PreviousBackwardKey != "" {
+		t.Fatalf("previous keys kept: %+v", data)
+	}
+}